@@ -0,0 +1,128 @@
+package besticon
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// AddressPolicy decides which IP addresses lookups may connect to, so a
+// lookup can't be used to reach internal services. An address is allowed
+// if it is in one of the Allow prefixes or in none of the Deny prefixes.
+// IPv4-mapped IPv6 addresses are checked as IPv4 addresses.
+type AddressPolicy struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// DefaultDeniedPrefixes are the networks DefaultAddressPolicy denies:
+// everything that is not the public internet, e.g. loopback, private,
+// link-local including the 169.254.169.254 cloud metadata endpoint,
+// carrier-grade NAT and multicast.
+var DefaultDeniedPrefixes = mustParsePrefixes(
+	"0.0.0.0/8",      // "this network", 0.0.0.0 reaches localhost
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, includes broadcast
+	"::/96",          // unspecified, loopback and IPv4-compatible
+	"64:ff9b:1::/48", // local-use IPv4/IPv6 translation
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"fec0::/10",      // site-local
+	"ff00::/8",       // multicast
+)
+
+// DefaultAddressPolicy returns the policy lookups use unless configured
+// otherwise, it denies DefaultDeniedPrefixes.
+func DefaultAddressPolicy() *AddressPolicy {
+	return &AddressPolicy{Deny: slices.Clone(DefaultDeniedPrefixes)}
+}
+
+// Allowed reports whether lookups may connect to ip.
+func (p *AddressPolicy) Allowed(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	ip = ip.Unmap().WithZone("")
+
+	for _, prefix := range p.Allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	for _, prefix := range p.Deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkHost rejects host early if it is an IP address the policy denies.
+// Host names are checked when connecting, see NewDialer.
+func (p *AddressPolicy) checkHost(host string) error {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	if !p.Allowed(ip) {
+		return &PrivateAddressError{Host: host, IP: net.IP(ip.Unmap().AsSlice())}
+	}
+	return nil
+}
+
+// NewDialer returns a dialer that refuses to connect to addresses policy
+// denies. As the check happens on the address actually connected to, it
+// covers every address a name resolves to, every redirect hop, and DNS
+// answers that change between lookups.
+func NewDialer(policy *AddressPolicy) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		ControlContext: func(_ context.Context, network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !policy.Allowed(addrPort.Addr()) {
+				return &PrivateAddressError{Host: address, IP: net.IP(addrPort.Addr().Unmap().AsSlice())}
+			}
+			return nil
+		},
+	}
+}
+
+type addressPolicyOption struct {
+	policy *AddressPolicy
+}
+
+func (a *addressPolicyOption) applyOption(b *Besticon) {
+	b.addressPolicy = a.policy
+}
+
+// WithAddressPolicy sets which addresses lookups may connect to,
+// DefaultAddressPolicy by default. The policy is enforced by the default
+// HTTP client. Clients passed to WithHTTPClient need to dial with
+// NewDialer(policy) for that, otherwise only IP addresses in URLs are
+// checked.
+func WithAddressPolicy(policy *AddressPolicy) Option {
+	return &addressPolicyOption{policy: policy}
+}
+
+func mustParsePrefixes(prefixes ...string) []netip.Prefix {
+	var result []netip.Prefix
+	for _, s := range prefixes {
+		result = append(result, netip.MustParsePrefix(s))
+	}
+	return result
+}
@@ -4,19 +4,24 @@ package besticon
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"image"
 	"image/color"
 	"io"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/golang/groupcache"
+	"github.com/golang/groupcache/singleflight"
 
 	// Load supported image formats.
 	_ "image/gif"
@@ -24,20 +29,42 @@ import (
 	_ "image/png"
 
 	_ "github.com/mat/besticon/v3/ico"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
 
 	"github.com/mat/besticon/v3/colorfinder"
+	"github.com/mat/besticon/v3/svgraster"
 
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/html/charset"
 )
 
 // Besticon is the main interface to the besticon package.
 type Besticon struct {
-	httpClient *http.Client
-	iconCache  *groupcache.Group
-	logger     Logger
+	httpClient    *http.Client
+	addressPolicy *AddressPolicy
+	proxy         *ProxyConfig
+	cache         Cache
+	imageStore    ImageStore
+	images        *imageWriter
+	loads         singleflight.Group
+	logger        Logger
+	log           *slog.Logger
+	now           func() time.Time
+
+	lookupObserver func(siteURL string, icons []Icon, err error)
+	tracer         trace.Tracer
+
+	cacheTTL             time.Duration
+	negativeCacheTTL     time.Duration
+	staleWhileRevalidate time.Duration
+
+	fallbacks *Fallbacks
+	timeouts  *Timeouts
 
 	defaultFormats      []string
 	discardImageBytes   bool
+	disableCookies      bool
 	maxResponseBodySize int64
 }
 
@@ -57,35 +84,127 @@ func New(opts ...Option) *Besticon {
 		b.maxResponseBodySize = 10485760 // 10MB
 	}
 
+	if b.addressPolicy == nil {
+		b.addressPolicy = DefaultAddressPolicy()
+	}
+
+	if b.timeouts == nil {
+		timeouts := DefaultTimeouts
+		b.timeouts = &timeouts
+	}
+
 	if b.httpClient == nil {
-		b.httpClient = NewDefaultHTTPClient()
+		b.httpClient = newHTTPClient(b.addressPolicy, b.proxy, *b.timeouts)
 	}
 
 	if b.logger == nil {
 		b.logger = NewDefaultLogger(os.Stdout)
 	}
 
+	if b.log == nil {
+		b.log = slog.New(NewLoggerHandler(b.logger))
+	}
+
+	if b.now == nil {
+		b.now = time.Now
+	}
+
+	if b.imageStore != nil {
+		b.images = newImageWriter(b.imageStore, b.log)
+	}
+
+	if b.cacheTTL == 0 {
+		b.cacheTTL = defaultCacheTTL
+	}
+
+	if b.negativeCacheTTL == 0 {
+		b.negativeCacheTTL = defaultNegativeCacheTTL
+	}
+
 	return b
 }
 
-// Icon holds icon information.
+// Icon holds icon information. Error is serialized to JSON as its ErrorCode.
 type Icon struct {
-	URL       string `json:"url"`
-	Width     int    `json:"width"`
-	Height    int    `json:"height"`
-	Format    string `json:"format"`
-	Bytes     int    `json:"bytes"`
-	Error     error  `json:"error"`
-	Sha1sum   string `json:"sha1sum"`
-	ImageData []byte `json:",omitempty"`
+	URL        string     `json:"url"`
+	Width      int        `json:"width"`
+	Height     int        `json:"height"`
+	Format     string     `json:"format"`
+	Bytes      int        `json:"bytes"`
+	Error      error      `json:"error"`
+	Sha1sum    string     `json:"sha1sum"`
+	Provenance Provenance `json:"provenance"`
+	ImageData  []byte     `json:",omitempty"`
+}
+
+func (ico Icon) MarshalJSON() ([]byte, error) {
+	type Alias Icon
+	var code *string
+	if ico.Error != nil {
+		c := ErrorCode(ico.Error)
+		code = &c
+	}
+	return json.Marshal(struct {
+		Alias
+		Error *string `json:"error"`
+	}{Alias(ico), code})
+}
+
+func (ico *Icon) UnmarshalJSON(data []byte) error {
+	type Alias Icon
+	aux := struct {
+		*Alias
+		Error *string `json:"error"`
+	}{Alias: (*Alias)(ico)}
+	if e := json.Unmarshal(data, &aux); e != nil {
+		return e
+	}
+
+	ico.Error = nil
+	if aux.Error != nil {
+		ico.Error = errorForCode(*aux.Error)
+	}
+	return nil
 }
 
+// Provenance records where an icon was found and how it was declared, so
+// you can tell why a site got the icon it got.
+type Provenance struct {
+	// Source is one of the Source* constants.
+	Source string `json:"source"`
+	// Rel, Sizes, Type and Media are the attributes of the declaring tag,
+	// if any. Sizes, Type and Purpose also come from manifests.
+	Rel     string `json:"rel,omitempty"`
+	Sizes   string `json:"sizes,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Media   string `json:"media,omitempty"`
+	Purpose string `json:"purpose,omitempty"`
+	// Redirects lists every URL requested to fetch the icon, starting with
+	// URL, if there were redirects.
+	Redirects []string `json:"redirects,omitempty"`
+}
+
+// Sources for Provenance.Source.
+const (
+	SourceLinkTag       = "link"          // <link rel="icon"> and friends
+	SourceManifest      = "manifest"      // icons member of a Web App Manifest
+	SourceMetaTag       = "meta"          // <meta name="msapplication-...">
+	SourceBrowserconfig = "browserconfig" // tile images in browserconfig.xml
+	SourceDefaultPath   = "default_path"  // probing well-known paths like /favicon.ico
+)
+
 type IconFinder struct {
 	b *Besticon
 
+	// ctx and url are those of the last lookup, for logging.
+	ctx context.Context
+	url string
+
 	FormatsAllowed  []string
 	HostOnlyDomains []string
 	icons           []Icon
+	tileColor       string
+	attempts        []Attempt
 }
 
 func (b *Besticon) NewIconFinder() *IconFinder {
@@ -95,24 +214,49 @@ func (b *Besticon) NewIconFinder() *IconFinder {
 }
 
 func (f *IconFinder) FetchIcons(url string) ([]Icon, error) {
-	url = strings.TrimSpace(url)
-	if !strings.HasPrefix(url, "http:") && !strings.HasPrefix(url, "https:") {
-		url = "http://" + url
-	}
+	return f.FetchIconsContext(context.Background(), url)
+}
 
-	url = f.stripIfNecessary(url)
+// FetchIconsContext is like FetchIcons but aborts all outstanding requests
+// once ctx is done.
+func (f *IconFinder) FetchIconsContext(ctx context.Context, url string) ([]Icon, error) {
+	url = f.siteURL(url)
+	f.ctx, f.url = ctx, url
 
+	var res *result
 	var err error
 
 	if f.b.CacheEnabled() {
-		f.icons, err = f.b.resultFromCache(url)
+		res, err = f.b.resultFromCache(ctx, url)
 	} else {
-		f.icons, err = f.b.fetchIcons(url)
+		res, err = f.b.fetchIcons(ctx, url)
+	}
+
+	f.icons, f.tileColor, f.attempts = nil, "", nil
+	if res != nil {
+		f.icons, f.tileColor, f.attempts = res.Icons, res.TileColor, res.Attempts
 	}
 
 	return f.Icons(), err
 }
 
+func (f *IconFinder) context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+	return f.ctx
+}
+
+// siteURL returns the URL to look up for url, which is also its cache key.
+// Hosts without a scheme are looked up with https, http is a fallback.
+func (f *IconFinder) siteURL(url string) string {
+	url = strings.TrimSpace(url)
+	if !strings.HasPrefix(url, "http:") && !strings.HasPrefix(url, "https:") {
+		url = "https://" + url
+	}
+	return f.stripIfNecessary(url)
+}
+
 // stripIfNecessary removes everything from URL but the Scheme and Host
 // part if URL.Host is found in HostOnlyDomains.
 // This can be used for very popular domains like youtube.com where throttling is
@@ -134,11 +278,23 @@ func (f *IconFinder) stripIfNecessary(URL string) string {
 }
 
 func (f *IconFinder) IconInSizeRange(r SizeRange) *Icon {
+	icon := f.iconInSizeRange(r)
+	if icon == nil {
+		f.b.log.DebugContext(f.context(), "no icon in size range", "url", f.url, "min", r.Min, "perfect", r.Perfect, "max", r.Max, "candidates", len(f.icons))
+	} else {
+		f.b.log.DebugContext(f.context(), "icon selected", "url", f.url, "min", r.Min, "perfect", r.Perfect, "max", r.Max,
+			"icon", icon.URL, "format", icon.Format, "width", icon.Width, "height", icon.Height)
+	}
+	return icon
+}
+
+func (f *IconFinder) iconInSizeRange(r SizeRange) *Icon {
 	icons := f.Icons()
 
-	// 1. SVG always wins
+	// 1. SVG scales to any size, so it wins unless its aspect ratio is too far
+	// off for the range
 	for _, ico := range icons {
-		if ico.Format == "svg" {
+		if ico.Format == "svg" && svgFitsSizeRange(ico.Width, ico.Height, r) {
 			return &ico
 		}
 	}
@@ -162,10 +318,55 @@ func (f *IconFinder) IconInSizeRange(r SizeRange) *Icon {
 	return nil
 }
 
+// RasterizedIconInSizeRange helps clients that can't display SVG: when
+// the allowed formats include PNG it renders the SVG icon IconInSizeRange
+// would pick with SVG allowed into a PNG of exactly r.Perfect pixels. It
+// returns nil if the site has no suitable SVG icon. Needs image bytes, so
+// it never finds anything with WithDiscardImageBytes.
+func (f *IconFinder) RasterizedIconInSizeRange(r SizeRange) (*Icon, error) {
+	if r.Perfect < 1 || !includesString(f.b.formats(f.FormatsAllowed), "png") {
+		return nil, nil
+	}
+
+	var err error
+	for _, ico := range f.icons {
+		if ico.Format != "svg" || ico.ImageData == nil || !svgFitsSizeRange(ico.Width, ico.Height, r) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if e := svgraster.RenderPNG(ico.ImageData, r.Perfect, &buf); e != nil {
+			err = &DecodeError{URL: ico.URL, Err: e}
+			continue
+		}
+
+		ico.Format = "png"
+		ico.Width, ico.Height = r.Perfect, r.Perfect
+		ico.Bytes = buf.Len()
+		ico.Sha1sum = sha1Sum(buf.Bytes())
+		ico.ImageData = buf.Bytes()
+		return &ico, nil
+	}
+	return nil, err
+}
+
 func (f *IconFinder) MainColorForIcons() *color.RGBA {
 	return MainColorForIcons(f.icons)
 }
 
+// TileColor returns the Windows tile color the site declared with
+// <meta name="msapplication-TileColor"> or in its browserconfig.xml, or nil.
+// Like MainColorForIcons it's a hint for coloring fallback icons.
+func (f *IconFinder) TileColor() *color.RGBA {
+	return parseHexColor(f.tileColor)
+}
+
+// Attempts returns the pages the last lookup tried to fetch, in order. It
+// is empty for lookups that failed.
+func (f *IconFinder) Attempts() []Attempt {
+	return f.attempts
+}
+
 func (f *IconFinder) Icons() []Icon {
 	return f.b.discardUnwantedFormats(f.icons, f.FormatsAllowed)
 }
@@ -176,16 +377,20 @@ func (ico *Icon) Image() (*image.Image, error) {
 }
 
 func (b *Besticon) discardUnwantedFormats(icons []Icon, wantedFormats []string) []Icon {
-	formats := b.defaultFormats
-	if len(wantedFormats) > 0 {
-		formats = wantedFormats
-	}
-
+	formats := b.formats(wantedFormats)
 	return filterIcons(icons, func(ico Icon) bool {
 		return includesString(formats, ico.Format)
 	})
 }
 
+// formats returns wantedFormats or, if empty, the default formats.
+func (b *Besticon) formats(wantedFormats []string) []string {
+	if len(wantedFormats) > 0 {
+		return wantedFormats
+	}
+	return b.defaultFormats
+}
+
 type iconPredicate func(Icon) bool
 
 func filterIcons(icons []Icon, pred iconPredicate) []Icon {
@@ -202,48 +407,138 @@ func includesString(arr []string, str string) bool {
 	return slices.Contains(arr, str)
 }
 
-func (b *Besticon) fetchIcons(siteURL string) ([]Icon, error) {
-	var links []string
+// fetchIcons looks up the icons of siteURL, bypassing the cache.
+func (b *Besticon) fetchIcons(ctx context.Context, siteURL string) (*result, error) {
+	ctx, span := b.startSpan(ctx, "besticon.lookup", attrURL.String(siteURL))
+	res, err := b.findIcons(b.withCookieJar(ctx), siteURL)
+	if res != nil {
+		span.SetAttributes(attrIconCount.Int(len(res.Icons)))
+	}
+	endSpan(span, err)
+	if b.lookupObserver != nil && ctx.Err() == nil {
+		var icons []Icon
+		if res != nil {
+			icons = res.Icons
+		}
+		b.lookupObserver(siteURL, icons, err)
+	}
+	return res, err
+}
 
-	html, urlAfterRedirect, e := b.fetchHTML(siteURL)
+func (b *Besticon) findIcons(ctx context.Context, siteURL string) (*result, error) {
+	var links []iconLink
+	var browserconfigURL, tileColor string
+
+	// Requests are made in lookupCtx, ctx tells whether anybody is still
+	// waiting for the result.
+	lookupCtx, cancel := withTimeout(ctx, b.timeouts.Lookup)
+	defer cancel()
+
+	html, urlAfterRedirect, attempts, e := b.fetchPage(lookupCtx, siteURL)
+	if ctx.Err() != nil {
+		// Nobody is waiting for the result anymore, don't try fallbacks.
+		return nil, ctx.Err()
+	}
+	if lookupCtx.Err() != nil {
+		return nil, &TimeoutError{URL: siteURL, Err: lookupCtx.Err()}
+	}
 	if e == nil {
 		// Search HTML for icons
-		links, e = findIconLinks(urlAfterRedirect, html)
+		page, e := findIconLinks(urlAfterRedirect, html)
 		if e != nil {
 			return nil, e
 		}
+		links = page.icons
+		browserconfigURL = page.browserconfigURL
+		tileColor = page.tileColor
+
+		if page.manifestURL != "" {
+			links = append(links, b.fetchManifestIcons(lookupCtx, page.manifestURL)...)
+		}
 	} else {
-		// Unable to fetch the response or got a bad HTTP status code. Try default
-		// icon paths. https://github.com/mat/besticon/discussions/47
+		// Unable to fetch the response or got a bad HTTP status code, neither
+		// for the fallbacks. Try default icon paths.
+		// https://github.com/mat/besticon/discussions/47
 		links, e = defaultIconURLs(siteURL)
 		if e != nil {
 			return nil, e
 		}
+		browserconfigURL, e = defaultBrowserconfigURL(siteURL)
+		if e != nil {
+			return nil, e
+		}
 	}
 
-	icons := b.fetchAllIcons(links)
-	icons = rejectBrokenIcons(icons)
+	if browserconfigURL != "" {
+		tiles, color := b.fetchBrowserconfig(lookupCtx, browserconfigURL)
+		links = append(links, tiles...)
+		if tileColor == "" {
+			tileColor = color
+		}
+	}
+
+	// Icons not fetched within the lookup timeout are left out.
+	icons := b.fetchAllIcons(lookupCtx, uniqueIconLinks(links))
+	if e := ctx.Err(); e != nil {
+		return nil, e
+	}
+	icons = b.rejectBrokenIcons(ctx, icons)
 	sortIcons(icons, true)
 
-	return icons, nil
+	return &result{Icons: icons, TileColor: tileColor, Attempts: attempts}, nil
 }
 
-func (b *Besticon) fetchHTML(url string) ([]byte, *url.URL, error) {
-	r, e := b.Get(url)
+// fetchManifestIcons returns the icons declared in the Web App Manifest at
+// manifestURL. A missing or broken manifest just contributes no icons.
+func (b *Besticon) fetchManifestIcons(ctx context.Context, manifestURL string) []iconLink {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Page)
+	defer cancel()
+
+	r, e := b.GetContext(ctx, manifestURL)
+	if e != nil {
+		return nil
+	}
+
+	body, e := b.GetBodyBytes(r)
+	if e != nil {
+		return nil
+	}
+	if !(r.StatusCode >= 200 && r.StatusCode < 300) {
+		return nil
+	}
+
+	links, e := parseManifestIcons(r.Request.URL, body)
+	if e != nil {
+		b.log.ErrorContext(ctx, "invalid web app manifest", "url", manifestURL, "error", e)
+		return nil
+	}
+	return links
+}
+
+func (b *Besticon) fetchHTML(ctx context.Context, url string) (html []byte, finalURL *url.URL, err error) {
+	ctx, span := b.startSpan(ctx, "besticon.fetchHTML", attrURL.String(url))
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := withTimeout(ctx, b.timeouts.Page)
+	defer cancel()
+
+	r, e := b.GetContext(ctx, url)
 	if e != nil {
 		return nil, nil, e
 	}
+	span.SetAttributes(attrStatusCode.Int(r.StatusCode))
 
 	if !(r.StatusCode >= 200 && r.StatusCode < 300) {
-		return nil, nil, errors.New("besticon: not found")
+		r.Body.Close()
+		return nil, nil, &NotFoundError{URL: url, StatusCode: r.StatusCode}
 	}
 
 	body, e := b.GetBodyBytes(r)
 	if e != nil {
 		return nil, nil, e
 	}
+	span.SetAttributes(attrBodySize.Int(len(body)))
 	if len(body) == 0 {
-		return nil, nil, errors.New("besticon: empty response")
+		return nil, nil, ErrEmptyResponse
 	}
 
 	reader := bytes.NewReader(body)
@@ -266,21 +561,17 @@ func MainColorForIcons(icons []Icon) *color.RGBA {
 	}
 
 	var icon *Icon
-	// Prefer gif, jpg, png
-	for _, ico := range icons {
-		if ico.Format == "gif" || ico.Format == "jpg" || ico.Format == "png" {
-			icon = &ico
-			break
-		}
-	}
-	// Try .ico else
-	if icon == nil {
+	// Prefer single image formats, try .ico else
+	for _, formats := range [][]string{{"gif", "jpg", "png", "webp", "bmp"}, {"ico"}} {
 		for _, ico := range icons {
-			if ico.Format == "ico" {
+			if includesString(formats, ico.Format) {
 				icon = &ico
 				break
 			}
 		}
+		if icon != nil {
+			break
+		}
 	}
 
 	if icon == nil {
@@ -301,66 +592,125 @@ func MainColorForIcons(icons []Icon) *color.RGBA {
 	return &mainColor
 }
 
+// parseHexColor parses #rgb and #rrggbb colors, returning nil for anything
+// else.
+func parseHexColor(s string) *color.RGBA {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return nil
+	}
+
+	rgb, e := strconv.ParseUint(s, 16, 32)
+	if e != nil {
+		return nil
+	}
+	return &color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 0xff}
+}
+
 // Construct default icon URLs. A fallback if we can't fetch the HTML.
-func defaultIconURLs(siteURL string) ([]string, error) {
+func defaultIconURLs(siteURL string) ([]iconLink, error) {
 	baseURL, e := url.Parse(siteURL)
 	if e != nil {
 		return nil, e
 	}
 
-	var links []string
+	var links []iconLink
 	for _, path := range iconPaths {
 		absoluteURL, e := absoluteURL(baseURL, path)
 		if e != nil {
 			return nil, e
 		}
-		links = append(links, absoluteURL)
+		links = append(links, iconLink{URL: absoluteURL, Source: SourceDefaultPath})
 	}
 
 	return links, nil
 }
 
-func (b *Besticon) fetchAllIcons(urls []string) []Icon {
-	ch := make(chan Icon)
+// Construct the default browserconfig.xml URL. A fallback if we can't fetch
+// the HTML.
+func defaultBrowserconfigURL(siteURL string) (string, error) {
+	baseURL, e := url.Parse(siteURL)
+	if e != nil {
+		return "", e
+	}
+	return absoluteURL(baseURL, browserconfigPath)
+}
+
+// fetchAllIcons fetches all links concurrently. If ctx is done before all
+// fetches finished it returns what it has so far; the outstanding requests
+// are aborted through ctx.
+func (b *Besticon) fetchAllIcons(ctx context.Context, links []iconLink) []Icon {
+	ch := make(chan Icon, len(links))
 
-	for _, u := range urls {
-		go func(u string) { ch <- b.fetchIconDetails(u) }(u)
+	for _, l := range links {
+		go func(l iconLink) { ch <- b.fetchIconDetails(ctx, l) }(l)
 	}
 
 	var icons []Icon
-	for range urls {
-		icon := <-ch
-		icons = append(icons, icon)
+	for range links {
+		select {
+		case icon := <-ch:
+			icons = append(icons, icon)
+		case <-ctx.Done():
+			return icons
+		}
 	}
 	return icons
 }
 
-func (b *Besticon) fetchIconDetails(url string) Icon {
-	i := Icon{URL: url}
+func (b *Besticon) fetchIconDetails(ctx context.Context, link iconLink) (i Icon) {
+	ctx, span := b.startSpan(ctx, "besticon.fetchIconDetails", attrURL.String(link.URL))
+	defer func() {
+		if i.Error == nil {
+			span.SetAttributes(attrIconFormat.String(i.Format), attrIconWidth.Int(i.Width), attrIconHeight.Int(i.Height))
+		}
+		endSpan(span, i.Error)
+	}()
+
+	i = Icon{URL: link.URL, Provenance: link.provenance()}
 
-	response, e := b.Get(url)
+	getCtx, cancel := withTimeout(ctx, b.timeouts.Icon)
+	defer cancel()
+	response, e := b.GetContext(getCtx, link.URL)
 	if e != nil {
 		i.Error = e
 		return i
 	}
+	span.SetAttributes(attrStatusCode.Int(response.StatusCode))
+	i.Provenance.Redirects = redirectChain(response)
 
 	body, e := b.GetBodyBytes(response)
 	if e != nil {
 		i.Error = e
 		return i
 	}
+	span.SetAttributes(attrBodySize.Int(len(body)))
 
-	if isSVG(body) {
+	if IsSVG(body) {
 		// Special handling for svg, which golang can't decode with
-		// image.DecodeConfig. Fill in an absurdly large width/height so SVG always
-		// wins size contests.
+		// image.DecodeConfig. We report the intrinsic size and only ever keep
+		// the sanitized document.
+		width, height, e := parseSVGSize(body)
+		if e != nil {
+			i.Error = &DecodeError{URL: link.URL, Err: e}
+			return i
+		}
+		body, e = SanitizeSVG(body)
+		if e != nil {
+			i.Error = &DecodeError{URL: link.URL, Err: e}
+			return i
+		}
+
 		i.Format = "svg"
-		i.Width = 9999
-		i.Height = 9999
+		i.Width = max(1, int(math.Round(width)))
+		i.Height = max(1, int(math.Round(height)))
 	} else {
 		cfg, format, e := image.DecodeConfig(bytes.NewReader(body))
 		if e != nil {
-			i.Error = fmt.Errorf("besticon: unknown image format: %s", e)
+			i.Error = &DecodeError{URL: link.URL, Err: e}
 			return i
 		}
 
@@ -376,6 +726,7 @@ func (b *Besticon) fetchIconDetails(url string) Icon {
 
 	i.Bytes = len(body)
 	i.Sha1sum = sha1Sum(body)
+	b.storeImage(ctx, i.Sha1sum, body)
 	if !b.discardImageBytes {
 		i.ImageData = body
 	}
@@ -383,10 +734,56 @@ func (b *Besticon) fetchIconDetails(url string) Icon {
 	return i
 }
 
-// SVG detector. We can't use image.RegisterFormat, since RegisterFormat is
-// limited to a simple magic number check. It's easy to confuse the first few
-// bytes of HTML with SVG.
-func isSVG(body []byte) bool {
+// fetchBrowserconfig returns the tile images and tile color declared in the
+// browserconfig.xml at browserconfigURL. Most sites don't have one, so a
+// missing or broken file just contributes nothing.
+func (b *Besticon) fetchBrowserconfig(ctx context.Context, browserconfigURL string) ([]iconLink, string) {
+	ctx, cancel := withTimeout(ctx, b.timeouts.Page)
+	defer cancel()
+
+	r, e := b.GetContext(ctx, browserconfigURL)
+	if e != nil {
+		return nil, ""
+	}
+
+	body, e := b.GetBodyBytes(r)
+	if e != nil {
+		return nil, ""
+	}
+	if !(r.StatusCode >= 200 && r.StatusCode < 300) {
+		return nil, ""
+	}
+
+	links, tileColor, e := parseBrowserconfig(r.Request.URL, body)
+	if e != nil {
+		return nil, ""
+	}
+	return links, tileColor
+}
+
+// redirectChain returns the URLs requested to get r, oldest first, or nil if
+// there were no redirects.
+func redirectChain(r *http.Response) []string {
+	if r.Request == nil || r.Request.Response == nil {
+		return nil
+	}
+
+	var chain []string
+	for req := r.Request; req != nil; {
+		chain = append(chain, req.URL.String())
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	slices.Reverse(chain)
+	return chain
+}
+
+// IsSVG is our SVG detector. We can't use image.RegisterFormat, since
+// RegisterFormat is limited to a simple magic number check. It's easy to
+// confuse the first few bytes of HTML with SVG.
+func IsSVG(body []byte) bool {
 	// is it long enough?
 	if len(body) < 10 {
 		return false
@@ -436,10 +833,17 @@ func urlFromBase(baseURL *url.URL, path string) string {
 	return u.String()
 }
 
-func rejectBrokenIcons(icons []Icon) []Icon {
+func (b *Besticon) rejectBrokenIcons(ctx context.Context, icons []Icon) []Icon {
 	var result []Icon
 	for _, img := range icons {
-		if img.Error == nil && (img.Width > 1 && img.Height > 1) {
+		switch {
+		case img.Error != nil:
+			b.log.DebugContext(ctx, "icon rejected", "url", img.URL, "reason", ErrorCode(img.Error), "error", img.Error)
+		// Tiny raster images are tracking pixels, tiny SVGs just use a small
+		// coordinate system.
+		case img.Format != "svg" && (img.Width <= 1 || img.Height <= 1):
+			b.log.DebugContext(ctx, "icon rejected", "url", img.URL, "reason", "too_small", "width", img.Width, "height", img.Height)
+		default:
 			result = append(result, img)
 		}
 	}
@@ -1,9 +1,17 @@
 package besticon
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
@@ -106,6 +114,9 @@ func TestFetchIcons(t *testing.T) {
 			{"https://github.com/apple-touch-icon.png", 120, "png"},
 			{"https://github.com/apple-touch-icon-114.png", 114, "png"},
 			{"https://github.com/apple-touch-icon-precomposed.png", 57, "png"},
+			// The vcr transport doesn't enforce the address policy, so
+			// this public host isn't dropped for not resolving.
+			{"https://assets-cdn.github.com/favicon.ico", 32, "ico"},
 			{"https://github.com/favicon.ico", 32, "ico"},
 		}},
 
@@ -218,17 +229,92 @@ func TestMortenmøllerWithIDNAHost(t *testing.T) {
 	assertEquals(t, 13, len(actualImages))
 }
 
+func TestFetchIconsContextCancelsRequests(t *testing.T) {
+	started := make(chan struct{})
+	aborted := make(chan error, 1)
+	requests := 0
+
+	client := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			requests++
+			close(started)
+			<-req.Context().Done()
+			aborted <- req.Context().Err()
+			return nil, req.Context().Err()
+		}),
+	}
+	b := New(WithHTTPClient(client), WithLogger(NewDefaultLogger(io.Discard)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, err := b.NewIconFinder().FetchIconsContext(ctx, testSiteURL)
+	assertEquals(t, true, errors.Is(err, context.Canceled))
+	assertEquals(t, context.Canceled, <-aborted)
+	assertEquals(t, 1, requests)
+}
+
+func TestFetchAllIconsReturnsWhenContextDone(t *testing.T) {
+	b := newTestBesticon(map[string]testResponse{
+		"/favicon.ico": {contentType: "image/x-icon", body: mustReadFile("testdata/favicon.ico")},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	icons := b.fetchAllIcons(ctx, []iconLink{{URL: testSiteURL + "/favicon.ico"}})
+	for _, ico := range icons {
+		assertEquals(t, true, errors.Is(ico.Error, context.Canceled))
+	}
+}
+
 func TestMainColorForIconsWithBrokenImageData(t *testing.T) {
 	icn := Icon{Format: "png", ImageData: []byte("broken-image-data")}
 	colr := MainColorForIcons([]Icon{icn})
 	assertEquals(t, (*color.RGBA)(nil), colr)
 }
 
+func TestParseHexColor(t *testing.T) {
+	assertEquals(t, &color.RGBA{0x2b, 0x57, 0x97, 0xff}, parseHexColor("#2b5797"))
+	assertEquals(t, &color.RGBA{0xff, 0x00, 0x00, 0xff}, parseHexColor("#F00"))
+	assertEquals(t, (*color.RGBA)(nil), parseHexColor(""))
+	assertEquals(t, (*color.RGBA)(nil), parseHexColor("red"))
+}
+
 func TestImageSizeDetection(t *testing.T) {
 	assertEquals(t, 1, getImageWidthForFile("testdata/pixel.gif"))
 	assertEquals(t, 1, getImageWidthForFile("testdata/pixel.jpg"))
 	assertEquals(t, 1, getImageWidthForFile("testdata/pixel.png"))
 	assertEquals(t, 48, getImageWidthForFile("testdata/favicon.ico"))
+	assertEquals(t, 16, getImageWidthForFile("testdata/red.webp"))
+	assertEquals(t, 16, getImageWidthForFile("testdata/rose.bmp"))
+}
+
+func TestFetchWebPAndBMPIcons(t *testing.T) {
+	b := newTestBesticon(map[string]testResponse{
+		"/": {contentType: "text/html", body: []byte(`<html><head>
+			<link rel="icon" href="/favicon.webp" type="image/webp">
+			<link rel="icon" href="/rose.bmp">
+		</head></html>`)},
+		"/favicon.webp": {contentType: "image/webp", body: mustReadFile("testdata/red.webp")},
+		"/rose.bmp":     {contentType: "image/bmp", body: mustReadFile("testdata/rose.bmp")},
+	}, WithDefaultFormats("webp", "bmp"))
+
+	finder := b.NewIconFinder()
+	icons, err := finder.FetchIcons(testSiteURL)
+	check(err)
+	assertEquals(t, 2, len(icons))
+	assertEquals(t, "webp", icons[0].Format)
+	assertEquals(t, 16, icons[0].Width)
+	assertEquals(t, "bmp", icons[1].Format)
+	assertEquals(t, 12, icons[1].Height)
+	assertEquals(t, &color.RGBA{0xff, 0x00, 0x00, 0x00}, MainColorForIcons(icons[:1]))
+
+	finder.FormatsAllowed = []string{"webp"}
+	assertEquals(t, testSiteURL+"/favicon.webp", finder.IconInSizeRange(SizeRange{16, 16, 32}).URL)
 }
 
 func TestParseSizeRange(t *testing.T) {
@@ -307,7 +393,7 @@ func TestIsSVG(t *testing.T) {
 		mustReadFile("testdata/favicon.ico"),
 	}
 	for _, data := range invalid {
-		assertEquals(t, isSVG(data), false)
+		assertEquals(t, IsSVG(data), false)
 	}
 
 	valid := [][]byte{
@@ -317,7 +403,7 @@ func TestIsSVG(t *testing.T) {
 		mustReadFile("testdata/svg.svg"),
 	}
 	for _, data := range valid {
-		assertEquals(t, isSVG(data), true)
+		assertEquals(t, IsSVG(data), true)
 	}
 }
 
@@ -343,8 +429,6 @@ func fetchIconsWithVCR(s string) ([]Icon, *IconFinder, error) {
 		}
 	}()
 
-	client.Jar = mustInitCookieJar()
-
 	b := New(WithHTTPClient(client), WithDiscardImageBytes(true))
 
 	// fetch
@@ -354,6 +438,75 @@ func fetchIconsWithVCR(s string) ([]Icon, *IconFinder, error) {
 	return icons, finder, err
 }
 
+// testSiteURL is a public address, so requests to it pass the private
+// address check without needing DNS. They never hit the network since
+// newTestBesticon serves them from memory.
+const testSiteURL = "http://93.184.215.14"
+
+type testResponse struct {
+	status      int
+	contentType string
+	location    string
+	body        []byte
+}
+
+// newTestBesticon returns a Besticon whose requests are answered from
+// responses, keyed by URL path. Unknown paths get a 404. Failing pages are
+// not retried and have no fallbacks.
+func newTestBesticon(responses map[string]testResponse, opts ...Option) *Besticon {
+	client := &http.Client{Transport: respondWith(responses)}
+	opts = append([]Option{WithHTTPClient(client), WithLogger(NewDefaultLogger(io.Discard)), WithFallbacks(Fallbacks{})}, opts...)
+	return New(opts...)
+}
+
+// respondWith answers requests with the response for their path, 404 if
+// there is none.
+func respondWith(responses map[string]testResponse) roundTripperFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		path := req.URL.Path
+		if path == "" {
+			path = "/"
+		}
+		res, ok := responses[path]
+		if !ok {
+			res = testResponse{status: http.StatusNotFound}
+		}
+		if res.status == 0 {
+			res.status = http.StatusOK
+		}
+
+		w := httptest.NewRecorder()
+		if res.contentType != "" {
+			w.Header().Set("Content-Type", res.contentType)
+		}
+		if res.location != "" {
+			w.Header().Set("Location", res.location)
+		}
+		w.WriteHeader(res.status)
+		w.Write(res.body)
+
+		resp := w.Result()
+		resp.Request = req
+		return resp, nil
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// testPNG returns an encoded, single colored PNG image of the given size.
+func testPNG(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0x11, 0x36, 0x71, 0xff}}, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	check(png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
 func getImageWidthForFile(filename string) int {
 	f, err := os.Open(filename)
 	check(err)
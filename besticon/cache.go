@@ -0,0 +1,154 @@
+package besticon
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache"
+	"github.com/golang/groupcache/lru"
+)
+
+// ErrCacheMiss is returned by Cache.Get when there is no value for a key.
+var ErrCacheMiss = errors.New("besticon: cache miss")
+
+// Cache stores the results of icon lookups. Besticon comes with an in-memory
+// LRU (NewMemoryCache), groupcache (NewGroupcache) and an on-disk store
+// (NewDiskCache), use WithCacheBackend to plug in your own.
+//
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored for key or ErrCacheMiss if there is
+	// none or it has expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set stores value for key. It may be evicted before ttl is up.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// LoadingCache is a Cache that loads missing values itself, like groupcache
+// does. Besticon uses GetOrLoad instead of Get and Set for these.
+type LoadingCache interface {
+	Cache
+
+	// GetOrLoad returns the value for key, calling load to get and store
+	// it if there is none.
+	GetOrLoad(ctx context.Context, key string, ttl time.Duration, load func(context.Context) ([]byte, error)) ([]byte, error)
+}
+
+// PurgeableCache is a Cache that can remove entries, which is needed for
+// EvictFromCache and PurgeCache.
+type PurgeableCache interface {
+	Cache
+
+	// Delete removes the value for key, if any.
+	Delete(ctx context.Context, key string) error
+
+	// Purge removes all values.
+	Purge(ctx context.Context) error
+}
+
+// MemoryCache is a Cache keeping the most recently used values in memory.
+type MemoryCache struct {
+	mu       sync.Mutex
+	lru      *lru.Cache
+	size     int64
+	maxBytes int64
+	now      func() time.Time
+
+	gets, hits, evictions int64
+}
+
+var _ PurgeableCache = (*MemoryCache)(nil)
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// NewMemoryCache returns a MemoryCache holding up to maxBytes of values.
+func NewMemoryCache(maxBytes int64) *MemoryCache {
+	c := &MemoryCache{
+		lru:      lru.New(0),
+		maxBytes: maxBytes,
+		now:      time.Now,
+	}
+	c.lru.OnEvicted = func(key lru.Key, value any) {
+		c.size -= entrySize(key.(string), value.(*memoryEntry))
+	}
+	return c
+}
+
+// Get implements Cache.
+func (c *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gets++
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	e := v.(*memoryEntry)
+	if !c.now().Before(e.expires) {
+		c.lru.Remove(key)
+		return nil, ErrCacheMiss
+	}
+	c.hits++
+	return e.value, nil
+}
+
+// Set implements Cache.
+func (c *MemoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &memoryEntry{value: value, expires: c.now().Add(ttl)}
+	if entrySize(key, e) > c.maxBytes {
+		c.lru.Remove(key)
+		return nil
+	}
+
+	c.lru.Remove(key)
+	c.lru.Add(key, e)
+	c.size += entrySize(key, e)
+	for c.size > c.maxBytes {
+		c.lru.RemoveOldest()
+		c.evictions++
+	}
+	return nil
+}
+
+// Delete implements PurgeableCache.
+func (c *MemoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Remove(key)
+	return nil
+}
+
+// Purge implements PurgeableCache.
+func (c *MemoryCache) Purge(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Clear()
+	return nil
+}
+
+// Stats returns the statistics of the cache in the format groupcache uses.
+func (c *MemoryCache) Stats() groupcache.CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return groupcache.CacheStats{
+		Bytes:     c.size,
+		Items:     int64(c.lru.Len()),
+		Gets:      c.gets,
+		Hits:      c.hits,
+		Evictions: c.evictions,
+	}
+}
+
+func entrySize(key string, e *memoryEntry) int64 {
+	return int64(len(key) + len(e.value))
+}
@@ -0,0 +1,444 @@
+package besticon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryCache(10)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	check(c.Set(ctx, "a", []byte("1234"), time.Hour))
+	check(c.Set(ctx, "b", []byte("1234"), time.Hour))
+	v, err := c.Get(ctx, "a")
+	check(err)
+	assertEquals(t, "1234", string(v))
+
+	// "b" is the least recently used now and has to make room
+	check(c.Set(ctx, "c", []byte("1234"), time.Hour))
+	_, err = c.Get(ctx, "b")
+	assertEquals(t, true, errors.Is(err, ErrCacheMiss))
+	_, err = c.Get(ctx, "a")
+	check(err)
+
+	now = now.Add(time.Hour)
+	_, err = c.Get(ctx, "a")
+	assertEquals(t, true, errors.Is(err, ErrCacheMiss))
+
+	// values that can never fit are not stored
+	check(c.Set(ctx, "d", []byte("far too large"), time.Hour))
+	_, err = c.Get(ctx, "d")
+	assertEquals(t, true, errors.Is(err, ErrCacheMiss))
+}
+
+func TestDiskCache(t *testing.T) {
+	ctx := context.Background()
+	c, err := NewDiskCache(t.TempDir(), 0)
+	check(err)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	_, err = c.Get(ctx, "http://example.com")
+	assertEquals(t, true, errors.Is(err, ErrCacheMiss))
+
+	check(c.Set(ctx, "http://example.com", []byte("value"), time.Hour))
+	v, err := c.Get(ctx, "http://example.com")
+	check(err)
+	assertEquals(t, "value", string(v))
+
+	// a second instance sees the same values, e.g. after a restart
+	c2, err := NewDiskCache(c.dir, 0)
+	check(err)
+	c2.now = c.now
+	v, err = c2.Get(ctx, "http://example.com")
+	check(err)
+	assertEquals(t, "value", string(v))
+
+	now = now.Add(time.Hour)
+	_, err = c.Get(ctx, "http://example.com")
+	assertEquals(t, true, errors.Is(err, ErrCacheMiss))
+}
+
+func TestDiskCacheSweep(t *testing.T) {
+	ctx := context.Background()
+	c, err := NewDiskCache(t.TempDir(), 1000)
+	check(err)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	check(c.Set(ctx, "expired", make([]byte, 100), 0))
+	for i := range 10 {
+		check(c.Set(ctx, fmt.Sprint(i), make([]byte, 100), time.Duration(i+1)*time.Hour))
+	}
+	check(c.Sweep(ctx))
+
+	// 10 files of 108 bytes, the two expiring soonest go to get below 900
+	for key, cached := range map[string]bool{"expired": false, "0": false, "1": false, "2": true, "9": true} {
+		_, err := c.Get(ctx, key)
+		assertEquals(t, cached, err == nil)
+	}
+	assertEquals(t, int64(8*108), c.size.Load())
+}
+
+func TestDiskCacheKeepsOtherFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	check(os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("mine"), 0o644))
+	c, err := NewDiskCache(dir, 1)
+	check(err)
+
+	check(c.Set(ctx, "a", []byte("1"), time.Hour))
+	check(c.Sweep(ctx))
+	check(c.Purge(ctx))
+
+	entries, err := os.ReadDir(dir)
+	check(err)
+	assertEquals(t, 1, len(entries))
+	assertEquals(t, "notes.txt", entries[0].Name())
+}
+
+func TestWithCacheBackend(t *testing.T) {
+	var lookups atomic.Int32
+	b := newTestBesticon(nil,
+		countLookups(&lookups, siteWithFavicon()),
+		WithCacheBackend(NewMemoryCache(1<<20)),
+	)
+
+	icons, err := b.NewIconFinder().FetchIcons(testSiteURL)
+	check(err)
+	assertEquals(t, 1, len(icons))
+	assertEquals(t, true, strings.HasSuffix(icons[0].URL, "/favicon.ico"))
+
+	// the second lookup is answered from the cache
+	icons, err = b.NewIconFinder().FetchIcons(testSiteURL)
+	check(err)
+	assertEquals(t, 1, len(icons))
+	assertEquals(t, int32(1), lookups.Load())
+}
+
+func TestCacheTTL(t *testing.T) {
+	var lookups atomic.Int32
+	now := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	b := newTestBesticon(nil,
+		countLookups(&lookups, siteWithFavicon()),
+		WithCacheBackend(NewMemoryCache(1<<20)),
+		WithCacheTTL(2*time.Hour),
+		WithClock(func() time.Time { return now }),
+	)
+
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, int32(1), lookups.Load())
+
+	// no more expiring at midnight
+	now = now.Add(90 * time.Minute)
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, int32(1), lookups.Load())
+
+	now = now.Add(30 * time.Minute)
+	icons, err := b.NewIconFinder().FetchIcons(testSiteURL)
+	check(err)
+	assertEquals(t, 1, len(icons))
+	assertEquals(t, int32(2), lookups.Load())
+}
+
+func TestNegativeCacheTTL(t *testing.T) {
+	var lookups atomic.Int32
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newTestBesticon(nil,
+		countLookups(&lookups, map[string]testResponse{"/": {status: http.StatusServiceUnavailable}}),
+		WithCacheBackend(NewMemoryCache(1<<20)),
+		WithNegativeCacheTTL(5*time.Minute),
+		WithClock(func() time.Time { return now }),
+	)
+
+	icons, _ := b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, 0, len(icons))
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, int32(1), lookups.Load())
+
+	now = now.Add(5 * time.Minute)
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, int32(2), lookups.Load())
+}
+
+func TestNonPositiveCacheTTLs(t *testing.T) {
+	for _, ttl := range []time.Duration{0, -time.Hour} {
+		b := New(WithCacheTTL(ttl), WithNegativeCacheTTL(ttl), WithStaleWhileRevalidate(ttl))
+		assertEquals(t, defaultCacheTTL, b.cacheTTL)
+		assertEquals(t, defaultNegativeCacheTTL, b.negativeCacheTTL)
+		assertEquals(t, time.Duration(0), b.staleWhileRevalidate)
+
+		// the window doesn't panic or span ages
+		assertEquals(t, groupcacheKey(testSiteURL, defaultCacheTTL), groupcacheKey(testSiteURL, ttl))
+	}
+}
+
+func TestCachedErrorKeepsCode(t *testing.T) {
+	cache := NewMemoryCache(1 << 20)
+	b := newTestBesticon(nil, WithCacheBackend(cache))
+
+	data, _ := b.encodeResult(nil, &NotFoundError{URL: testSiteURL, StatusCode: 404})
+	check(cache.Set(context.Background(), testSiteURL, data, time.Hour))
+
+	_, err := b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, true, errors.Is(err, ErrNotFound))
+	assertEquals(t, CodeNotFound, ErrorCode(err))
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var lookups atomic.Int32
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newTestBesticon(nil,
+		countLookups(&lookups, siteWithFavicon()),
+		WithCacheBackend(NewMemoryCache(1<<20)),
+		WithCacheTTL(time.Hour),
+		WithStaleWhileRevalidate(time.Hour),
+		WithClock(func() time.Time { return now }),
+	)
+	b.NewIconFinder().FetchIcons(testSiteURL)
+
+	// expired but within the window: served from the cache, refreshed in
+	// the background
+	now = now.Add(90 * time.Minute)
+	icons, err := b.NewIconFinder().FetchIcons(testSiteURL)
+	check(err)
+	assertEquals(t, 1, len(icons))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lookups.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assertEquals(t, int32(2), lookups.Load())
+}
+
+// countLookups answers requests from responses and counts how often the site
+// itself was requested.
+func countLookups(lookups *atomic.Int32, responses map[string]testResponse) Option {
+	respond := respondWith(responses)
+	return WithHTTPClient(&http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "" || req.URL.Path == "/" {
+				lookups.Add(1)
+			}
+			return respond(req)
+		}),
+	})
+}
+
+func TestSharedLookupOutlivesCanceledCaller(t *testing.T) {
+	var lookups atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	respond := respondWith(siteWithFavicon())
+	b := newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "" && lookups.Add(1) == 1 {
+				close(started)
+				select {
+				case <-release:
+				case <-req.Context().Done():
+					return nil, req.Context().Err()
+				}
+			}
+			return respond(req)
+		})}),
+		WithCacheBackend(NewMemoryCache(1<<20)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := b.NewIconFinder().FetchIconsContext(ctx, testSiteURL)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := b.NewIconFinder().FetchIcons(testSiteURL)
+		second <- err
+	}()
+
+	// The first caller going away doesn't fail the lookup the second one
+	// waits for.
+	cancel()
+	assertEquals(t, true, errors.Is(<-first, context.Canceled))
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	check(<-second)
+	assertEquals(t, int32(1), lookups.Load())
+
+	icons, err := b.NewIconFinder().FetchIcons(testSiteURL)
+	check(err)
+	assertEquals(t, 1, len(icons))
+	assertEquals(t, int32(1), lookups.Load())
+}
+
+func siteWithFavicon() map[string]testResponse {
+	return map[string]testResponse{
+		"/":            {body: []byte(`<html><head></head></html>`)},
+		"/favicon.ico": {body: mustReadFile("testdata/favicon.ico")},
+	}
+}
+
+func TestWithCacheTwice(t *testing.T) {
+	// groupcache panics when a group is registered twice
+	New(WithCache(1))
+	New(WithCache(1))
+}
+
+func TestGroupcacheLoadsPeerRequests(t *testing.T) {
+	var lookups atomic.Int32
+	g := NewGroupcache("peer-test", 1)
+	newTestBesticon(nil, countLookups(&lookups, siteWithFavicon()), WithCacheBackend(g))
+
+	// requests from peers come without a load function, only with the key
+	var data []byte
+	err := g.Group().Get(context.Background(), "1-"+testSiteURL, groupcache.AllocatingByteSliceSink(&data))
+	check(err)
+	assertEquals(t, int32(1), lookups.Load())
+	assertEquals(t, true, strings.Contains(string(data), "/favicon.ico"))
+}
+
+func TestPurgeableCaches(t *testing.T) {
+	ctx := context.Background()
+	disk, err := NewDiskCache(t.TempDir(), 0)
+	check(err)
+
+	for _, c := range []PurgeableCache{NewMemoryCache(1 << 20), disk} {
+		check(c.Set(ctx, "a", []byte("1"), time.Hour))
+		check(c.Set(ctx, "b", []byte("2"), time.Hour))
+
+		check(c.Delete(ctx, "a"))
+		check(c.Delete(ctx, "unknown"))
+		_, err := c.Get(ctx, "a")
+		assertEquals(t, true, errors.Is(err, ErrCacheMiss))
+		_, err = c.Get(ctx, "b")
+		check(err)
+
+		check(c.Purge(ctx))
+		_, err = c.Get(ctx, "b")
+		assertEquals(t, true, errors.Is(err, ErrCacheMiss))
+
+		// still usable after a purge
+		check(c.Set(ctx, "c", []byte("3"), time.Hour))
+		_, err = c.Get(ctx, "c")
+		check(err)
+	}
+}
+
+func TestMemoryCacheStats(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryCache(10)
+
+	check(c.Set(ctx, "a", []byte("1234"), time.Hour))
+	check(c.Set(ctx, "b", []byte("1234"), time.Hour))
+	check(c.Set(ctx, "c", []byte("1234"), time.Hour))
+	c.Get(ctx, "a")
+	c.Get(ctx, "c")
+
+	stats := c.Stats()
+	assertEquals(t, int64(10), stats.Bytes)
+	assertEquals(t, int64(2), stats.Items)
+	assertEquals(t, int64(2), stats.Gets)
+	assertEquals(t, int64(1), stats.Hits)
+	assertEquals(t, int64(1), stats.Evictions)
+
+	check(c.Purge(ctx))
+	assertEquals(t, int64(0), c.Stats().Bytes)
+}
+
+func TestEvictFromCache(t *testing.T) {
+	var lookups atomic.Int32
+	b := newTestBesticon(nil,
+		countLookups(&lookups, siteWithFavicon()),
+		WithCacheBackend(NewMemoryCache(1<<20)),
+	)
+	ctx := context.Background()
+
+	_, err := b.NewIconFinder().CachedIcons(ctx, testSiteURL)
+	assertEquals(t, true, errors.Is(err, ErrCacheMiss))
+
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	entry, err := b.NewIconFinder().CachedIcons(ctx, testSiteURL)
+	check(err)
+	assertEquals(t, 1, len(entry.Icons))
+	assertEquals(t, nil, entry.Error)
+	assertEquals(t, false, entry.Expires.IsZero())
+
+	check(b.NewIconFinder().EvictFromCache(ctx, testSiteURL))
+	_, err = b.NewIconFinder().CachedIcons(ctx, testSiteURL)
+	assertEquals(t, true, errors.Is(err, ErrCacheMiss))
+
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, int32(2), lookups.Load())
+
+	check(b.PurgeCache(ctx))
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, int32(3), lookups.Load())
+}
+
+func TestPurgeGroupcache(t *testing.T) {
+	b := newTestBesticon(nil, WithCacheBackend(NewGroupcache("purge-test", 1)))
+	ctx := context.Background()
+
+	assertEquals(t, ErrCacheUnsupported, b.PurgeCache(ctx))
+	assertEquals(t, ErrCacheUnsupported, b.NewIconFinder().EvictFromCache(ctx, testSiteURL))
+	_, err := b.NewIconFinder().CachedIcons(ctx, testSiteURL)
+	assertEquals(t, ErrCacheUnsupported, err)
+}
+
+func TestRefreshCache(t *testing.T) {
+	var lookups atomic.Int32
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newTestBesticon(nil,
+		countLookups(&lookups, siteWithFavicon()),
+		WithCacheBackend(NewMemoryCache(1<<20)),
+		WithCacheTTL(time.Hour),
+		WithClock(func() time.Time { return now }),
+	)
+	ctx := context.Background()
+
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	now = now.Add(50 * time.Minute)
+	check(b.NewIconFinder().RefreshCache(ctx, testSiteURL))
+	assertEquals(t, int32(2), lookups.Load())
+
+	entry, err := b.NewIconFinder().CachedIcons(ctx, testSiteURL)
+	check(err)
+	assertEquals(t, now.Add(time.Hour), entry.Expires)
+
+	g := newTestBesticon(nil, WithCacheBackend(NewGroupcache("refresh-test", 1)))
+	assertEquals(t, ErrCacheUnsupported, g.NewIconFinder().RefreshCache(ctx, testSiteURL))
+}
+
+func TestLookupObserver(t *testing.T) {
+	var lookups atomic.Int32
+	var found atomic.Int32
+	b := newTestBesticon(nil,
+		countLookups(&lookups, siteWithFavicon()),
+		WithCacheBackend(NewMemoryCache(1<<20)),
+		WithLookupObserver(func(siteURL string, icons []Icon, err error) {
+			assertEquals(t, testSiteURL, siteURL)
+			assertEquals(t, nil, err)
+			found.Add(int32(len(icons)))
+		}),
+	)
+
+	// cache hits are not lookups
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, int32(1), lookups.Load())
+	assertEquals(t, int32(1), found.Load())
+}
@@ -2,91 +2,378 @@ package besticon
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"fmt"
+	"slices"
 	"time"
 
 	"github.com/golang/groupcache"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type SiteURLKey string
 
 const contextKeySiteURL SiteURLKey = "siteURL"
 
+// Defaults for WithCacheTTL and WithNegativeCacheTTL.
+const (
+	defaultCacheTTL         = 24 * time.Hour
+	defaultNegativeCacheTTL = 10 * time.Minute
+)
+
 type result struct {
-	Icons []Icon
-	Error string
+	Icons     []Icon
+	TileColor string
+	Error     string
+	ErrorCode string
+
+	// Attempts are the pages the lookup tried to fetch.
+	Attempts []Attempt
+
+	// Expires is when the result should be looked up again.
+	Expires time.Time
+}
+
+// cachedError is a lookup error restored from the cache. It still matches
+// the sentinel error of its code.
+type cachedError struct {
+	msg string
+	err error
 }
 
-func (b *Besticon) resultFromCache(siteURL string) ([]Icon, error) {
-	if b.iconCache == nil {
-		return b.fetchIcons(siteURL)
+func (e *cachedError) Error() string {
+	return e.msg
+}
+
+func (e *cachedError) Unwrap() error {
+	return e.err
+}
+
+func (b *Besticon) resultFromCache(ctx context.Context, siteURL string) (*result, error) {
+	if b.cache == nil {
+		return b.fetchIcons(ctx, siteURL)
 	}
 
-	c := context.WithValue(context.Background(), contextKeySiteURL, siteURL)
-	var data []byte
-	err := b.iconCache.Get(c, cacheKey(siteURL), groupcache.AllocatingByteSliceSink(&data))
+	data, err := b.cachedResult(ctx, siteURL)
 	if err != nil {
-		b.logger.LogError(fmt.Errorf("failed to get icon from cache: %w", err))
-		return b.fetchIcons(siteURL)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		b.log.ErrorContext(ctx, "failed to get icon from cache", "url", siteURL, "error", err)
+		return b.fetchIcons(ctx, siteURL)
 	}
 
-	res := &result{}
-	err = json.Unmarshal(data, res)
+	res, err := unmarshalResult(data)
 	if err != nil {
-		panic(err)
+		// An entry from an older version or one that got corrupted.
+		b.log.ErrorContext(ctx, "failed to decode cached icon", "url", siteURL, "error", err)
+		return b.fetchIcons(ctx, siteURL)
 	}
 
+	b.loadImages(ctx, res.Icons)
+
 	if res.Error != "" {
-		return res.Icons, errors.New(res.Error)
+		return res, &cachedError{msg: res.Error, err: errorForCode(res.ErrorCode)}
 	}
-	return res.Icons, nil
+	return res, nil
 }
 
-func cacheKey(siteURL string) string {
-	// Let results expire after a day
-	now := time.Now()
-	return fmt.Sprintf("%d-%02d-%02d-%s", now.Year(), now.Month(), now.Day(), siteURL)
+// cachedResult returns the encoded result for siteURL from the cache,
+// looking it up if it's not there or has expired. Results that expired
+// less than the stale-while-revalidate window ago are still returned while
+// a refresh runs in the background.
+func (b *Besticon) cachedResult(ctx context.Context, siteURL string) (data []byte, err error) {
+	ctx, span := b.startSpan(ctx, "besticon.cache", attrURL.String(siteURL))
+	defer func() { endSpan(span, err) }()
+
+	if l, ok := b.cache.(LoadingCache); ok {
+		hit := true
+		data, err = l.GetOrLoad(ctx, siteURL, b.cacheTTL, func(ctx context.Context) ([]byte, error) {
+			hit = false
+			return b.loadForGroupcache(ctx, siteURL)
+		})
+		span.SetAttributes(attrCacheHit.Bool(hit))
+		b.logCacheLookup(ctx, siteURL, hit, false)
+		return data, err
+	}
+
+	data, err = b.cache.Get(ctx, siteURL)
+	if err != nil && !errors.Is(err, ErrCacheMiss) {
+		b.log.ErrorContext(ctx, "failed to get icon from cache", "url", siteURL, "error", err)
+	}
+	if err == nil {
+		// Entries that can't be decoded are misses and get replaced.
+		if expires, err := resultExpires(data); err == nil {
+			now := b.now()
+			switch {
+			case now.Before(expires):
+				span.SetAttributes(attrCacheHit.Bool(true))
+				b.logCacheLookup(ctx, siteURL, true, false)
+				return data, nil
+			case now.Before(expires.Add(b.staleWhileRevalidate)):
+				span.SetAttributes(attrCacheHit.Bool(true), attrCacheStale.Bool(true))
+				b.logCacheLookup(ctx, siteURL, true, true)
+				// The refresh gets its own trace, it outlives this one.
+				go b.loadAndStore(trace.ContextWithSpanContext(context.WithoutCancel(ctx), trace.SpanContext{}), siteURL)
+				return data, nil
+			}
+		}
+	}
+
+	span.SetAttributes(attrCacheHit.Bool(false))
+	b.logCacheLookup(ctx, siteURL, false, false)
+	return b.loadAndStore(ctx, siteURL)
 }
 
-func (b *Besticon) generatorFunc(ctx context.Context, key string, sink groupcache.Sink) error {
-	siteURL := ctx.Value(contextKeySiteURL).(string)
-	icons, err := b.fetchIcons(siteURL)
+func (b *Besticon) logCacheLookup(ctx context.Context, siteURL string, hit, stale bool) {
+	switch {
+	case stale:
+		b.log.DebugContext(ctx, "cache hit", "url", siteURL, "stale", true)
+	case hit:
+		b.log.DebugContext(ctx, "cache hit", "url", siteURL)
+	default:
+		b.log.DebugContext(ctx, "cache miss", "url", siteURL)
+	}
+}
+
+// loadAndStore looks up siteURL and stores the result in the cache.
+// Concurrent calls for the same site share one lookup. It runs until the
+// lookup timeout even if the caller that started it goes away, so the
+// others don't fail with it; each caller stops waiting once its own ctx is
+// done.
+func (b *Besticon) loadAndStore(ctx context.Context, siteURL string) ([]byte, error) {
+	type load struct {
+		data []byte
+		err  error
+	}
+	done := make(chan load, 1)
+	shared := context.WithoutCancel(ctx)
+	go func() {
+		v, err := b.loads.Do(siteURL, func() (any, error) {
+			res, err := b.fetchIcons(shared, siteURL)
+			data, ttl := b.encodeResult(res, err)
+			if err := b.cache.Set(shared, siteURL, data, ttl+b.staleWhileRevalidate); err != nil {
+				b.log.ErrorContext(shared, "failed to store icon in cache", "url", siteURL, "error", err)
+			}
+			return data, nil
+		})
+		data, _ := v.([]byte)
+		done <- load{data, err}
+	}()
+
+	select {
+	case l := <-done:
+		return l.data, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// loadForGroupcache looks up siteURL for a Groupcache. Groupcache keeps
+// entries for the whole TTL, too long for errors, so they are not cached.
+func (b *Besticon) loadForGroupcache(ctx context.Context, siteURL string) ([]byte, error) {
+	res, err := b.fetchIcons(ctx, siteURL)
 	if err != nil {
-		// Don't cache errors
-		return err
+		return nil, err
 	}
+	data, _ := b.encodeResult(res, nil)
+	return data, nil
+}
 
-	res := result{Icons: icons}
-	bytes, err := json.Marshal(res)
+// encodeResult encodes res or, if err is not nil, the failed lookup for the
+// cache. It returns how long to keep it: failed lookups and sites without
+// icons get the shorter negative TTL.
+func (b *Besticon) encodeResult(res *result, err error) ([]byte, time.Duration) {
+	ttl := b.cacheTTL
 	if err != nil {
-		panic(err)
+		res = &result{Error: err.Error(), ErrorCode: ErrorCode(err)}
+	}
+	if err != nil || len(res.Icons) == 0 {
+		ttl = b.negativeCacheTTL
 	}
-	sink.SetBytes(bytes)
+	if b.imageStore != nil {
+		// The images are in the store, no need to keep a copy per site.
+		stripped := *res
+		stripped.Icons = slices.Clone(res.Icons)
+		for i := range stripped.Icons {
+			stripped.Icons[i].ImageData = nil
+		}
+		res = &stripped
+	}
+	res.Expires = b.now().Add(ttl)
 
-	return nil
+	return marshalResult(res), ttl
 }
 
 type cacheOption struct {
-	size int64
+	cache Cache
 }
 
 func (c *cacheOption) applyOption(b *Besticon) {
-	b.iconCache = groupcache.NewGroup("icons", c.size<<20, groupcache.GetterFunc(b.generatorFunc))
+	b.cache = c.cache
+	if g, ok := c.cache.(*Groupcache); ok {
+		g.setLoader(b.loadForGroupcache)
+	}
 }
 
+// WithCache caches results in the groupcache group "icons" of the given
+// size.
 func WithCache(sizeInMB int64) Option {
 	return &cacheOption{
-		size: sizeInMB,
+		cache: NewGroupcache("icons", sizeInMB),
+	}
+}
+
+type cacheTTLOption struct {
+	ttl, negativeTTL, staleWhileRevalidate time.Duration
+}
+
+func (c *cacheTTLOption) applyOption(b *Besticon) {
+	if c.ttl > 0 {
+		b.cacheTTL = c.ttl
+	}
+	if c.negativeTTL > 0 {
+		b.negativeCacheTTL = c.negativeTTL
+	}
+	if c.staleWhileRevalidate > 0 {
+		b.staleWhileRevalidate = c.staleWhileRevalidate
+	}
+}
+
+// WithCacheTTL sets how long lookup results are cached, 24 hours by
+// default. A ttl <= 0 keeps the default.
+func WithCacheTTL(ttl time.Duration) Option {
+	return &cacheTTLOption{ttl: ttl}
+}
+
+// WithNegativeCacheTTL sets how long failed lookups and sites without icons
+// are cached, 10 minutes by default. A ttl <= 0 keeps the default.
+func WithNegativeCacheTTL(ttl time.Duration) Option {
+	return &cacheTTLOption{negativeTTL: ttl}
+}
+
+// WithStaleWhileRevalidate keeps serving expired results for up to window
+// while they are refreshed in the background. It's off by default.
+func WithStaleWhileRevalidate(window time.Duration) Option {
+	return &cacheTTLOption{staleWhileRevalidate: window}
+}
+
+type clockOption struct {
+	now func() time.Time
+}
+
+func (c *clockOption) applyOption(b *Besticon) {
+	b.now = c.now
+}
+
+// WithClock sets the function used to tell the time for cache expiry,
+// time.Now by default.
+func WithClock(now func() time.Time) Option {
+	return &clockOption{now: now}
+}
+
+// WithCacheBackend caches results in c. A nil c disables caching.
+func WithCacheBackend(c Cache) Option {
+	return &cacheOption{
+		cache: c,
 	}
 }
 
+// ErrCacheUnsupported is returned when the cache backend can't do what was
+// asked for, e.g. remove entries from a Groupcache.
+var ErrCacheUnsupported = errors.New("besticon: not supported by the cache backend")
+
+// CacheEntry is a lookup result as found in the cache.
+type CacheEntry struct {
+	Icons     []Icon
+	TileColor string
+	// Attempts are the pages the lookup tried to fetch.
+	Attempts []Attempt
+	// Error is the error of a failed lookup.
+	Error   error
+	Expires time.Time
+}
+
+// CachedIcons returns the cache entry for url without looking it up, or
+// ErrCacheMiss if there is none. The image data of the icons is not loaded.
+//
+// Loading caches like Groupcache would look up missing entries, they return
+// ErrCacheUnsupported.
+func (f *IconFinder) CachedIcons(ctx context.Context, url string) (*CacheEntry, error) {
+	b := f.b
+	if b.cache == nil {
+		return nil, ErrCacheMiss
+	}
+	if _, ok := b.cache.(LoadingCache); ok {
+		return nil, ErrCacheUnsupported
+	}
+
+	data, err := b.cache.Get(ctx, f.siteURL(url))
+	if err != nil {
+		return nil, err
+	}
+	res, err := unmarshalResult(data)
+	if err != nil {
+		return nil, ErrCacheMiss
+	}
+
+	entry := &CacheEntry{Icons: res.Icons, TileColor: res.TileColor, Attempts: res.Attempts, Expires: res.Expires}
+	if res.Error != "" {
+		entry.Error = &cachedError{msg: res.Error, err: errorForCode(res.ErrorCode)}
+	}
+	return entry, nil
+}
+
+// EvictFromCache removes the cached result for url, so the next lookup
+// fetches the icons again.
+func (f *IconFinder) EvictFromCache(ctx context.Context, url string) error {
+	c, err := f.b.purgeableCache()
+	if err != nil {
+		return err
+	}
+	return c.Delete(ctx, f.siteURL(url))
+}
+
+// RefreshCache looks up url again and replaces its cached result, e.g. to
+// refresh a popular site before it expires. Failed lookups are cached like
+// any other, only an error of ctx is returned.
+func (f *IconFinder) RefreshCache(ctx context.Context, url string) error {
+	b := f.b
+	if b.cache == nil {
+		return ErrCacheUnsupported
+	}
+	if _, ok := b.cache.(LoadingCache); ok {
+		return ErrCacheUnsupported
+	}
+	_, err := b.loadAndStore(ctx, f.siteURL(url))
+	return err
+}
+
+// PurgeCache removes all cached results.
+func (b *Besticon) PurgeCache(ctx context.Context) error {
+	c, err := b.purgeableCache()
+	if err != nil {
+		return err
+	}
+	return c.Purge(ctx)
+}
+
+func (b *Besticon) purgeableCache() (PurgeableCache, error) {
+	c, ok := b.cache.(PurgeableCache)
+	if !ok {
+		return nil, ErrCacheUnsupported
+	}
+	return c, nil
+}
+
 func (b *Besticon) CacheEnabled() bool {
-	return b.iconCache != nil
+	return b.cache != nil
 }
 
-// GetCacheStats returns cache statistics.
+// GetCacheStats returns cache statistics. They are only available for
+// Groupcache and MemoryCache backends, others report zeros.
 func (b *Besticon) GetCacheStats() groupcache.CacheStats {
-	return b.iconCache.CacheStats(groupcache.MainCache)
+	if c, ok := b.cache.(interface{ Stats() groupcache.CacheStats }); ok {
+		return c.Stats()
+	}
+	return groupcache.CacheStats{}
 }
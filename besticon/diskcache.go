@@ -0,0 +1,257 @@
+package besticon
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DiskCache is a Cache storing values as files in a directory, so they
+// survive restarts. Expired files are removed when they are read and by
+// sweeps, which also keep the files within the size limit.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+	now      func() time.Time
+
+	// size is an estimate of the bytes in the directory, counting writes
+	// since the last sweep.
+	size      atomic.Int64
+	lastSweep atomic.Int64
+	sweeping  sync.Mutex
+}
+
+var _ PurgeableCache = (*DiskCache)(nil)
+
+// diskCacheSweepInterval is how often Set sweeps expired files even if the
+// cache is not full. The first Set always sweeps, to find the size of the
+// files already there.
+const diskCacheSweepInterval = 10 * time.Minute
+
+// NewDiskCache returns a DiskCache storing its files in dir, creating it if
+// needed, and keeping them within maxBytes. A maxBytes <= 0 means no limit.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskCache{dir: dir, maxBytes: maxBytes, now: time.Now}, nil
+}
+
+// Each file holds the expiry time in Unix nanoseconds, big-endian, followed
+// by the value.
+const diskCacheHeaderSize = 8
+
+// Get implements Cache.
+func (c *DiskCache) Get(ctx context.Context, key string) ([]byte, error) {
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < diskCacheHeaderSize {
+		os.Remove(path)
+		return nil, ErrCacheMiss
+	}
+
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	if !c.now().Before(expires) {
+		os.Remove(path)
+		return nil, ErrCacheMiss
+	}
+	return data[diskCacheHeaderSize:], nil
+}
+
+// Set implements Cache.
+func (c *DiskCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	data := make([]byte, diskCacheHeaderSize+len(value))
+	binary.BigEndian.PutUint64(data, uint64(c.now().Add(ttl).UnixNano()))
+	copy(data[diskCacheHeaderSize:], value)
+
+	if err := writeFileAtomic(c.path(key), data); err != nil {
+		return err
+	}
+	now := c.now()
+	size := c.size.Add(int64(len(data)))
+	if (c.maxBytes > 0 && size > c.maxBytes) || now.Sub(time.Unix(0, c.lastSweep.Load())) > diskCacheSweepInterval {
+		go func() {
+			if c.sweeping.TryLock() {
+				c.sweepLocked(now)
+				c.sweeping.Unlock()
+			}
+		}()
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path first and
+// then renames it, so readers never see half a file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Delete implements PurgeableCache.
+func (c *DiskCache) Delete(ctx context.Context, key string) error {
+	err := os.Remove(c.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Purge implements PurgeableCache. It removes the cache's files, other
+// files in the directory are left alone.
+func (c *DiskCache) Purge(ctx context.Context) error {
+	c.sweeping.Lock()
+	defer c.sweeping.Unlock()
+
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := c.remove(f.name); err != nil {
+			return err
+		}
+	}
+	c.size.Store(0)
+	return nil
+}
+
+// Sweep removes the expired files and, while the files are over the size
+// limit, the ones expiring soonest, which are the oldest for one TTL. It
+// stops below nine tenths of the limit, so that not every Set has to sweep.
+func (c *DiskCache) Sweep(ctx context.Context) error {
+	c.sweeping.Lock()
+	defer c.sweeping.Unlock()
+	return c.sweepLocked(c.now())
+}
+
+func (c *DiskCache) sweepLocked(now time.Time) error {
+	c.lastSweep.Store(now.UnixNano())
+
+	files, err := c.files()
+	if err != nil {
+		return err
+	}
+	var size int64
+	live := files[:0]
+	for _, f := range files {
+		if !now.Before(f.expires) {
+			if err := c.remove(f.name); err != nil {
+				return err
+			}
+			continue
+		}
+		size += f.size
+		live = append(live, f)
+	}
+
+	if c.maxBytes > 0 && size > c.maxBytes {
+		slices.SortFunc(live, func(a, b diskCacheFile) int {
+			return cmp.Or(a.expires.Compare(b.expires), cmp.Compare(a.name, b.name))
+		})
+		for _, f := range live {
+			if size <= c.maxBytes/10*9 {
+				break
+			}
+			if err := c.remove(f.name); err != nil {
+				return err
+			}
+			size -= f.size
+		}
+	}
+	c.size.Store(size)
+	return nil
+}
+
+type diskCacheFile struct {
+	name    string
+	size    int64
+	expires time.Time
+}
+
+// diskCacheFileRe matches the names of the cache's files, see path.
+var diskCacheFileRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// files returns the cache's files in the directory. Files without a valid
+// header expire right away.
+func (c *DiskCache) files() ([]diskCacheFile, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []diskCacheFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !diskCacheFileRe.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, diskCacheFile{
+			name:    e.Name(),
+			size:    info.Size(),
+			expires: c.readExpires(e.Name()),
+		})
+	}
+	return files, nil
+}
+
+func (c *DiskCache) readExpires(name string) time.Time {
+	var header [diskCacheHeaderSize]byte
+	f, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(header[:])))
+}
+
+func (c *DiskCache) remove(name string) error {
+	err := os.Remove(filepath.Join(c.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
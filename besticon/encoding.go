@@ -0,0 +1,271 @@
+package besticon
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Cached results are encoded in a compact binary format rather than JSON,
+// which would inflate the image data by a third and is slow to decode.
+//
+// An entry is the magic "BI", a version byte and the result. The result
+// starts with its expiry time so that checking it doesn't need a full
+// decode. Integers are varints, strings and byte slices are prefixed with
+// their length.
+const (
+	resultMagic   = "BI"
+	resultVersion = 2
+)
+
+var errCorruptResult = errors.New("besticon: corrupt cache entry")
+
+func marshalResult(res *result) []byte {
+	size := 64 + len(res.TileColor) + len(res.Error) + len(res.ErrorCode)
+	for _, a := range res.Attempts {
+		size += 8 + len(a.URL) + len(a.ErrorCode)
+	}
+	for _, ico := range res.Icons {
+		size += 128 + len(ico.URL) + len(ico.ImageData)
+	}
+
+	e := encoder{buf: make([]byte, 0, size)}
+	e.buf = append(e.buf, resultMagic...)
+	e.buf = append(e.buf, resultVersion)
+	e.time(res.Expires)
+	e.string(res.TileColor)
+	e.string(res.Error)
+	e.string(res.ErrorCode)
+	e.uint(uint64(len(res.Attempts)))
+	for _, a := range res.Attempts {
+		e.string(a.URL)
+		e.string(a.ErrorCode)
+	}
+	e.uint(uint64(len(res.Icons)))
+	for _, ico := range res.Icons {
+		e.string(ico.URL)
+		e.int(int64(ico.Width))
+		e.int(int64(ico.Height))
+		e.string(ico.Format)
+		e.int(int64(ico.Bytes))
+		code := ""
+		if ico.Error != nil {
+			code = ErrorCode(ico.Error)
+		}
+		e.string(code)
+		e.string(ico.Sha1sum)
+
+		p := ico.Provenance
+		e.string(p.Source)
+		e.string(p.Rel)
+		e.string(p.Sizes)
+		e.string(p.Type)
+		e.string(p.Media)
+		e.string(p.Purpose)
+		e.uint(uint64(len(p.Redirects)))
+		for _, r := range p.Redirects {
+			e.string(r)
+		}
+
+		e.bytes(ico.ImageData)
+	}
+	return e.buf
+}
+
+// unmarshalResult decodes an entry written by marshalResult.
+func unmarshalResult(data []byte) (*result, error) {
+	d, err := newDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &result{}
+	res.Expires = d.time()
+	res.TileColor = d.string()
+	res.Error = d.string()
+	res.ErrorCode = d.string()
+	if n := d.count(); n > 0 {
+		res.Attempts = make([]Attempt, n)
+		for i := range res.Attempts {
+			res.Attempts[i] = Attempt{URL: d.string(), ErrorCode: d.string()}
+		}
+	}
+	n := d.count()
+	if n > 0 {
+		res.Icons = make([]Icon, n)
+	}
+	for i := range res.Icons {
+		ico := &res.Icons[i]
+		ico.URL = d.string()
+		ico.Width = int(d.int())
+		ico.Height = int(d.int())
+		ico.Format = d.string()
+		ico.Bytes = int(d.int())
+		if code := d.string(); code != "" {
+			ico.Error = errorForCode(code)
+		}
+		ico.Sha1sum = d.string()
+
+		p := &ico.Provenance
+		p.Source = d.string()
+		p.Rel = d.string()
+		p.Sizes = d.string()
+		p.Type = d.string()
+		p.Media = d.string()
+		p.Purpose = d.string()
+		if n := d.count(); n > 0 {
+			p.Redirects = make([]string, n)
+			for j := range p.Redirects {
+				p.Redirects[j] = d.string()
+			}
+		}
+
+		ico.ImageData = d.bytes()
+	}
+
+	if d.err != nil || len(d.buf) != 0 {
+		return nil, errCorruptResult
+	}
+	return res, nil
+}
+
+// resultExpires returns the expiry time of an encoded result without
+// decoding all of it.
+func resultExpires(data []byte) (time.Time, error) {
+	d, err := newDecoder(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t := d.time()
+	return t, d.err
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) int(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) string(s string) {
+	e.uint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	// 0 is nil, everything else is the length plus one
+	if b == nil {
+		e.uint(0)
+		return
+	}
+	e.uint(uint64(len(b)) + 1)
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) time(t time.Time) {
+	if t.IsZero() {
+		e.int(0)
+		return
+	}
+	e.int(t.UnixNano())
+}
+
+// decoder reads what encoder wrote. After the first error all reads return
+// zero values and err is set.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func newDecoder(data []byte) (*decoder, error) {
+	header := len(resultMagic) + 1
+	if len(data) < header || string(data[:len(resultMagic)]) != resultMagic {
+		return nil, errCorruptResult
+	}
+	if data[len(resultMagic)] != resultVersion {
+		// Entries from other versions are treated like corrupt ones, they
+		// just get looked up again.
+		return nil, errCorruptResult
+	}
+	return &decoder{buf: data[header:]}, nil
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errCorruptResult
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errCorruptResult
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// count reads a number of elements, each taking up at least one byte.
+func (d *decoder) count() int {
+	n := d.uint()
+	if n > uint64(len(d.buf)) {
+		d.err = errCorruptResult
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) take(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = errCorruptResult
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.take(d.uint()))
+}
+
+// bytes returns a copy, callers may hold on to and modify it while data is
+// still used by the cache.
+func (d *decoder) bytes() []byte {
+	n := d.uint()
+	if n == 0 {
+		return nil
+	}
+	b := d.take(n - 1)
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+func (d *decoder) time() time.Time {
+	v := d.int()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v).UTC()
+}
@@ -0,0 +1,156 @@
+package besticon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMarshalResult(t *testing.T) {
+	res := sampleResult()
+	decoded, err := unmarshalResult(marshalResult(res))
+	check(err)
+	assertEquals(t, true, reflect.DeepEqual(res, decoded))
+
+	empty := &result{Error: "boom", ErrorCode: CodeNotFound}
+	decoded, err = unmarshalResult(marshalResult(empty))
+	check(err)
+	assertEquals(t, true, reflect.DeepEqual(empty, decoded))
+}
+
+func TestMarshalResultKeepsIconErrors(t *testing.T) {
+	res := &result{Icons: []Icon{{URL: "http://example.com/favicon.ico", Error: &NotFoundError{StatusCode: 404}}}}
+	decoded, err := unmarshalResult(marshalResult(res))
+	check(err)
+	assertEquals(t, true, errors.Is(decoded.Icons[0].Error, ErrNotFound))
+}
+
+func TestUnmarshalCorruptResult(t *testing.T) {
+	data := marshalResult(sampleResult())
+	for i := range len(data) {
+		if _, err := unmarshalResult(data[:i]); err == nil {
+			fail(t, "truncated entry was decoded")
+		}
+	}
+
+	_, err := unmarshalResult(append(data, 0))
+	assertEquals(t, errCorruptResult, err)
+
+	newer := append([]byte(nil), data...)
+	newer[len(resultMagic)] = resultVersion + 1
+	_, err = unmarshalResult(newer)
+	assertEquals(t, errCorruptResult, err)
+
+	old, _ := json.Marshal(sampleResult())
+	_, err = unmarshalResult(old)
+	assertEquals(t, errCorruptResult, err)
+	_, err = resultExpires(old)
+	assertEquals(t, errCorruptResult, err)
+}
+
+func TestResultExpires(t *testing.T) {
+	expires, err := resultExpires(marshalResult(sampleResult()))
+	check(err)
+	assertEquals(t, true, sampleResult().Expires.Equal(expires))
+}
+
+func TestCorruptCacheEntryIsAMiss(t *testing.T) {
+	for _, entry := range []string{`{"Icons":null,"TileColor":"","Error":""}`, "BI\x01garbage"} {
+		var lookups atomic.Int32
+		cache := NewMemoryCache(1 << 20)
+		b := newTestBesticon(nil, countLookups(&lookups, siteWithFavicon()), WithCacheBackend(cache))
+		check(cache.Set(context.Background(), testSiteURL, []byte(entry), time.Hour))
+
+		icons, err := b.NewIconFinder().FetchIcons(testSiteURL)
+		check(err)
+		assertEquals(t, 1, len(icons))
+
+		// the entry was replaced
+		b.NewIconFinder().FetchIcons(testSiteURL)
+		assertEquals(t, int32(1), lookups.Load())
+	}
+}
+
+// The benchmarks compare the binary encoding to the JSON one used before:
+//
+//	go test -run '^$' -bench 'Result' -benchmem
+//
+// entries/32MB is how many results of the sample site fit into the default
+// cache of the iconserver.
+func BenchmarkMarshalResultJSON(b *testing.B) {
+	res := sampleResult()
+	var data []byte
+	for b.Loop() {
+		data, _ = json.Marshal(res)
+	}
+	reportEntrySize(b, data)
+}
+
+func BenchmarkMarshalResultBinary(b *testing.B) {
+	res := sampleResult()
+	var data []byte
+	for b.Loop() {
+		data = marshalResult(res)
+	}
+	reportEntrySize(b, data)
+}
+
+func BenchmarkUnmarshalResultJSON(b *testing.B) {
+	data, _ := json.Marshal(sampleResult())
+	for b.Loop() {
+		var res result
+		check(json.Unmarshal(data, &res))
+	}
+	reportEntrySize(b, data)
+}
+
+func BenchmarkUnmarshalResultBinary(b *testing.B) {
+	data := marshalResult(sampleResult())
+	for b.Loop() {
+		_, err := unmarshalResult(data)
+		check(err)
+	}
+	reportEntrySize(b, data)
+}
+
+func reportEntrySize(b *testing.B, data []byte) {
+	b.ReportMetric(float64(len(data)), "bytes/entry")
+	b.ReportMetric(float64(32<<20/len(data)), "entries/32MB")
+}
+
+// sampleResult is a result as found for a typical site, with a favicon.ico
+// and a couple of PNGs and JPEGs.
+func sampleResult() *result {
+	icon := func(path string, width int, format string, file string) Icon {
+		data := mustReadFile(file)
+		return Icon{
+			URL:        testSiteURL + path,
+			Width:      width,
+			Height:     width,
+			Format:     format,
+			Bytes:      len(data),
+			Sha1sum:    "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3",
+			Provenance: Provenance{Source: SourceLinkTag, Rel: "icon", Sizes: "32x32", Type: "image/" + format},
+			ImageData:  data,
+		}
+	}
+
+	redirected := icon("/apple-touch-icon.png", 180, "png", "testdata/pixel.png")
+	redirected.Provenance.Redirects = []string{testSiteURL + "/old-icon.png", redirected.URL}
+
+	return &result{
+		Icons: []Icon{
+			icon("/favicon.ico", 48, "ico", "testdata/favicon.ico"),
+			redirected,
+			icon("/logo.jpg", 300, "jpg", "testdata/mat.jpg"),
+			icon("/icon.gif", 16, "gif", "testdata/pixel.gif"),
+		},
+		TileColor: "#ffffff",
+		Attempts:  []Attempt{{URL: "https://93.184.215.14", ErrorCode: CodeTimeout}, {URL: testSiteURL}},
+		Expires:   time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
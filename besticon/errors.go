@@ -0,0 +1,153 @@
+package besticon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Sentinel errors for lookup failures. Use errors.Is to check for them, the
+// struct errors below match the corresponding sentinel.
+var (
+	ErrNotFound         = errors.New("besticon: not found")
+	ErrEmptyResponse    = errors.New("besticon: empty response")
+	ErrPrivateAddress   = errors.New("besticon: private ip address disallowed")
+	ErrBodyTooLarge     = errors.New("besticon: body too large")
+	ErrDecode           = errors.New("besticon: unknown image format")
+	ErrTimeout          = errors.New("besticon: timeout")
+	ErrTooManyRedirects = errors.New("besticon: stopped after 10 redirects")
+)
+
+// Error codes as returned by ErrorCode. They are part of the API and will
+// not change.
+const (
+	CodeNotFound         = "not_found"
+	CodeEmptyResponse    = "empty_response"
+	CodePrivateAddress   = "private_address"
+	CodeBodyTooLarge     = "body_too_large"
+	CodeDecode           = "decode_failed"
+	CodeTimeout          = "timeout"
+	CodeTooManyRedirects = "too_many_redirects"
+	CodeParse            = "parse_failed"
+	CodeCanceled         = "canceled"
+	CodeUnknown          = "unknown"
+)
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrNotFound, CodeNotFound},
+	{ErrEmptyResponse, CodeEmptyResponse},
+	{ErrPrivateAddress, CodePrivateAddress},
+	{ErrBodyTooLarge, CodeBodyTooLarge},
+	{ErrDecode, CodeDecode},
+	{ErrTimeout, CodeTimeout},
+	{context.DeadlineExceeded, CodeTimeout},
+	{ErrTooManyRedirects, CodeTooManyRedirects},
+	{errParseHTML, CodeParse},
+	{errParseManifest, CodeParse},
+	{errParseBrowserconfig, CodeParse},
+	{context.Canceled, CodeCanceled},
+}
+
+// ErrorCode returns a stable, machine readable code for err, CodeUnknown if
+// there is none or "" if err is nil.
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeUnknown
+}
+
+// errorForCode is the reverse of ErrorCode, it returns the sentinel for
+// code.
+func errorForCode(code string) error {
+	for _, c := range errorCodes {
+		if c.code == code {
+			return c.err
+		}
+	}
+	return fmt.Errorf("besticon: %s", code)
+}
+
+// NotFoundError is returned when a server answers with a non 2xx status.
+type NotFoundError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("besticon: not found: %s returned status %d", e.URL, e.StatusCode)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// PrivateAddressError is returned when a host resolves to an address we
+// must not connect to.
+type PrivateAddressError struct {
+	Host string
+	IP   net.IP
+}
+
+func (e *PrivateAddressError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", ErrPrivateAddress, e.Host, e.IP)
+}
+
+func (e *PrivateAddressError) Is(target error) bool {
+	return target == ErrPrivateAddress
+}
+
+// DecodeError is returned for icons whose image format we can't decode.
+type DecodeError struct {
+	URL string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrDecode, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrDecode
+}
+
+// TimeoutError is returned when a request did not finish in time.
+type TimeoutError struct {
+	URL string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrTimeout, e.URL, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// isTimeout tells whether err is a network or deadline timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
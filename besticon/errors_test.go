@@ -0,0 +1,67 @@
+package besticon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{nil, ""},
+		{&NotFoundError{URL: "http://example.com", StatusCode: 404}, CodeNotFound},
+		{ErrEmptyResponse, CodeEmptyResponse},
+		{&PrivateAddressError{Host: "localhost", IP: net.IPv4(127, 0, 0, 1)}, CodePrivateAddress},
+		{ErrBodyTooLarge, CodeBodyTooLarge},
+		{&DecodeError{URL: "http://example.com/x.ico", Err: errors.New("image: unknown format")}, CodeDecode},
+		{&TimeoutError{URL: "http://example.com", Err: context.DeadlineExceeded}, CodeTimeout},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: ErrTooManyRedirects}, CodeTooManyRedirects},
+		{fmt.Errorf("wrapped: %w", errParseHTML), CodeParse},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: context.Canceled}, CodeCanceled},
+		{errors.New("something else"), CodeUnknown},
+	}
+
+	for _, test := range tests {
+		assertEquals(t, test.code, ErrorCode(test.err))
+	}
+}
+
+func TestErrorsMatchSentinels(t *testing.T) {
+	var notFound *NotFoundError
+	err := fmt.Errorf("lookup: %w", &NotFoundError{URL: "http://example.com", StatusCode: 503})
+	assertEquals(t, true, errors.Is(err, ErrNotFound))
+	assertEquals(t, true, errors.As(err, &notFound))
+	assertEquals(t, 503, notFound.StatusCode)
+
+	err = &TimeoutError{URL: "http://example.com", Err: context.DeadlineExceeded}
+	assertEquals(t, true, errors.Is(err, ErrTimeout))
+	assertEquals(t, true, errors.Is(err, context.DeadlineExceeded))
+	assertEquals(t, false, errors.Is(err, ErrNotFound))
+}
+
+func TestIconErrorJSON(t *testing.T) {
+	icon := Icon{URL: "http://example.com/favicon.ico", Error: &DecodeError{Err: errors.New("bad")}}
+
+	data, e := json.Marshal(icon)
+	check(e)
+	assertEquals(t, `{"url":"http://example.com/favicon.ico","width":0,"height":0,"format":"","bytes":0,"sha1sum":"","provenance":{"source":""},"error":"decode_failed"}`, string(data))
+
+	var decoded Icon
+	check(json.Unmarshal(data, &decoded))
+	assertEquals(t, true, errors.Is(decoded.Error, ErrDecode))
+	assertEquals(t, icon.URL, decoded.URL)
+
+	data, e = json.Marshal(Icon{URL: "http://example.com/favicon.ico", Width: 16})
+	check(e)
+	decoded = Icon{}
+	check(json.Unmarshal(data, &decoded))
+	assertEquals(t, nil, decoded.Error)
+	assertEquals(t, 16, decoded.Width)
+}
@@ -2,9 +2,10 @@ package besticon
 
 import (
 	"bytes"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
-	"maps"
 	"net/url"
 	"regexp"
 	"slices"
@@ -23,13 +24,59 @@ const (
 	favIcon                   = "icon"
 	appleTouchIcon            = "apple-touch-icon"
 	appleTouchIconPrecomposed = "apple-touch-icon-precomposed"
+	manifest                  = "manifest"
 )
 
-type empty struct{}
+// browserconfigPath is where IE and Edge look for tile images unless a page
+// points them elsewhere with <meta name="msapplication-config">.
+const browserconfigPath = "/browserconfig.xml"
+
+// Tile images declared with <meta name="msapplication-..."> tags and their
+// sizes. msapplication-TileImage is documented as 144x144.
+var msapplicationTiles = []struct {
+	name  string
+	sizes string
+}{
+	{"msapplication-square310x310logo", "310x310"},
+	{"msapplication-square150x150logo", "150x150"},
+	{"msapplication-tileimage", "144x144"},
+	{"msapplication-square70x70logo", "70x70"},
+}
+
+// iconLink is an icon candidate together with where and how it was
+// declared.
+type iconLink struct {
+	URL     string
+	Source  string
+	Rel     string
+	Sizes   string
+	Type    string
+	Media   string
+	Purpose string
+}
+
+func (l iconLink) provenance() Provenance {
+	return Provenance{
+		Source:  l.Source,
+		Rel:     l.Rel,
+		Sizes:   l.Sizes,
+		Type:    l.Type,
+		Media:   l.Media,
+		Purpose: l.Purpose,
+	}
+}
+
+// pageLinks is what findIconLinks discovers in a page.
+type pageLinks struct {
+	icons            []iconLink
+	manifestURL      string
+	browserconfigURL string
+	tileColor        string
+}
 
 // Find all icons in this html. We use siteURL as the base url unless we detect
 // another base url in <head>
-func findIconLinks(siteURL *url.URL, html []byte) ([]string, error) {
+func findIconLinks(siteURL *url.URL, html []byte) (*pageLinks, error) {
 	doc, e := docFromHTML(html)
 	if e != nil {
 		return nil, e
@@ -37,25 +84,81 @@ func findIconLinks(siteURL *url.URL, html []byte) ([]string, error) {
 
 	baseURL := determineBaseURL(siteURL, doc)
 
-	// Use a map to avoid dups
-	links := make(map[string]empty)
+	var links []iconLink
 
 	// Add common, hard coded icon paths
 	for _, path := range iconPaths {
-		links[urlFromBase(baseURL, path)] = empty{}
+		links = append(links, iconLink{URL: urlFromBase(baseURL, path), Source: SourceDefaultPath})
 	}
 
 	// Add icons found in page
-	urls := extractIconTags(doc)
-	for _, u := range urls {
-		absoluteURL, e := absoluteURL(baseURL, u)
+	for _, l := range extractIconTags(doc) {
+		absoluteURL, e := absoluteURL(baseURL, l.URL)
+		if e == nil {
+			l.URL = absoluteURL
+			links = append(links, l)
+		}
+	}
+
+	// Add Windows tile images
+	meta := extractMsapplicationTags(doc)
+	for _, tile := range msapplicationTiles {
+		if meta[tile.name] == "" {
+			continue
+		}
+		absoluteURL, e := absoluteURL(baseURL, meta[tile.name])
+		if e == nil {
+			links = append(links, iconLink{URL: absoluteURL, Source: SourceMetaTag, Sizes: tile.sizes})
+		}
+	}
+
+	page := &pageLinks{
+		icons:     uniqueIconLinks(links),
+		tileColor: meta["msapplication-tilecolor"],
+	}
+
+	if href := extractManifestTag(doc); href != "" {
+		manifestURL, e := absoluteURL(baseURL, href)
 		if e == nil {
-			links[absoluteURL] = empty{}
+			page.manifestURL = manifestURL
+		}
+	}
+
+	switch config := meta["msapplication-config"]; {
+	case config == "":
+		page.browserconfigURL = urlFromBase(baseURL, browserconfigPath)
+	case strings.EqualFold(config, "none"):
+		// Page opted out of browserconfig.xml
+	default:
+		browserconfigURL, e := absoluteURL(baseURL, config)
+		if e == nil {
+			page.browserconfigURL = browserconfigURL
+		}
+	}
+
+	return page, nil
+}
+
+// uniqueIconLinks drops duplicate URLs, keeping the first declaration, and
+// sorts the result by URL. A URL we only probe by default is replaced by an
+// actual declaration of the same URL.
+func uniqueIconLinks(links []iconLink) []iconLink {
+	seen := make(map[string]int)
+	var result []iconLink
+	for _, l := range links {
+		i, dup := seen[l.URL]
+		if !dup {
+			seen[l.URL] = len(result)
+			result = append(result, l)
+		} else if result[i].Source == SourceDefaultPath && l.Source != SourceDefaultPath {
+			result[i] = l
 		}
 	}
 
-	// Turn unique keys into a sorted array.
-	return slices.Sorted(maps.Keys(links)), nil
+	slices.SortFunc(result, func(a, b iconLink) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+	return result
 }
 
 // What is the baseURL for this doc?
@@ -101,17 +204,61 @@ var (
 )
 
 // Find icons from doc using goquery
-func extractIconTags(doc *goquery.Document) []string {
-	var hits []string
+func extractIconTags(doc *goquery.Document) []iconLink {
+	var hits []iconLink
 	doc.Find("link[href][rel]").Each(func(i int, s *goquery.Selection) {
 		href := extractIconTag(s)
 		if href != "" {
-			hits = append(hits, href)
+			rel, _ := s.Attr("rel")
+			sizes, _ := s.Attr("sizes")
+			typ, _ := s.Attr("type")
+			media, _ := s.Attr("media")
+			hits = append(hits, iconLink{
+				URL:    href,
+				Source: SourceLinkTag,
+				Rel:    strings.ToLower(strings.TrimSpace(rel)),
+				Sizes:  sizes,
+				Type:   typ,
+				Media:  media,
+			})
 		}
 	})
 	return hits
 }
 
+// Find <link rel="manifest" href="xxx">
+func extractManifestTag(doc *goquery.Document) string {
+	href := ""
+	doc.Find("link[href][rel]").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		rel, _ := s.Attr("rel")
+		if !slices.Contains(strings.Fields(strings.ToLower(rel)), manifest) {
+			return true
+		}
+		href, _ = s.Attr("href")
+		return href == ""
+	})
+	return href
+}
+
+// Find all <meta name="msapplication-xxx" content="yyy">, keyed by lower
+// case name.
+func extractMsapplicationTags(doc *goquery.Document) map[string]string {
+	meta := make(map[string]string)
+	doc.Find("meta[name][content]").Each(func(i int, s *goquery.Selection) {
+		name, _ := s.Attr("name")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !strings.HasPrefix(name, "msapplication-") {
+			return
+		}
+		if _, dup := meta[name]; dup {
+			return
+		}
+		content, _ := s.Attr("content")
+		meta[name] = strings.TrimSpace(content)
+	})
+	return meta
+}
+
 func extractIconTag(s *goquery.Selection) string {
 	// What sort of iconType is in this <rel>?
 	rel, _ := s.Attr("rel")
@@ -147,3 +294,109 @@ func regexpQuoteMetaArray(a []string) []string {
 	}
 	return quoted
 }
+
+// webAppManifest is the part of a Web App Manifest we care about, see
+// https://www.w3.org/TR/appmanifest/#icons-member
+type webAppManifest struct {
+	Icons []struct {
+		Src     string `json:"src"`
+		Sizes   string `json:"sizes"`
+		Type    string `json:"type"`
+		Purpose string `json:"purpose"`
+	} `json:"icons"`
+}
+
+// Parse the icons declared in a manifest. Relative srcs are resolved against
+// the manifest URL, not the page. Icons meant only as monochrome masks are
+// skipped since they don't look like the site's logo.
+func parseManifestIcons(manifestURL *url.URL, data []byte) ([]iconLink, error) {
+	var m webAppManifest
+	if e := json.Unmarshal(data, &m); e != nil {
+		return nil, errParseManifest
+	}
+
+	var links []iconLink
+	for _, icon := range m.Icons {
+		if icon.Src == "" || !usablePurpose(icon.Purpose) {
+			continue
+		}
+		src, e := url.Parse(icon.Src)
+		if e != nil {
+			continue
+		}
+		links = append(links, iconLink{
+			URL:     manifestURL.ResolveReference(src).String(),
+			Source:  SourceManifest,
+			Sizes:   icon.Sizes,
+			Type:    icon.Type,
+			Purpose: icon.Purpose,
+		})
+	}
+	return links, nil
+}
+
+var errParseManifest = errors.New("besticon: could not parse manifest")
+
+// A manifest icon without purpose means "any". Only monochrome icons are
+// unusable for us.
+func usablePurpose(purpose string) bool {
+	purposes := strings.Fields(strings.ToLower(purpose))
+	return len(purposes) == 0 || slices.ContainsFunc(purposes, func(p string) bool {
+		return p != "monochrome"
+	})
+}
+
+// browserconfig is the part of a browserconfig.xml we care about, see
+// https://learn.microsoft.com/en-us/previous-versions/windows/internet-explorer/ie-developer/platform-apis/dn320426(v=vs.85)
+type browserconfig struct {
+	Tile struct {
+		Square70x70Logo   browserconfigImage `xml:"square70x70logo"`
+		Square150x150Logo browserconfigImage `xml:"square150x150logo"`
+		Square310x310Logo browserconfigImage `xml:"square310x310logo"`
+		TileImage         browserconfigImage `xml:"TileImage"`
+		TileColor         string             `xml:"TileColor"`
+	} `xml:"msapplication>tile"`
+}
+
+type browserconfigImage struct {
+	Src string `xml:"src,attr"`
+}
+
+// Parse the tile images and color declared in a browserconfig.xml. Relative
+// srcs are resolved against the browserconfig URL.
+func parseBrowserconfig(browserconfigURL *url.URL, data []byte) ([]iconLink, string, error) {
+	var c browserconfig
+	if e := xml.Unmarshal(data, &c); e != nil {
+		return nil, "", errParseBrowserconfig
+	}
+
+	tile := c.Tile
+	images := []struct {
+		src   string
+		sizes string
+	}{
+		{tile.Square70x70Logo.Src, "70x70"},
+		{tile.Square150x150Logo.Src, "150x150"},
+		{tile.Square310x310Logo.Src, "310x310"},
+		{tile.TileImage.Src, "144x144"},
+	}
+
+	var links []iconLink
+	for _, img := range images {
+		if img.src == "" {
+			continue
+		}
+		src, e := url.Parse(strings.TrimSpace(img.src))
+		if e != nil {
+			continue
+		}
+		links = append(links, iconLink{
+			URL:    browserconfigURL.ResolveReference(src).String(),
+			Source: SourceBrowserconfig,
+			Sizes:  img.sizes,
+		})
+	}
+	return links, strings.TrimSpace(tile.TileColor), nil
+}
+
+var errParseBrowserconfig = errors.New("besticon: could not parse browserconfig")
@@ -1,6 +1,10 @@
 package besticon
 
 import (
+	"context"
+	"image/color"
+	"net/http"
+	"net/url"
 	"sort"
 	"testing"
 )
@@ -8,7 +12,10 @@ import (
 func mustFindIconLinks(html []byte) []string {
 	doc, e := docFromHTML(html)
 	check(e)
-	links := extractIconTags(doc)
+	var links []string
+	for _, l := range extractIconTags(doc) {
+		links = append(links, l.URL)
+	}
 	sort.Strings(links)
 	return links
 }
@@ -60,3 +67,170 @@ func TestLinkExtraction(t *testing.T) {
 		"/wp-content/assets/dist/img/icon/favicon.ico",
 	}, links)
 }
+
+func TestManifestLinkExtraction(t *testing.T) {
+	siteURL, e := url.Parse("https://example.com/blog/")
+	check(e)
+
+	page, e := findIconLinks(siteURL, []byte(`<head>
+		<link rel="icon" href="/favicon.png" sizes="32x32" type="image/png">
+		<link rel="manifest" href="/site.webmanifest">
+	</head>`))
+	check(e)
+	assertEquals(t, "https://example.com/site.webmanifest", page.manifestURL)
+	assertEquals(t, iconLink{URL: "https://example.com/favicon.png", Source: SourceLinkTag, Rel: "icon", Sizes: "32x32", Type: "image/png"}, page.icons[3])
+
+	page, e = findIconLinks(siteURL, []byte(`<link rel="icon" href="/favicon.png">`))
+	check(e)
+	assertEquals(t, "", page.manifestURL)
+}
+
+func TestParseManifestIcons(t *testing.T) {
+	manifestURL, e := url.Parse("https://example.com/static/manifest.json")
+	check(e)
+
+	links, e := parseManifestIcons(manifestURL, []byte(`{
+		"name": "Example",
+		"icons": [
+			{"src": "icon-192.png", "sizes": "192x192", "type": "image/png"},
+			{"src": "/icon-512.png", "sizes": "512x512", "type": "image/png", "purpose": "any maskable"},
+			{"src": "https://cdn.example.com/mask.png", "sizes": "512x512", "purpose": "monochrome"},
+			{"sizes": "48x48"}
+		]
+	}`))
+	check(e)
+	assertEquals(t, []iconLink{
+		{URL: "https://example.com/static/icon-192.png", Source: SourceManifest, Sizes: "192x192", Type: "image/png"},
+		{URL: "https://example.com/icon-512.png", Source: SourceManifest, Sizes: "512x512", Type: "image/png", Purpose: "any maskable"},
+	}, links)
+
+	_, e = parseManifestIcons(manifestURL, []byte("<html>"))
+	assertEquals(t, errParseManifest, e)
+}
+
+func TestFetchIconsFollowsManifest(t *testing.T) {
+	b := newTestBesticon(map[string]testResponse{
+		"/": {contentType: "text/html", body: []byte(`<link rel="manifest" href="/site.webmanifest">`)},
+		"/site.webmanifest": {contentType: "application/manifest+json", body: []byte(
+			`{"icons": [{"src": "/android-chrome-192x192.png", "sizes": "192x192", "type": "image/png"}]}`)},
+		"/android-chrome-192x192.png": {contentType: "image/png", body: testPNG(192, 192)},
+		"/favicon.ico":                {contentType: "image/x-icon", body: mustReadFile("testdata/favicon.ico")},
+	})
+
+	res, e := b.fetchIcons(context.Background(), testSiteURL)
+	check(e)
+	icons := res.Icons
+	assertEquals(t, 2, len(icons))
+	assertEquals(t, testSiteURL+"/android-chrome-192x192.png", icons[0].URL)
+	assertEquals(t, 192, icons[0].Width)
+	assertEquals(t, testSiteURL+"/favicon.ico", icons[1].URL)
+}
+
+func TestMsapplicationTagExtraction(t *testing.T) {
+	siteURL, e := url.Parse("https://example.com")
+	check(e)
+
+	page, e := findIconLinks(siteURL, []byte(`<head>
+		<meta name="msapplication-TileImage" content="/mstile-144x144.png">
+		<meta name="msapplication-square310x310logo" content="/mstile-310x310.png">
+		<meta name="msapplication-TileColor" content="#2b5797">
+		<meta name="msapplication-config" content="/ieconfig.xml">
+	</head>`))
+	check(e)
+	assertEquals(t, "#2b5797", page.tileColor)
+	assertEquals(t, "https://example.com/ieconfig.xml", page.browserconfigURL)
+	assertEquals(t, []iconLink{
+		{URL: "https://example.com/apple-touch-icon-precomposed.png", Source: SourceDefaultPath},
+		{URL: "https://example.com/apple-touch-icon.png", Source: SourceDefaultPath},
+		{URL: "https://example.com/favicon.ico", Source: SourceDefaultPath},
+		{URL: "https://example.com/mstile-144x144.png", Source: SourceMetaTag, Sizes: "144x144"},
+		{URL: "https://example.com/mstile-310x310.png", Source: SourceMetaTag, Sizes: "310x310"},
+	}, page.icons)
+
+	// Default path unless the page opts out
+	page, e = findIconLinks(siteURL, []byte(`<title>no tiles</title>`))
+	check(e)
+	assertEquals(t, "https://example.com/browserconfig.xml", page.browserconfigURL)
+
+	page, e = findIconLinks(siteURL, []byte(`<meta name="msapplication-config" content="none">`))
+	check(e)
+	assertEquals(t, "", page.browserconfigURL)
+}
+
+func TestParseBrowserconfig(t *testing.T) {
+	browserconfigURL, e := url.Parse("https://example.com/assets/browserconfig.xml")
+	check(e)
+
+	links, tileColor, e := parseBrowserconfig(browserconfigURL, []byte(`<?xml version="1.0" encoding="utf-8"?>
+<browserconfig>
+  <msapplication>
+    <tile>
+      <square150x150logo src="mstile-150x150.png"/>
+      <square310x310logo src="/mstile-310x310.png"/>
+      <TileColor>#da532c</TileColor>
+    </tile>
+  </msapplication>
+</browserconfig>`))
+	check(e)
+	assertEquals(t, "#da532c", tileColor)
+	assertEquals(t, []iconLink{
+		{URL: "https://example.com/assets/mstile-150x150.png", Source: SourceBrowserconfig, Sizes: "150x150"},
+		{URL: "https://example.com/mstile-310x310.png", Source: SourceBrowserconfig, Sizes: "310x310"},
+	}, links)
+
+	_, _, e = parseBrowserconfig(browserconfigURL, []byte("{}"))
+	assertEquals(t, errParseBrowserconfig, e)
+}
+
+func TestFetchIconsReadsBrowserconfig(t *testing.T) {
+	b := newTestBesticon(map[string]testResponse{
+		"/": {contentType: "text/html", body: []byte(`<title>tiles only</title>`)},
+		"/browserconfig.xml": {contentType: "application/xml", body: []byte(
+			`<browserconfig><msapplication><tile><square150x150logo src="/mstile-150x150.png"/><TileColor>#2d89ef</TileColor></tile></msapplication></browserconfig>`)},
+		"/mstile-150x150.png": {contentType: "image/png", body: testPNG(150, 150)},
+	})
+
+	finder := b.NewIconFinder()
+	finder.FormatsAllowed = []string{"png"}
+	icons, e := finder.FetchIcons(testSiteURL)
+	check(e)
+	assertEquals(t, 1, len(icons))
+	assertEquals(t, testSiteURL+"/mstile-150x150.png", icons[0].URL)
+	assertEquals(t, &color.RGBA{0x2d, 0x89, 0xef, 0xff}, finder.TileColor())
+}
+
+func TestUniqueIconLinksPrefersDeclarations(t *testing.T) {
+	links := uniqueIconLinks([]iconLink{
+		{URL: "https://example.com/favicon.ico", Source: SourceDefaultPath},
+		{URL: "https://example.com/a.png", Source: SourceLinkTag, Rel: "icon"},
+		{URL: "https://example.com/favicon.ico", Source: SourceLinkTag, Rel: "shortcut icon"},
+		{URL: "https://example.com/a.png", Source: SourceManifest},
+	})
+	assertEquals(t, []iconLink{
+		{URL: "https://example.com/a.png", Source: SourceLinkTag, Rel: "icon"},
+		{URL: "https://example.com/favicon.ico", Source: SourceLinkTag, Rel: "shortcut icon"},
+	}, links)
+}
+
+func TestFetchIconsRecordsProvenance(t *testing.T) {
+	b := newTestBesticon(map[string]testResponse{
+		"/": {contentType: "text/html", body: []byte(
+			`<link rel="apple-touch-icon" href="/old-icon.png" sizes="180x180" media="(prefers-color-scheme: dark)">`)},
+		"/old-icon.png":       {status: http.StatusMovedPermanently, location: "/icons/new-icon.png"},
+		"/icons/new-icon.png": {contentType: "image/png", body: testPNG(180, 180)},
+		"/favicon.ico":        {contentType: "image/x-icon", body: mustReadFile("testdata/favicon.ico")},
+	})
+
+	res, e := b.fetchIcons(context.Background(), testSiteURL)
+	check(e)
+	assertEquals(t, 2, len(res.Icons))
+
+	assertEquals(t, Provenance{
+		Source:    SourceLinkTag,
+		Rel:       "apple-touch-icon",
+		Sizes:     "180x180",
+		Media:     "(prefers-color-scheme: dark)",
+		Redirects: []string{testSiteURL + "/old-icon.png", testSiteURL + "/icons/new-icon.png"},
+	}, res.Icons[0].Provenance)
+	assertEquals(t, Provenance{Source: SourceDefaultPath}, res.Icons[1].Provenance)
+}
@@ -0,0 +1,181 @@
+package besticon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Fallbacks configures what lookups try when they can't fetch the page of
+// a site. In order, they retry the page, try the other scheme and then
+// the same for the www. or apex counterpart of the host and for its
+// registrable domain.
+type Fallbacks struct {
+	// Retries is how often to retry a page after a transient failure,
+	// i.e. a 429 or 5xx response or a dropped connection.
+	Retries int
+	// Backoff is how long to wait before the first retry, it doubles with
+	// every further retry.
+	Backoff time.Duration
+
+	// OtherScheme tries https for http URLs and the other way round.
+	OtherScheme bool
+	// WWW tries www.example.com for example.com and the other way round.
+	WWW bool
+	// ParentDomain tries example.co.uk for blog.example.co.uk.
+	ParentDomain bool
+}
+
+// DefaultFallbacks are the fallbacks lookups use unless configured
+// otherwise.
+var DefaultFallbacks = Fallbacks{
+	Retries:      1,
+	Backoff:      250 * time.Millisecond,
+	OtherScheme:  true,
+	WWW:          true,
+	ParentDomain: true,
+}
+
+type fallbacksOption struct {
+	fallbacks Fallbacks
+}
+
+func (f *fallbacksOption) applyOption(b *Besticon) {
+	b.fallbacks = &f.fallbacks
+}
+
+// WithFallbacks sets what lookups try when they can't fetch the page of a
+// site, DefaultFallbacks by default. Use Fallbacks{} to try just the URL
+// looked up.
+func WithFallbacks(f Fallbacks) Option {
+	return &fallbacksOption{fallbacks: f}
+}
+
+// Attempt is a page a lookup tried to fetch.
+type Attempt struct {
+	URL string
+	// ErrorCode is the code of the error fetching the page as returned by
+	// ErrorCode, empty if it was fetched.
+	ErrorCode string
+}
+
+// chain returns the URLs to try for siteURL, siteURL first.
+func (f *Fallbacks) chain(siteURL string) []string {
+	u, err := url.Parse(siteURL)
+	if err != nil || u.Host == "" {
+		return []string{siteURL}
+	}
+
+	schemes := []string{u.Scheme}
+	if f.OtherScheme && u.Port() == "" {
+		switch u.Scheme {
+		case "http":
+			schemes = append(schemes, "https")
+		case "https":
+			schemes = append(schemes, "http")
+		}
+	}
+
+	hosts := []string{u.Host}
+	host := u.Hostname()
+	if _, err := netip.ParseAddr(host); err != nil && u.Port() == "" {
+		domain, _ := publicsuffix.EffectiveTLDPlusOne(host)
+		if f.WWW {
+			if apex, ok := strings.CutPrefix(host, "www."); ok {
+				hosts = append(hosts, apex)
+			} else if host == domain {
+				hosts = append(hosts, "www."+host)
+			}
+		}
+		if f.ParentDomain && domain != "" && !slices.Contains(hosts, domain) {
+			hosts = append(hosts, domain)
+		}
+	}
+
+	var urls []string
+	for i, h := range hosts {
+		for _, scheme := range schemes {
+			c := url.URL{Scheme: scheme, Host: h}
+			if i == 0 {
+				// Other hosts may not have the same paths.
+				c = *u
+				c.Scheme = scheme
+			}
+			urls = append(urls, c.String())
+		}
+	}
+	return urls
+}
+
+// fetchPage fetches the HTML of siteURL, working through the fallbacks if
+// that fails. It returns the error of the last attempt if none worked.
+func (b *Besticon) fetchPage(ctx context.Context, siteURL string) (html []byte, finalURL *url.URL, attempts []Attempt, err error) {
+	f := b.fallbacks
+	if f == nil {
+		f = &DefaultFallbacks
+	}
+
+	// Hosts that timed out or don't resolve are down, trying them again with
+	// the other scheme would use up the lookup timeout before the other
+	// hosts get a chance.
+	down := map[string]bool{}
+	for _, candidate := range f.chain(siteURL) {
+		host := hostOf(candidate)
+		if down[host] {
+			continue
+		}
+		for try := 0; ; try++ {
+			html, finalURL, err = b.fetchHTML(ctx, candidate)
+			attempts = append(attempts, Attempt{URL: candidate, ErrorCode: ErrorCode(err)})
+			if err == nil || ctx.Err() != nil {
+				return html, finalURL, attempts, err
+			}
+
+			down[host] = isHostDown(err)
+			retry := try < f.Retries && isTransient(err) && !down[host]
+			b.log.DebugContext(ctx, "cannot fetch page", "url", candidate, "error", err, "retry", retry)
+			if !retry {
+				break
+			}
+			select {
+			case <-time.After(f.Backoff << try):
+			case <-ctx.Done():
+				return nil, nil, attempts, ctx.Err()
+			}
+		}
+	}
+	return nil, nil, attempts, err
+}
+
+// isHostDown reports whether err means the host of a page can't be reached
+// at all, no matter the scheme.
+func isHostDown(err error) bool {
+	var dnsErr *net.DNSError
+	return isTimeout(err) || errors.As(err, &dnsErr)
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Hostname()
+}
+
+// isTransient reports whether fetching a page again may work.
+func isTransient(err error) bool {
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		return notFound.StatusCode == 429 || notFound.StatusCode >= 500
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
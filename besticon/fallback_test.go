@@ -0,0 +1,208 @@
+package besticon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFallbackChain(t *testing.T) {
+	f := &DefaultFallbacks
+	for siteURL, expected := range map[string][]string{
+		"https://example.com": {
+			"https://example.com", "http://example.com",
+			"https://www.example.com", "http://www.example.com",
+		},
+		"http://www.example.com/path?q=1": {
+			"http://www.example.com/path?q=1", "https://www.example.com/path?q=1",
+			"http://example.com", "https://example.com",
+		},
+		"https://blog.example.co.uk": {
+			"https://blog.example.co.uk", "http://blog.example.co.uk",
+			"https://example.co.uk", "http://example.co.uk",
+		},
+		"https://www.blog.example.com": {
+			"https://www.blog.example.com", "http://www.blog.example.com",
+			"https://blog.example.com", "http://blog.example.com",
+			"https://example.com", "http://example.com",
+		},
+		"http://93.184.215.14":     {"http://93.184.215.14", "https://93.184.215.14"},
+		"http://example.com:8080":  {"http://example.com:8080"},
+		"http://co.uk":             {"http://co.uk", "https://co.uk"},
+		"ftp://example.com/x.html": {"ftp://example.com/x.html", "ftp://www.example.com"},
+	} {
+		assertEquals(t, expected, f.chain(siteURL))
+	}
+
+	none := &Fallbacks{}
+	assertEquals(t, []string{"https://blog.example.co.uk"}, none.chain("https://blog.example.co.uk"))
+	wwwOnly := &Fallbacks{WWW: true}
+	assertEquals(t, []string{"https://example.com", "https://www.example.com"}, wwwOnly.chain("https://example.com"))
+}
+
+// respondByURL answers requests with the body for their scheme and host,
+// failing for others like an unreachable site would.
+func respondByURL(pages map[string]string, requests *atomic.Int32) roundTripperFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		site := req.URL.Scheme + "://" + req.URL.Host
+		body, ok := pages[site]
+		if !ok {
+			return nil, syscall.ECONNREFUSED
+		}
+		if req.URL.Path != "" && req.URL.Path != "/" {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody, Request: req}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	}
+}
+
+func TestFallbacks(t *testing.T) {
+	var requests atomic.Int32
+	b := newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: respondByURL(map[string]string{
+			"https://www.example.com": `<html><head><link rel="icon" href="/icon.png"></head></html>`,
+		}, &requests)}),
+		WithFallbacks(DefaultFallbacks))
+
+	finder := b.NewIconFinder()
+	finder.FetchIcons("example.com")
+	assertEquals(t, []Attempt{
+		{URL: "https://example.com", ErrorCode: CodeUnknown},
+		{URL: "http://example.com", ErrorCode: CodeUnknown},
+		{URL: "https://www.example.com"},
+	}, finder.Attempts())
+
+	// The icons are looked for where the page was found.
+	var mu sync.Mutex
+	var seen []string
+	b = newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			seen = append(seen, req.URL.String())
+			mu.Unlock()
+			return respondByURL(map[string]string{
+				"https://example.co.uk": `<html><head><link rel="icon" href="/icon.png"></head></html>`,
+			}, &requests)(req)
+		})}),
+		WithFallbacks(Fallbacks{ParentDomain: true}))
+
+	finder = b.NewIconFinder()
+	finder.FetchIcons("https://blog.example.co.uk")
+	assertEquals(t, []Attempt{
+		{URL: "https://blog.example.co.uk", ErrorCode: CodeUnknown},
+		{URL: "https://example.co.uk"},
+	}, finder.Attempts())
+	mu.Lock()
+	defer mu.Unlock()
+	assertEquals(t, true, slices.Contains(seen, "https://example.co.uk/icon.png"))
+}
+
+func TestFallbacksSkipHostsThatAreDown(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	page := `<html><head></head></html>`
+	b := newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path != "" {
+				return &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody, Request: req}, nil
+			}
+			mu.Lock()
+			seen = append(seen, req.URL.String())
+			mu.Unlock()
+			switch req.URL.Host {
+			case "example.com":
+				// Hangs until the page timeout.
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			case "www.example.org":
+				return nil, &net.DNSError{Err: "no such host", Name: req.URL.Host, IsNotFound: true}
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(page)), Request: req}, nil
+		})}),
+		WithFallbacks(DefaultFallbacks),
+		WithTimeouts(Timeouts{Page: 50 * time.Millisecond}))
+
+	finder := b.NewIconFinder()
+	finder.FetchIcons("https://example.com")
+	assertEquals(t, []Attempt{
+		{URL: "https://example.com", ErrorCode: CodeTimeout},
+		{URL: "https://www.example.com"},
+	}, finder.Attempts())
+
+	finder.FetchIcons("https://www.example.org")
+	assertEquals(t, []Attempt{
+		{URL: "https://www.example.org", ErrorCode: CodeUnknown},
+		{URL: "https://example.org"},
+	}, finder.Attempts())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assertEquals(t, []string{"https://example.com", "https://www.example.com", "https://www.example.org", "https://example.org"}, seen)
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	var requests atomic.Int32
+	b := newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Path == "" && requests.Add(1) == 1 {
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: req}, nil
+			}
+			return respondWith(map[string]testResponse{"/": {body: []byte("<html></html>")}})(req)
+		})}),
+		WithFallbacks(Fallbacks{Retries: 2, Backoff: time.Millisecond}))
+
+	finder := b.NewIconFinder()
+	finder.FetchIcons(testSiteURL)
+	assertEquals(t, []Attempt{
+		{URL: testSiteURL, ErrorCode: CodeNotFound},
+		{URL: testSiteURL},
+	}, finder.Attempts())
+
+	// Permanent failures are not retried.
+	requests.Store(0)
+	b = newTestBesticon(nil,
+		countLookups(&requests, map[string]testResponse{"/": {status: http.StatusNotFound}}),
+		WithFallbacks(Fallbacks{Retries: 2, Backoff: time.Millisecond}))
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, int32(1), requests.Load())
+}
+
+func TestRetryStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			cancel()
+			return &http.Response{StatusCode: http.StatusBadGateway, Body: http.NoBody, Request: req}, nil
+		})}),
+		WithFallbacks(Fallbacks{Retries: 3, Backoff: time.Hour}))
+
+	_, err := b.NewIconFinder().FetchIconsContext(ctx, testSiteURL)
+	assertEquals(t, true, errors.Is(err, context.Canceled))
+}
+
+func TestIsTransient(t *testing.T) {
+	assertEquals(t, true, isTransient(&NotFoundError{StatusCode: 503}))
+	assertEquals(t, true, isTransient(&NotFoundError{StatusCode: 429}))
+	assertEquals(t, false, isTransient(&NotFoundError{StatusCode: 404}))
+	assertEquals(t, true, isTransient(syscall.ECONNRESET))
+	assertEquals(t, false, isTransient(syscall.ECONNREFUSED))
+	assertEquals(t, false, isTransient(&TimeoutError{Err: errors.New("slow")}))
+	assertEquals(t, false, isTransient(ErrPrivateAddress))
+}
+
+func TestIsHostDown(t *testing.T) {
+	assertEquals(t, true, isHostDown(&TimeoutError{Err: context.DeadlineExceeded}))
+	assertEquals(t, true, isHostDown(&net.DNSError{Err: "no such host", IsNotFound: true}))
+	assertEquals(t, false, isHostDown(syscall.ECONNREFUSED))
+	assertEquals(t, false, isHostDown(&NotFoundError{StatusCode: 503}))
+}
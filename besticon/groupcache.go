@@ -0,0 +1,127 @@
+package besticon
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+// Groupcache is a Cache backed by a groupcache group. Groupcache can't
+// replace or expire entries, so failed lookups are not cached and there is
+// no stale-while-revalidate.
+//
+// With a groupcache.HTTPPool set up, each site is looked up by the peer
+// owning its key only and shared with all others.
+type Groupcache struct {
+	group *groupcache.Group
+
+	mu   sync.RWMutex
+	load func(ctx context.Context, siteURL string) ([]byte, error)
+}
+
+var _ LoadingCache = (*Groupcache)(nil)
+
+var (
+	groupcachesMu sync.Mutex
+	groupcaches   = map[string]*Groupcache{}
+)
+
+type contextKeyLoader struct{}
+
+// NewGroupcache returns a Groupcache using the group with the given name and
+// a cache of sizeInMB. Groups are global, so asking for the same name twice
+// returns the same Groupcache.
+func NewGroupcache(name string, sizeInMB int64) *Groupcache {
+	groupcachesMu.Lock()
+	defer groupcachesMu.Unlock()
+
+	if g, ok := groupcaches[name]; ok {
+		return g
+	}
+	g := &Groupcache{}
+	g.group = groupcache.NewGroup(name, sizeInMB<<20, groupcache.GetterFunc(g.getter))
+	groupcaches[name] = g
+	return g
+}
+
+// setLoader sets how to load keys requested by peers. Their requests don't
+// come with a load function, so this one goes by the site URL alone.
+func (g *Groupcache) setLoader(load func(ctx context.Context, siteURL string) ([]byte, error)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.load = load
+}
+
+func (g *Groupcache) getter(ctx context.Context, key string, sink groupcache.Sink) error {
+	load, ok := ctx.Value(contextKeyLoader{}).(func(context.Context) ([]byte, error))
+	if !ok {
+		g.mu.RLock()
+		loadSite := g.load
+		g.mu.RUnlock()
+
+		_, siteURL, found := strings.Cut(key, "-")
+		if loadSite == nil || !found {
+			return ErrCacheMiss
+		}
+		load = func(ctx context.Context) ([]byte, error) {
+			return loadSite(ctx, siteURL)
+		}
+	}
+
+	data, err := load(ctx)
+	if err != nil {
+		return err
+	}
+	return sink.SetBytes(data)
+}
+
+// Get implements Cache.
+func (g *Groupcache) Get(ctx context.Context, key string) ([]byte, error) {
+	return g.GetOrLoad(ctx, key, defaultCacheTTL, func(context.Context) ([]byte, error) {
+		return nil, ErrCacheMiss
+	})
+}
+
+// Set does nothing, groupcache only stores values it loaded itself.
+func (g *Groupcache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return nil
+}
+
+// GetOrLoad implements LoadingCache. Groupcache can't expire entries, so
+// the key is scoped to the current ttl-sized time window instead. Windows
+// are offset per key so that not all entries expire at the same time.
+func (g *Groupcache) GetOrLoad(ctx context.Context, key string, ttl time.Duration, load func(context.Context) ([]byte, error)) ([]byte, error) {
+	c := context.WithValue(ctx, contextKeyLoader{}, load)
+	c = context.WithValue(c, contextKeySiteURL, key)
+
+	var data []byte
+	err := g.group.Get(c, groupcacheKey(key, ttl), groupcache.AllocatingByteSliceSink(&data))
+	return data, err
+}
+
+// Stats returns the statistics of the group's main cache.
+func (g *Groupcache) Stats() groupcache.CacheStats {
+	return g.group.CacheStats(groupcache.MainCache)
+}
+
+// Group returns the underlying group, e.g. for its Stats.
+func (g *Groupcache) Group() *groupcache.Group {
+	return g.group
+}
+
+func groupcacheKey(key string, ttl time.Duration) string {
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	offset := time.Duration(h.Sum64() % uint64(ttl))
+
+	window := time.Now().Add(offset).Truncate(ttl)
+	return fmt.Sprintf("%d-%s", window.Unix(), key)
+}
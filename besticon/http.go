@@ -1,9 +1,8 @@
 package besticon
 
 import (
-	"errors"
+	"context"
 	"io"
-	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -27,32 +26,67 @@ func (h *httpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return h.transport.RoundTrip(req)
 }
 
+const defaultUserAgent = "Mozilla/5.0 (iPhone; CPU iPhone OS 10_0 like Mac OS X) AppleWebKit/602.1.38 (KHTML, like Gecko) Version/10.0 Mobile/14A5297c Safari/602.1"
+
+// NewDefaultHTTPTransport returns a transport that sends userAgent and
+// connects only to addresses DefaultAddressPolicy allows.
 func NewDefaultHTTPTransport(userAgent string) http.RoundTripper {
+	return NewHTTPTransport(userAgent, DefaultAddressPolicy(), nil, DefaultTimeouts)
+}
+
+// NewHTTPTransport returns a transport that sends userAgent and connects
+// only to addresses policy allows, through proxy unless that is nil. It
+// applies the Dial, TLSHandshake and ResponseHeader timeouts, those of
+// DefaultTimeouts where they are zero.
+// Proxies set in the environment, e.g. with HTTPS_PROXY, are not used.
+func NewHTTPTransport(userAgent string, policy *AddressPolicy, proxy *ProxyConfig, timeouts Timeouts) http.RoundTripper {
+	timeouts = timeouts.withDefaults()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.TLSHandshakeTimeout = limit(timeouts.TLSHandshake)
+	transport.ResponseHeaderTimeout = limit(timeouts.ResponseHeader)
+
+	dialer := NewDialer(policy)
+	dialer.Timeout = limit(timeouts.Dial)
+	transport.DialContext = dialer.DialContext
+	if proxy != nil {
+		transport.DialContext = newProxyDialer(proxy, policy, limit(timeouts.Dial)).DialContext
+	}
 	return &httpTransport{
-		transport: http.DefaultTransport,
+		transport: transport,
 		userAgent: userAgent,
 	}
 }
 
+// NewDefaultHTTPClient returns the client lookups use by default. It has no
+// overall timeout, lookups bound their requests with the Page and Icon
+// timeouts.
 func NewDefaultHTTPClient() *http.Client {
+	return newHTTPClient(DefaultAddressPolicy(), nil, DefaultTimeouts)
+}
+
+func newHTTPClient(policy *AddressPolicy, proxy *ProxyConfig, timeouts Timeouts) *http.Client {
 	return &http.Client{
-		Timeout:   5 * time.Second,
-		Jar:       mustInitCookieJar(),
-		Transport: NewDefaultHTTPTransport("Mozilla/5.0 (iPhone; CPU iPhone OS 10_0 like Mac OS X) AppleWebKit/602.1.38 (KHTML, like Gecko) Version/10.0 Mobile/14A5297c Safari/602.1"),
-		// Re-validate the target of every redirect hop. Without this, the
-		// initial-host check in Get only covers the first request: a public
-		// host could 302 to a private/loopback/link-local address and the
-		// default redirect-following client would happily follow it.
+		Transport: NewHTTPTransport(defaultUserAgent, policy, proxy, timeouts),
+		// Redirect targets need no check of their own, the transport
+		// checks every address it connects to.
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if len(via) >= 10 {
-				return errors.New("stopped after 10 redirects")
+				return ErrTooManyRedirects
 			}
-			return checkPublicHost(req.URL.Hostname())
+			return nil
 		},
 	}
 }
 
 func (b *Besticon) Get(urlstring string) (*http.Response, error) {
+	return b.GetContext(context.Background(), urlstring)
+}
+
+// GetContext is like Get but aborts the request once ctx is done. If ctx
+// has no deadline, the Icon timeout bounds the request, reading the body
+// included.
+func (b *Besticon) GetContext(ctx context.Context, urlstring string) (*http.Response, error) {
 	u, e := url.Parse(urlstring)
 	if e != nil {
 		return nil, e
@@ -64,46 +98,49 @@ func (b *Besticon) Get(urlstring string) (*http.Response, error) {
 		return nil, e
 	}
 
-	if e := checkPublicHost(u.Hostname()); e != nil {
+	if e := b.addressPolicy.checkHost(u.Hostname()); e != nil {
 		return nil, e
 	}
 
-	req, e := http.NewRequest("GET", u.String(), nil)
+	cancel := context.CancelFunc(func() {})
+	if _, ok := ctx.Deadline(); !ok {
+		ctx, cancel = withTimeout(ctx, b.timeouts.Icon)
+	}
+
+	req, e := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if e != nil {
+		cancel()
 		return nil, e
 	}
 
 	start := time.Now()
-	resp, err := b.httpClient.Do(req)
+	resp, err := b.client(ctx).Do(req)
 	end := time.Now()
 	duration := end.Sub(start)
 
 	b.logger.LogResponse(req, resp, duration, err)
 
-	return resp, err
-}
-
-// checkPublicHost resolves host and rejects it if it maps to a
-// loopback/private address. It is applied both to the initial URL and to the
-// target of every redirect hop so that an allowed public host cannot be used
-// to bounce a request onto an internal address.
-func checkPublicHost(host string) error {
-	ipAddr, e := net.ResolveIPAddr("ip", host)
-	if e != nil {
-		return e
-	}
-	if isPrivateIP(ipAddr) {
-		return errors.New("private ip address disallowed")
+	if err != nil {
+		cancel()
+		if isTimeout(err) {
+			return nil, &TimeoutError{URL: urlstring, Err: err}
+		}
+		return nil, err
 	}
-	return nil
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
 }
 
-func isPrivateIP(ipAddr *net.IPAddr) bool {
-	if ipAddr == nil {
-		return false
-	}
+// cancelOnClose releases the timeout of a request once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-	return ipAddr.IP.IsLoopback() || ipAddr.IP.IsPrivate()
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
 }
 
 func (b *Besticon) GetBodyBytes(r *http.Response) ([]byte, error) {
@@ -112,11 +149,58 @@ func (b *Besticon) GetBodyBytes(r *http.Response) ([]byte, error) {
 	r.Body.Close()
 
 	if int64(len(data)) >= b.maxResponseBodySize {
-		return nil, errors.New("body too large")
+		return nil, ErrBodyTooLarge
 	}
 	return data, e
 }
 
+type cookieJarKey struct{}
+
+// withCookieJar gives the lookup in ctx a cookie jar of its own, so sites
+// can set cookies, e.g. on consent pages, without them being sent in other
+// lookups.
+func (b *Besticon) withCookieJar(ctx context.Context) context.Context {
+	if b.disableCookies {
+		return ctx
+	}
+	return context.WithValue(ctx, cookieJarKey{}, mustInitCookieJar())
+}
+
+// client returns the HTTP client for a request in ctx, one with the cookie
+// jar of the lookup. Requests outside lookups get a jar of their own.
+func (b *Besticon) client(ctx context.Context) *http.Client {
+	var jar http.CookieJar
+	if !b.disableCookies {
+		jar, _ = ctx.Value(cookieJarKey{}).(http.CookieJar)
+		if jar == nil {
+			jar = mustInitCookieJar()
+		}
+	}
+
+	client := *b.httpClient
+	client.Jar = jar
+	client.CheckRedirect = b.checkRedirect(b.httpClient.CheckRedirect)
+	return &client
+}
+
+// checkRedirect rejects redirects to IP addresses the policy denies before
+// calling next, if any. For transports from NewHTTPTransport that is
+// redundant, but clients passed to WithHTTPClient may not have one.
+func (b *Besticon) checkRedirect(next func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if err := b.addressPolicy.checkHost(req.URL.Hostname()); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= 10 {
+			return ErrTooManyRedirects
+		}
+		return nil
+	}
+}
+
 func mustInitCookieJar() *cookiejar.Jar {
 	options := cookiejar.Options{
 		PublicSuffixList: publicsuffix.List,
@@ -1,9 +1,14 @@
 package besticon
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"net/url"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -18,28 +23,28 @@ func TestGetFollowsRedirectToPrivateHost(t *testing.T) {
 
 	// "Internal" service on loopback. A direct request to it is rejected by
 	// the initial-host check; reaching it requires the redirect bypass.
-	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("cannot bind 127.0.0.2: %v", err)
+	}
+	internal := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		atomic.AddInt32(&internalHit, 1)
 		w.Write([]byte("INTERNAL"))
-	}))
+	})}}
+	internal.Start()
 	defer internal.Close()
 
-	// Public decoy: bound to the host link-local address (non-loopback,
-	// non-private per net.IP), so the initial-host check allows it. It
-	// redirects to the loopback internal service.
-	llHost := linkLocalHost(t)
-	ln, err := net.Listen("tcp", llHost+":0")
-	if err != nil {
-		t.Skipf("cannot bind link-local %s: %v", llHost, err)
-	}
-	decoy := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// Decoy standing in for a public host: allowed as an exception, so the
+	// initial-host check passes. It redirects to the internal service.
+	decoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, internal.URL+"/secret", http.StatusFound)
-	})}
-	go decoy.Serve(ln)
+	}))
 	defer decoy.Close()
 
-	b := New()
-	resp, err := b.Get("http://" + ln.Addr().String() + "/favicon")
+	policy := DefaultAddressPolicy()
+	policy.Allow = mustParsePrefixes("127.0.0.1/32")
+	b := New(WithAddressPolicy(policy))
+	resp, err := b.Get(decoy.URL + "/favicon")
 	if resp != nil {
 		resp.Body.Close()
 	}
@@ -55,6 +60,30 @@ func TestGetFollowsRedirectToPrivateHost(t *testing.T) {
 	}
 }
 
+// TestGetChecksRedirectsWithOwnClient makes sure redirects to denied IP
+// addresses are rejected for clients without a transport enforcing the
+// policy, too.
+func TestGetChecksRedirectsWithOwnClient(t *testing.T) {
+	var internalHit atomic.Int32
+	decoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/secret" {
+			internalHit.Add(1)
+			return
+		}
+		http.Redirect(w, r, "http://127.0.0.2:"+r.URL.Port()+"/secret", http.StatusFound)
+	}))
+	defer decoy.Close()
+
+	policy := DefaultAddressPolicy()
+	policy.Allow = mustParsePrefixes("127.0.0.1/32")
+	b := New(WithAddressPolicy(policy), WithHTTPClient(&http.Client{}), WithLogger(NewDefaultLogger(io.Discard)))
+	_, err := b.Get(decoy.URL + "/favicon")
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("expected redirect to private host to be rejected, got %v", err)
+	}
+	assertEquals(t, int32(0), internalHit.Load())
+}
+
 // TestGetRejectsDirectPrivateHost is the negative control: a direct request to
 // a loopback address is already rejected by the initial-host check.
 func TestGetRejectsDirectPrivateHost(t *testing.T) {
@@ -73,29 +102,137 @@ func TestGetRejectsDirectPrivateHost(t *testing.T) {
 	}
 }
 
-// linkLocalHost returns a usable non-loopback, non-private IP (link-local) on
-// the host so the decoy server passes the initial-host check.
-func linkLocalHost(t *testing.T) string {
-	t.Helper()
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		t.Skipf("cannot enumerate interfaces: %v", err)
+// TestGetChecksResolvedAddress makes sure host names are checked by the
+// addresses they resolve to when connecting.
+func TestGetChecksResolvedAddress(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("INTERNAL"))
+	}))
+	defer internal.Close()
+	u, _ := url.Parse(internal.URL)
+	localURL := "http://localhost:" + u.Port() + "/secret"
+
+	_, err := New().Get(localURL)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("expected request to localhost to be rejected, got err=%v", err)
 	}
-	for _, a := range addrs {
-		var ip net.IP
-		switch v := a.(type) {
-		case *net.IPNet:
-			ip = v.IP
-		case *net.IPAddr:
-			ip = v.IP
+	assertEquals(t, CodePrivateAddress, ErrorCode(err))
+
+	// Allowing the test host is the escape hatch for internal sites.
+	policy := DefaultAddressPolicy()
+	policy.Allow = mustParsePrefixes("127.0.0.1/32", "::1/128")
+	resp, err := New(WithAddressPolicy(policy)).Get(localURL)
+	check(err)
+	resp.Body.Close()
+	assertEquals(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAddressPolicy(t *testing.T) {
+	policy := DefaultAddressPolicy()
+	for ip, allowed := range map[string]bool{
+		"93.184.215.14":          true,
+		"2606:2800:21f:cb07::1":  true,
+		"127.0.0.1":              false,
+		"10.1.2.3":               false,
+		"172.31.0.1":             false,
+		"192.168.1.1":            false,
+		"169.254.169.254":        false,
+		"100.64.0.1":             false,
+		"0.0.0.0":                false,
+		"224.0.0.1":              false,
+		"255.255.255.255":        false,
+		"::":                     false,
+		"::1":                    false,
+		"::127.0.0.1":            false,
+		"::ffff:127.0.0.1":       false,
+		"::ffff:169.254.169.254": false,
+		"fe80::1%eth0":           false,
+		"fd00:ec2::254":          false,
+		"ff02::1":                false,
+	} {
+		if policy.Allowed(netip.MustParseAddr(ip)) != allowed {
+			t.Errorf("Allowed(%s) = %t, want %t", ip, !allowed, allowed)
 		}
-		if ip == nil || ip.To4() == nil {
-			continue
+	}
+	assertEquals(t, false, policy.Allowed(netip.Addr{}))
+
+	policy.Allow = mustParsePrefixes("10.0.0.0/24")
+	policy.Deny = append(policy.Deny, mustParsePrefixes("93.184.215.0/24")...)
+	assertEquals(t, true, policy.Allowed(netip.MustParseAddr("10.0.0.7")))
+	assertEquals(t, true, policy.Allowed(netip.MustParseAddr("::ffff:10.0.0.7")))
+	assertEquals(t, false, policy.Allowed(netip.MustParseAddr("10.0.1.7")))
+	assertEquals(t, false, policy.Allowed(netip.MustParseAddr("93.184.215.14")))
+	assertEquals(t, true, DefaultAddressPolicy().Allowed(netip.MustParseAddr("93.184.215.14")))
+}
+
+func TestGetRejectsPrivateIPBeforeConnecting(t *testing.T) {
+	var requests atomic.Int32
+	b := newTestBesticon(nil, WithHTTPClient(&http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests.Add(1)
+		return nil, errors.New("unexpected request")
+	})}))
+
+	_, err := b.Get("http://169.254.169.254/latest/meta-data/")
+	var e *PrivateAddressError
+	if !errors.As(err, &e) {
+		t.Fatalf("expected a PrivateAddressError, got %v", err)
+	}
+	assertEquals(t, "169.254.169.254", e.IP.String())
+	assertEquals(t, int32(0), requests.Load())
+}
+
+// consentWall answers / with a redirect to /consent, which sets a cookie
+// and redirects back, unless the request has the cookie. It counts the
+// requests to /consent and those that came with a cookie.
+func consentWall(consents, withCookies *atomic.Int32) roundTripperFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		if len(req.Cookies()) > 0 {
+			withCookies.Add(1)
 		}
-		if ip.IsLinkLocalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() {
-			return ip.String()
+		res := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: http.NoBody, Request: req}
+		switch {
+		case req.URL.Path == "/consent":
+			consents.Add(1)
+			res.StatusCode = http.StatusFound
+			res.Header.Set("Location", "/")
+			res.Header.Set("Set-Cookie", "consent=yes; Path=/")
+		case req.URL.Path == "/favicon.ico":
+			res.StatusCode = http.StatusOK
+			res.Body = io.NopCloser(bytes.NewReader(mustReadFile("testdata/favicon.ico")))
+		case req.URL.Path != "/" && req.URL.Path != "":
+		case req.Header.Get("Cookie") == "consent=yes":
+			res.StatusCode = http.StatusOK
+			res.Body = io.NopCloser(strings.NewReader(`<html><head></head></html>`))
+		default:
+			res.StatusCode = http.StatusFound
+			res.Header.Set("Location", "/consent")
 		}
+		return res, nil
 	}
-	t.Skip("no usable link-local IPv4 address on host")
-	return ""
+}
+
+func TestCookiesDoNotLeakBetweenLookups(t *testing.T) {
+	var consents, withCookies atomic.Int32
+	b := newTestBesticon(nil, WithHTTPClient(&http.Client{Transport: consentWall(&consents, &withCookies)}))
+
+	for i := 1; i <= 2; i++ {
+		icons, err := b.NewIconFinder().FetchIcons(testSiteURL)
+		check(err)
+		assertEquals(t, 1, len(icons))
+		// Every lookup has to pass the consent page again.
+		assertEquals(t, int32(i), consents.Load())
+	}
+	assertEquals(t, true, withCookies.Load() > 0)
+}
+
+func TestWithoutCookies(t *testing.T) {
+	var consents, withCookies atomic.Int32
+	b := newTestBesticon(nil, WithHTTPClient(&http.Client{
+		Transport: consentWall(&consents, &withCookies),
+		Jar:       mustInitCookieJar(),
+	}), WithCookies(false))
+
+	b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, true, consents.Load() > 0)
+	assertEquals(t, int32(0), withCookies.Load())
 }
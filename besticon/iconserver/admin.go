@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mat/besticon/v3/besticon"
+)
+
+const (
+	// maxWarmURLs limits how many sites one /admin/cache/warm request may
+	// look up.
+	maxWarmURLs = 1000
+	// warmConcurrency is how many of them are looked up at the same time.
+	warmConcurrency = 8
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+// registerAdminHandlers adds the cache administration endpoints, which need
+// the token as "Authorization: Bearer <token>". Without a token they are
+// not available.
+func (s *server) registerAdminHandlers(token string) {
+	if token == "" {
+		return
+	}
+	registerHandler("/admin/cache/stats", requireToken(token, http.MethodGet, s.adminStatsHandler))
+	registerHandler("/admin/cache/entry", requireToken(token, http.MethodGet, s.adminEntryHandler))
+	registerHandler("/admin/cache/purge", requireToken(token, http.MethodPost, s.adminPurgeHandler))
+	registerHandler("/admin/cache/warm", requireToken(token, http.MethodPost, s.adminWarmHandler))
+}
+
+func requireToken(token string, method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *server) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := s.besticon.GetCacheStats()
+	renderJSONResponse(w, 200, struct {
+		Enabled   bool  `json:"enabled"`
+		Bytes     int64 `json:"bytes"`
+		Items     int64 `json:"items"`
+		Gets      int64 `json:"gets"`
+		Hits      int64 `json:"hits"`
+		Evictions int64 `json:"evictions"`
+	}{
+		s.besticon.CacheEnabled(),
+		stats.Bytes,
+		stats.Items,
+		stats.Gets,
+		stats.Hits,
+		stats.Evictions,
+	})
+}
+
+func (s *server) adminEntryHandler(w http.ResponseWriter, r *http.Request) {
+	url := strings.TrimSpace(r.FormValue(urlParam))
+	if url == "" {
+		writeAPIError(w, 400, errors.New("need url parameter"))
+		return
+	}
+
+	entry, err := s.newIconFinder().CachedIcons(r.Context(), url)
+	if err != nil {
+		writeCacheError(w, r, err)
+		return
+	}
+
+	icons := make([]apiIcon, len(entry.Icons))
+	for i, icon := range entry.Icons {
+		icon.ImageData = nil
+		icons[i] = apiIcon{Icon: icon}
+	}
+	data := struct {
+		URL       string       `json:"url"`
+		Icons     []apiIcon    `json:"icons"`
+		TileColor string       `json:"tile_color,omitempty"`
+		Attempts  []apiAttempt `json:"attempts,omitempty"`
+		Error     string       `json:"error,omitempty"`
+		Code      string       `json:"code,omitempty"`
+		Expires   time.Time    `json:"expires"`
+	}{
+		URL:       url,
+		Icons:     icons,
+		TileColor: entry.TileColor,
+		Expires:   entry.Expires,
+	}
+	for _, a := range entry.Attempts {
+		data.Attempts = append(data.Attempts, apiAttempt{URL: a.URL, Code: a.ErrorCode})
+	}
+	if entry.Error != nil {
+		data.Error = entry.Error.Error()
+		data.Code = besticon.ErrorCode(entry.Error)
+	}
+	renderJSONResponse(w, 200, data)
+}
+
+// apiAttempt is a page a lookup tried to fetch.
+type apiAttempt struct {
+	URL  string `json:"url"`
+	Code string `json:"code,omitempty"`
+}
+
+// adminPurgeHandler removes the cached result for the url parameter, or
+// all of them with all=true.
+func (s *server) adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	url := strings.TrimSpace(r.FormValue(urlParam))
+	all := r.FormValue("all") == "true"
+
+	var err error
+	switch {
+	case all && url == "":
+		err = s.besticon.PurgeCache(r.Context())
+	case url != "" && !all:
+		finder := s.newIconFinder()
+		for _, u := range urlVariants(url) {
+			if err = finder.EvictFromCache(r.Context(), u); err != nil {
+				break
+			}
+		}
+	default:
+		writeAPIError(w, 400, errors.New("need either url or all=true"))
+		return
+	}
+	if err != nil {
+		writeCacheError(w, r, err)
+		return
+	}
+	if all {
+		logger.InfoContext(r.Context(), "purged the cache")
+	} else {
+		logger.InfoContext(r.Context(), "purged from the cache", "url", url)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// urlVariants returns the URLs a site may have been requested as: without a
+// scheme, both http and https.
+func urlVariants(url string) []string {
+	if strings.HasPrefix(url, "http:") || strings.HasPrefix(url, "https:") {
+		return []string{url}
+	}
+	return []string{"http://" + url, "https://" + url}
+}
+
+type warmResult struct {
+	URL   string `json:"url"`
+	Icons int    `json:"icons"`
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+// adminWarmHandler looks up the posted sites so that their results are
+// cached. The body is either a JSON array of URLs or one URL per line.
+func (s *server) adminWarmHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		writeAPIError(w, 400, errors.New("cannot read body"))
+		return
+	}
+	urls, err := parseWarmURLs(body)
+	if err != nil {
+		writeAPIError(w, 400, err)
+		return
+	}
+	if len(urls) > maxWarmURLs {
+		writeAPIError(w, 400, errors.New("too many urls"))
+		return
+	}
+
+	results := make([]warmResult, len(urls))
+	sem := make(chan struct{}, warmConcurrency)
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			icons, err := s.newIconFinder().FetchIconsContext(r.Context(), url)
+			results[i] = warmResult{URL: url, Icons: len(icons)}
+			if err != nil {
+				results[i].Error = err.Error()
+				results[i].Code = besticon.ErrorCode(err)
+			}
+		})
+	}
+	wg.Wait()
+
+	renderJSONResponse(w, 200, struct {
+		Results []warmResult `json:"results"`
+	}{results})
+}
+
+func parseWarmURLs(body []byte) ([]string, error) {
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		var urls []string
+		if err := json.Unmarshal(body, &urls); err != nil {
+			return nil, errors.New("body must be a JSON array of strings")
+		}
+		return urls, nil
+	}
+
+	var urls []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			urls = append(urls, line)
+		}
+	}
+	return urls, nil
+}
+
+func writeCacheError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, besticon.ErrCacheMiss):
+		writeAPIError(w, 404, errors.New("not in cache"))
+	case errors.Is(err, besticon.ErrCacheUnsupported):
+		writeAPIError(w, 501, fmt.Errorf("%w, needs CACHE_BACKEND memory or disk", err))
+	default:
+		logger.ErrorContext(r.Context(), "cache administration failed", "error", err)
+		writeAPIError(w, 500, err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mat/besticon/v3/besticon"
+)
+
+const testAdminToken = "secret"
+
+func TestAdminRequiresToken(t *testing.T) {
+	h := requireToken(testAdminToken, http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	for _, auth := range []string{"", "Bearer wrong", "secret", "Basic c2VjcmV0"} {
+		req := httptest.NewRequest("GET", "/admin/cache/stats", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		assertStringEquals(t, "401", fmt.Sprintf("%d", w.Code))
+		assertStringEquals(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+	}
+
+	w := httptest.NewRecorder()
+	h(w, adminRequest("POST", "/admin/cache/stats", ""))
+	assertStringEquals(t, "405", fmt.Sprintf("%d", w.Code))
+
+	w = httptest.NewRecorder()
+	h(w, adminRequest("GET", "/admin/cache/stats", ""))
+	assertStringEquals(t, "418", fmt.Sprintf("%d", w.Code))
+}
+
+func TestAdminCache(t *testing.T) {
+	var lookups atomic.Int32
+	s := newAdminTestServer(t, &lookups, besticon.NewMemoryCache(1<<20))
+
+	// warm
+	w := httptest.NewRecorder()
+	s.adminWarmHandler(w, adminRequest("POST", "/admin/cache/warm", "93.184.215.14\n\n"))
+	assertStringEquals(t, "200", fmt.Sprintf("%d", w.Code))
+	assertStringContains(t, w.Body.String(), `{"url":"93.184.215.14","icons":1}`)
+	assertStringEquals(t, "1", fmt.Sprint(lookups.Load()))
+
+	// stats
+	w = httptest.NewRecorder()
+	s.adminStatsHandler(w, adminRequest("GET", "/admin/cache/stats", ""))
+	assertStringContains(t, w.Body.String(), `"enabled":true`)
+	assertStringContains(t, w.Body.String(), `"items":1`)
+
+	// entry
+	w = httptest.NewRecorder()
+	s.adminEntryHandler(w, adminRequest("GET", "/admin/cache/entry?url=93.184.215.14", ""))
+	assertStringEquals(t, "200", fmt.Sprintf("%d", w.Code))
+	assertStringContains(t, w.Body.String(), `"url":"https://93.184.215.14/favicon.ico"`)
+	assertStringContains(t, w.Body.String(), `"attempts":[{"url":"https://93.184.215.14"}]`)
+	assertStringContains(t, w.Body.String(), `"expires":`)
+
+	// purge the site, looked up again afterwards
+	w = httptest.NewRecorder()
+	s.adminPurgeHandler(w, adminRequest("POST", "/admin/cache/purge?url=93.184.215.14", ""))
+	assertStringEquals(t, "204", fmt.Sprintf("%d", w.Code))
+
+	w = httptest.NewRecorder()
+	s.adminEntryHandler(w, adminRequest("GET", "/admin/cache/entry?url=93.184.215.14", ""))
+	assertStringEquals(t, "404", fmt.Sprintf("%d", w.Code))
+
+	s.newIconFinder().FetchIcons("93.184.215.14")
+	assertStringEquals(t, "2", fmt.Sprint(lookups.Load()))
+
+	// purge everything
+	w = httptest.NewRecorder()
+	s.adminPurgeHandler(w, adminRequest("POST", "/admin/cache/purge?all=true", ""))
+	assertStringEquals(t, "204", fmt.Sprintf("%d", w.Code))
+
+	w = httptest.NewRecorder()
+	s.adminStatsHandler(w, adminRequest("GET", "/admin/cache/stats", ""))
+	assertStringContains(t, w.Body.String(), `"items":0`)
+}
+
+func TestAdminPurgeNeedsURLOrAll(t *testing.T) {
+	s := newAdminTestServer(t, new(atomic.Int32), besticon.NewMemoryCache(1<<20))
+
+	for _, query := range []string{"", "?all=false", "?url=example.com&all=true"} {
+		w := httptest.NewRecorder()
+		s.adminPurgeHandler(w, adminRequest("POST", "/admin/cache/purge"+query, ""))
+		assertStringEquals(t, "400", fmt.Sprintf("%d", w.Code))
+	}
+}
+
+func TestAdminPurgeUnsupported(t *testing.T) {
+	s := newAdminTestServer(t, new(atomic.Int32), besticon.NewGroupcache("admin-test", 1))
+
+	for _, req := range []*http.Request{
+		adminRequest("POST", "/admin/cache/purge?all=true", ""),
+		adminRequest("POST", "/admin/cache/purge?url=93.184.215.14", ""),
+		adminRequest("GET", "/admin/cache/entry?url=93.184.215.14", ""),
+	} {
+		w := httptest.NewRecorder()
+		if req.Method == "GET" {
+			s.adminEntryHandler(w, req)
+		} else {
+			s.adminPurgeHandler(w, req)
+		}
+		assertStringEquals(t, "501", fmt.Sprintf("%d", w.Code))
+		assertStringContains(t, w.Body.String(), "not supported by the cache backend, needs CACHE_BACKEND memory or disk")
+	}
+}
+
+func TestAdminWarmLimits(t *testing.T) {
+	s := newAdminTestServer(t, new(atomic.Int32), besticon.NewMemoryCache(1<<20))
+
+	w := httptest.NewRecorder()
+	s.adminWarmHandler(w, adminRequest("POST", "/admin/cache/warm", strings.Repeat("example.com\n", maxWarmURLs+1)))
+	assertStringEquals(t, "400", fmt.Sprintf("%d", w.Code))
+
+	w = httptest.NewRecorder()
+	s.adminWarmHandler(w, adminRequest("POST", "/admin/cache/warm", `["example.com", 1]`))
+	assertStringEquals(t, "400", fmt.Sprintf("%d", w.Code))
+}
+
+func TestParseWarmURLs(t *testing.T) {
+	urls, _ := parseWarmURLs([]byte(` ["a.com", "https://b.com"] `))
+	assertStringEquals(t, "a.com https://b.com", strings.Join(urls, " "))
+
+	urls, _ = parseWarmURLs([]byte("a.com\r\n\n  b.com  \n"))
+	assertStringEquals(t, "a.com b.com", strings.Join(urls, " "))
+}
+
+func newAdminTestServer(t *testing.T, lookups *atomic.Int32, cache besticon.Cache, opts ...besticon.Option) *server {
+	respond := respondWith(map[string]string{
+		"/":            `<html><head></head></html>`,
+		"/favicon.ico": string(mustReadFile(t, "../testdata/favicon.ico")),
+	})
+	return newTestServerWithTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "" || req.URL.Path == "/" {
+			lookups.Add(1)
+		}
+		return respond(req)
+	}), append(opts, besticon.WithCacheBackend(cache))...)
+}
+
+func adminRequest(method string, target string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mat/besticon/v3/besticon"
+)
+
+const imagePathPrefix = "/img/"
+
+// imageStoreFromEnv returns the image store selected by IMAGE_STORE, nil if
+// there is none.
+func imageStoreFromEnv() (besticon.ImageStore, error) {
+	switch store := os.Getenv("IMAGE_STORE"); store {
+	case "":
+		return nil, nil
+	case "file":
+		return besticon.NewFileImageStore(getenvOrFallback("IMAGE_STORE_DIR", filepath.Join(os.TempDir(), "besticon-images")))
+	case "s3":
+		return besticon.NewS3ImageStore(besticon.S3Config{
+			Endpoint:        getenvOrFallback("IMAGE_STORE_S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Bucket:          os.Getenv("IMAGE_STORE_S3_BUCKET"),
+			Region:          os.Getenv("IMAGE_STORE_S3_REGION"),
+			Prefix:          os.Getenv("IMAGE_STORE_S3_PREFIX"),
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown IMAGE_STORE %q", store)
+	}
+}
+
+// imageHandler serves images from the image store as /img/<sha1>.<format>.
+// Their URLs change with their content, so they can be cached forever. The
+// format must be the image's, so nobody can have an image served as
+// another type.
+func (s *server) imageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	name := strings.TrimPrefix(r.URL.Path, imagePathPrefix)
+	sha1sum, format, _ := strings.Cut(name, ".")
+	mimeType, ok := formatContentTypes[format]
+	if s.imageStore == nil || !ok || !besticon.IsSha1sum(sha1sum) {
+		writeAPIError(w, 404, errors.New("not found"))
+		return
+	}
+
+	data, err := s.imageStore.Get(r.Context(), sha1sum)
+	if errors.Is(err, besticon.ErrImageNotFound) {
+		writeAPIError(w, 404, errors.New("not found"))
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(r.Context(), "cannot load image", "sha1sum", sha1sum, "error", err)
+		writeAPIError(w, 500, errors.New("cannot load image"))
+		return
+	}
+	if formatContentTypes[imageFormat(data)] != mimeType {
+		writeAPIError(w, 404, errors.New("not found"))
+		return
+	}
+
+	w.Header().Set(cacheControl, "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+sha1sum+`"`)
+	if etagMatches(r.Header.Get("If-None-Match"), `"`+sha1sum+`"`) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set(contentType, mimeType)
+	if format == "svg" {
+		w.Header().Set(contentSecurityPolicy, svgContentSecurityPolicy)
+	}
+	w.Write(data)
+}
+
+// imageURL returns the URL at which /img serves icon, "" if it doesn't.
+func (s *server) imageURL(r *http.Request, icon besticon.Icon) string {
+	if s.imageStore == nil || icon.Error != nil || !besticon.IsSha1sum(icon.Sha1sum) {
+		return ""
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s%s.%s", scheme, r.Host, imagePathPrefix, icon.Sha1sum, icon.Format)
+}
+
+// apiIcon is an icon as returned by /allicons.json.
+type apiIcon struct {
+	besticon.Icon
+	ImageURL string
+}
+
+func (a apiIcon) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(a.Icon)
+	if err != nil || a.ImageURL == "" {
+		return data, err
+	}
+
+	imageURL, err := json.Marshal(a.ImageURL)
+	if err != nil {
+		return nil, err
+	}
+	// Add "image_url" as the last field of the icon's object.
+	data = append(data[:len(data)-1], `,"image_url":`...)
+	data = append(data, imageURL...)
+	return append(data, '}'), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mat/besticon/v3/besticon"
+)
+
+const testSha1sum = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+func TestImageHandler(t *testing.T) {
+	store, err := besticon.NewFileImageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gif := mustReadFile(t, "../testdata/pixel.gif")
+	if err := store.Put(context.Background(), testSha1sum, gif); err != nil {
+		t.Fatal(err)
+	}
+	s := &server{imageStore: store}
+
+	w := httptest.NewRecorder()
+	s.imageHandler(w, httptest.NewRequest("GET", "/img/"+testSha1sum+".gif", nil))
+	assertStringEquals(t, "200", fmt.Sprintf("%d", w.Code))
+	assertStringEquals(t, "image/gif", w.Header().Get("Content-Type"))
+	assertStringEquals(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+	assertStringEquals(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assertStringEquals(t, string(gif), w.Body.String())
+
+	req := httptest.NewRequest("GET", "/img/"+testSha1sum+".gif", nil)
+	req.Header.Set("If-None-Match", `"`+testSha1sum+`"`)
+	w = httptest.NewRecorder()
+	s.imageHandler(w, req)
+	assertStringEquals(t, "304", fmt.Sprintf("%d", w.Code))
+
+	for _, path := range []string{
+		"/img/0000000000000000000000000000000000000000.gif",
+		"/img/" + testSha1sum + ".exe",
+		// not what's stored
+		"/img/" + testSha1sum + ".png",
+		"/img/" + testSha1sum + ".svg",
+		"/img/" + testSha1sum,
+		"/img/../../etc/passwd",
+	} {
+		w = httptest.NewRecorder()
+		s.imageHandler(w, httptest.NewRequest("GET", path, nil))
+		assertStringEquals(t, "404", fmt.Sprintf("%d", w.Code))
+		assertStringEquals(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	}
+}
+
+func TestGetAllIconsWithImageURLs(t *testing.T) {
+	store, err := besticon.NewFileImageStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServerWithTransport(respondWith(map[string]string{
+		"/":            `<html><head></head></html>`,
+		"/favicon.ico": string(mustReadFile(t, "../testdata/favicon.ico")),
+	}), besticon.WithImageStore(store))
+	s.imageStore = store
+
+	req, err := http.NewRequest("GET", "/allicons.json?url=http://93.184.215.14", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "icons.example.com"
+	w := httptest.NewRecorder()
+	s.alliconsHandler(w, req)
+
+	assertStringEquals(t, "200", fmt.Sprintf("%d", w.Code))
+	assertStringContains(t, w.Body.String(), `"image_url":"http://icons.example.com/img/`)
+	assertStringContains(t, w.Body.String(), `.ico"}`)
+}
@@ -1,13 +1,94 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
-var logger = log.New(os.Stdout, "server: ", log.LstdFlags|log.Lmicroseconds)
+var logger = newLogger(os.Stdout, "text", slog.LevelInfo)
+
+// loggerFromEnv returns the logger configured by LOG_FORMAT (text or json)
+// and LOG_LEVEL (debug, info, warn or error).
+func loggerFromEnv(w io.Writer) (*slog.Logger, error) {
+	format := getenvOrFallback("LOG_FORMAT", "text")
+	if format != "text" && format != "json" {
+		return nil, fmt.Errorf("unknown LOG_FORMAT %q, want text or json", format)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getenvOrFallback("LOG_LEVEL", "info"))); err != nil {
+		return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+
+	return newLogger(w, format, level), nil
+}
+
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(requestIDHandler{h})
+}
+
+// fatal logs msg and exits.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler adds the ID of the request being served, if any, to
+// records. That includes the ones of the besticon package, which logs with
+// the context of the lookup.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// newRequestID returns the X-Request-ID of req if it looks sane, so IDs
+// assigned by a proxy in front of us carry over, and a new one otherwise.
+func newRequestID(req *http.Request) string {
+	id := req.Header.Get(requestIDHeader)
+	if id != "" && len(id) <= 128 && !strings.ContainsFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) {
+		return id
+	}
+	return rand.Text()
+}
 
 type loggingWriter struct {
 	http.ResponseWriter
@@ -32,22 +113,28 @@ func (w *loggingWriter) Write(b []byte) (int, error) {
 	return bytesWritten, err
 }
 
-func newLoggingMux() http.HandlerFunc {
+// newLoggingMux serves requests with mux, assigning each a request ID
+// and logging it.
+func newLoggingMux(mux http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		id := newRequestID(req)
+		w.Header().Set(requestIDHeader, id)
+		req = req.WithContext(withRequestID(req.Context(), id))
+
 		start := time.Now()
 		writer := loggingWriter{w, 0, 0}
-		http.DefaultServeMux.ServeHTTP(&writer, req)
+		mux.ServeHTTP(&writer, req)
 		end := time.Now()
 		duration := end.Sub(start)
 
-		logger.Printf("%s %s %d \"%s\" %s %.2fms %d",
-			req.Method,
-			req.URL,
-			writer.status,
-			req.UserAgent(),
-			req.Referer(),
-			float64(duration)/float64(time.Millisecond),
-			writer.length,
+		logger.LogAttrs(req.Context(), slog.LevelInfo, "request",
+			slog.String("method", req.Method),
+			slog.String("url", req.URL.String()),
+			slog.Int("status", writer.status),
+			slog.String("user_agent", req.UserAgent()),
+			slog.String("referer", req.Referer()),
+			slog.Float64("duration_ms", float64(duration)/float64(time.Millisecond)),
+			slog.Int("bytes", writer.length),
 		)
 	}
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mat/besticon/v3/besticon"
+)
+
+// captureLogs sends the logs of the test to the returned buffer as JSON.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := logger
+	logger = newLogger(&buf, "json", slog.LevelDebug)
+	t.Cleanup(func() { logger = previous })
+	return &buf
+}
+
+func TestRequestIDFlowsIntoLibraryLogs(t *testing.T) {
+	buf := captureLogs(t)
+	s := newTestServerWithTransport(respondWith(map[string]string{"/": `<html><head></head></html>`}),
+		besticon.WithCacheBackend(besticon.NewMemoryCache(1<<20)), besticon.WithSlogLogger(logger))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/icon", s.iconHandler)
+
+	w := httptest.NewRecorder()
+	newLoggingMux(mux)(w, httptest.NewRequest("GET", "/icon?url=93.184.215.14&size=32", nil))
+
+	id := w.Header().Get(requestIDHeader)
+	if id == "" {
+		t.Fatal("no request ID in response")
+	}
+	messages := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		assertStringEquals(t, id, rec["request_id"].(string))
+		messages[rec["msg"].(string)] = true
+	}
+	for _, msg := range []string{"request", "cache miss", "upstream response", "no icon in size range"} {
+		if !messages[msg] {
+			t.Errorf("no %q record in %s", msg, buf)
+		}
+	}
+}
+
+func TestRequestIDFromHeader(t *testing.T) {
+	captureLogs(t)
+	handler := newLoggingMux(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(requestID(r.Context())))
+	}))
+
+	for header, keep := range map[string]bool{"proxy-4711": true, "": false, "bad\nid": false, strings.Repeat("x", 129): false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(requestIDHeader, header)
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		id := w.Header().Get(requestIDHeader)
+		assertStringEquals(t, id, w.Body.String())
+		if keep != (id == header) || id == "" {
+			t.Errorf("got request ID %q for header %q", id, header)
+		}
+	}
+}
+
+func TestLoggerFromEnv(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("LOG_LEVEL", "debug")
+	var buf bytes.Buffer
+	l, err := loggerFromEnv(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("hello", "key", "value")
+	assertStringContains(t, buf.String(), `"msg":"hello","key":"value"`)
+
+	t.Setenv("LOG_LEVEL", "loud")
+	if _, err := loggerFromEnv(&buf); err == nil {
+		t.Error("expected an error for LOG_LEVEL=loud")
+	}
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LOG_FORMAT", "xml")
+	if _, err := loggerFromEnv(&buf); err == nil {
+		t.Error("expected an error for LOG_FORMAT=xml")
+	}
+}
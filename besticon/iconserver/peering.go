@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mat/besticon/v3/besticon"
+
+	"github.com/golang/groupcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How often GROUPCACHE_PEERS_FILE is checked for changes.
+const peersFileInterval = 10 * time.Second
+
+// startPeering sets up the groupcache pool of iconserver replicas if
+// GROUPCACHE_SELF is set. The pool is served on GROUPCACHE_ADDRESS, which
+// should only be reachable by the other replicas: anyone who can reach it
+// can have this replica look up any site.
+func startPeering(cache besticon.Cache) {
+	self := os.Getenv("GROUPCACHE_SELF")
+	if self == "" {
+		return
+	}
+	if _, ok := cache.(*besticon.Groupcache); !ok {
+		fatal("GROUPCACHE_SELF needs CACHE_BACKEND=groupcache")
+	}
+
+	pool := groupcache.NewHTTPPoolOpts(self, nil)
+	pool.Transport = func(context.Context) http.RoundTripper {
+		return &peerStatsTransport{next: http.DefaultTransport}
+	}
+
+	if peersFile := os.Getenv("GROUPCACHE_PEERS_FILE"); peersFile != "" {
+		go watchPeersFile(pool, self, peersFile, peersFileInterval)
+	} else {
+		setPeers(pool, self, stringSliceFromEnv("GROUPCACHE_PEERS"))
+	}
+
+	addr, err := peerAddressFromEnv()
+	if err != nil {
+		fatal("cannot start groupcache peer server", "error", err)
+	}
+	go func() {
+		logger.Info("starting groupcache peer server", "address", addr)
+		err := http.ListenAndServe(addr, pool)
+		if err != nil {
+			fatal("cannot start groupcache peer server", "error", err)
+		}
+	}()
+}
+
+// peerAddressFromEnv returns the address to serve the pool on. Peers can't
+// reach the loopback default, so GROUPCACHE_ADDRESS must be set when there
+// are any.
+func peerAddressFromEnv() (string, error) {
+	addr := os.Getenv("GROUPCACHE_ADDRESS")
+	if addr != "" {
+		return addr, nil
+	}
+	if os.Getenv("GROUPCACHE_PEERS") != "" || os.Getenv("GROUPCACHE_PEERS_FILE") != "" {
+		return "", errors.New("GROUPCACHE_ADDRESS must be set with GROUPCACHE_PEERS or GROUPCACHE_PEERS_FILE")
+	}
+	return "127.0.0.1:9090", nil
+}
+
+// setPeers makes peers the pool's peers, self is always one of them.
+func setPeers(pool *groupcache.HTTPPool, self string, peers []string) {
+	var all []string
+	for _, p := range slices.Concat(peers, []string{self}) {
+		p = strings.TrimSuffix(strings.TrimSpace(p), "/")
+		if p != "" && !slices.Contains(all, p) {
+			all = append(all, p)
+		}
+	}
+	pool.Set(all...)
+	logger.Info("groupcache peers", "peers", strings.Join(all, ", "))
+}
+
+// watchPeersFile sets the pool's peers from path, one per line, whenever it
+// changes. Empty lines and lines starting with # are ignored.
+func watchPeersFile(pool *groupcache.HTTPPool, self string, path string, interval time.Duration) {
+	var last []byte
+	for {
+		data, err := os.ReadFile(path)
+		switch {
+		case err != nil:
+			logger.Error("cannot read GROUPCACHE_PEERS_FILE", "error", err)
+		case last == nil || !bytes.Equal(data, last):
+			setPeers(pool, self, parsePeersFile(data))
+			last = data
+		}
+		time.Sleep(interval)
+	}
+}
+
+func parsePeersFile(data []byte) []string {
+	var peers []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		peers = append(peers, line)
+	}
+	return peers
+}
+
+var peerRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "groupcache_peer_requests_total",
+		Help: "Requests to groupcache peers by result, hit if the peer answered with a value.",
+	},
+	[]string{"peer", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(peerRequests)
+}
+
+// registerGroupcacheMetrics exports the statistics of g's group.
+func registerGroupcacheMetrics(g *besticon.Groupcache) {
+	stats := &g.Group().Stats
+	for name, v := range map[string]*groupcache.AtomicInt{
+		"gets":            &stats.Gets,
+		"cache_hits":      &stats.CacheHits,
+		"peer_loads":      &stats.PeerLoads,
+		"peer_errors":     &stats.PeerErrors,
+		"loads":           &stats.Loads,
+		"local_loads":     &stats.LocalLoads,
+		"local_load_errs": &stats.LocalLoadErrs,
+		"server_requests": &stats.ServerRequests,
+	} {
+		prometheus.MustRegister(prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "groupcache_" + name + "_total",
+				Help: "groupcache Stats." + name + " of the icons group.",
+			},
+			func() float64 { return float64(v.Get()) },
+		))
+	}
+}
+
+// peerStatsTransport counts requests to each peer.
+type peerStatsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *peerStatsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	result := "hit"
+	if err != nil || res.StatusCode != http.StatusOK {
+		result = "miss"
+	}
+	peerRequests.WithLabelValues(req.URL.Host, result).Inc()
+	return res, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParsePeersFile(t *testing.T) {
+	peers := parsePeersFile([]byte("# replicas\nhttp://10.0.0.1:9090\n\n  http://10.0.0.2:9090  \n"))
+	assertStringEquals(t, "http://10.0.0.1:9090,http://10.0.0.2:9090", strings.Join(peers, ","))
+}
+
+func TestPeerStatsTransport(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			http.Error(w, "no", http.StatusInternalServerError)
+		}
+	}))
+	defer peer.Close()
+	host := strings.TrimPrefix(peer.URL, "http://")
+
+	transport := &peerStatsTransport{next: http.DefaultTransport}
+	for _, path := range []string{"/_groupcache/icons/a", "/_groupcache/icons/b", "/_groupcache/icons/missing"} {
+		req, _ := http.NewRequest("GET", peer.URL+path, nil)
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	assertStringEquals(t, "2", fmt.Sprint(testutil.ToFloat64(peerRequests.WithLabelValues(host, "hit"))))
+	assertStringEquals(t, "1", fmt.Sprint(testutil.ToFloat64(peerRequests.WithLabelValues(host, "miss"))))
+}
+
+func TestPeerAddressFromEnv(t *testing.T) {
+	addr, err := peerAddressFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringEquals(t, "127.0.0.1:9090", addr)
+
+	t.Setenv("GROUPCACHE_PEERS", "http://10.0.0.1:9090,http://10.0.0.2:9090")
+	_, err = peerAddressFromEnv()
+	assertStringEquals(t, "GROUPCACHE_ADDRESS must be set with GROUPCACHE_PEERS or GROUPCACHE_PEERS_FILE", fmt.Sprint(err))
+
+	t.Setenv("GROUPCACHE_ADDRESS", "10.0.0.1:9090")
+	addr, err = peerAddressFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringEquals(t, "10.0.0.1:9090", addr)
+}
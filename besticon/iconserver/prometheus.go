@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"time"
+
+	"github.com/mat/besticon/v3/besticon"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -27,3 +33,133 @@ func init() {
 	)
 	prometheus.MustRegister(duration)
 }
+
+var (
+	upstreamRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "besticon_upstream_requests_total",
+			Help: "Requests to sites for their pages and icons by status class, error if there was no response.",
+		},
+		[]string{"status_class"},
+	)
+	upstreamDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "besticon_upstream_request_duration_seconds",
+			Help:    "Time until the response headers of requests to sites arrived.",
+			Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"status_class"},
+	)
+	upstreamBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "besticon_upstream_downloaded_bytes_total",
+		Help: "Bytes of response bodies read from sites.",
+	})
+	iconsFound = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "besticon_icons_found",
+		Help:    "Icons found per lookup of a site, cache hits are not lookups.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50},
+	})
+	iconResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "besticon_icon_results_total",
+			Help: "Responses of /icon by outcome: icon, fallback_icon_url or lettericon.",
+		},
+		[]string{"outcome"},
+	)
+	lettericonDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "lettericon_render_duration_seconds",
+			Help:    "Time to render letter icons by format.",
+			Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25},
+		},
+		[]string{"format"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamRequests, upstreamDuration, upstreamBytes, iconsFound, iconResults, lettericonDuration)
+}
+
+// Outcomes for besticon_icon_results_total.
+const (
+	outcomeIcon            = "icon"
+	outcomeFallbackIconURL = "fallback_icon_url"
+	outcomeLettericon      = "lettericon"
+)
+
+// observeLookup is a besticon lookup observer recording the icons found.
+func observeLookup(siteURL string, icons []besticon.Icon, err error) {
+	iconsFound.Observe(float64(len(icons)))
+}
+
+// timeLettericon records how long render took to render a letter icon in
+// format, also in a span.
+func timeLettericon(ctx context.Context, format string, render func() error) error {
+	start := time.Now()
+	err := traceLettericon(ctx, format, render)
+	lettericonDuration.WithLabelValues(format).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// metricsTransport records the requests made to sites.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+
+	statusClass := "error"
+	if err == nil {
+		statusClass = fmt.Sprintf("%dxx", res.StatusCode/100)
+		res.Body = &countingReader{ReadCloser: res.Body}
+	}
+	upstreamRequests.WithLabelValues(statusClass).Inc()
+	upstreamDuration.WithLabelValues(statusClass).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+type countingReader struct {
+	io.ReadCloser
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	upstreamBytes.Add(float64(n))
+	return n, err
+}
+
+// cacheCollector exports the statistics of a besticon cache, see
+// Besticon.GetCacheStats.
+type cacheCollector struct {
+	b *besticon.Besticon
+}
+
+var (
+	cacheGetsDesc      = prometheus.NewDesc("besticon_cache_gets_total", "Lookups of sites in the cache.", nil, nil)
+	cacheHitsDesc      = prometheus.NewDesc("besticon_cache_hits_total", "Lookups of sites answered by the cache.", nil, nil)
+	cacheMissesDesc    = prometheus.NewDesc("besticon_cache_misses_total", "Lookups of sites not in the cache.", nil, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("besticon_cache_evictions_total", "Results evicted from the cache to make room.", nil, nil)
+	cacheBytesDesc     = prometheus.NewDesc("besticon_cache_bytes", "Size of the results in the cache.", nil, nil)
+	cacheItemsDesc     = prometheus.NewDesc("besticon_cache_items", "Number of results in the cache.", nil, nil)
+)
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheGetsDesc
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheBytesDesc
+	ch <- cacheItemsDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.b.GetCacheStats()
+	ch <- prometheus.MustNewConstMetric(cacheGetsDesc, prometheus.CounterValue, float64(stats.Gets))
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Gets-stats.Hits))
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheBytesDesc, prometheus.GaugeValue, float64(stats.Bytes))
+	ch <- prometheus.MustNewConstMetric(cacheItemsDesc, prometheus.GaugeValue, float64(stats.Items))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mat/besticon/v3/besticon"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMetricsTransport(t *testing.T) {
+	transport := &metricsTransport{next: respondWith(map[string]string{"/": "hello"})}
+	ok := testutil.ToFloat64(upstreamRequests.WithLabelValues("2xx"))
+	notFound := testutil.ToFloat64(upstreamRequests.WithLabelValues("4xx"))
+	downloaded := testutil.ToFloat64(upstreamBytes)
+
+	for _, path := range []string{"/", "/missing"} {
+		req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		res, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	assertStringEquals(t, fmt.Sprint(ok+1), fmt.Sprint(testutil.ToFloat64(upstreamRequests.WithLabelValues("2xx"))))
+	assertStringEquals(t, fmt.Sprint(notFound+1), fmt.Sprint(testutil.ToFloat64(upstreamRequests.WithLabelValues("4xx"))))
+	assertStringEquals(t, fmt.Sprint(downloaded+5), fmt.Sprint(testutil.ToFloat64(upstreamBytes)))
+}
+
+func TestCacheCollector(t *testing.T) {
+	cache := besticon.NewMemoryCache(1 << 20)
+	s := newAdminTestServer(t, new(atomic.Int32), cache)
+	s.newIconFinder().FetchIcons("93.184.215.14")
+	s.newIconFinder().FetchIcons("93.184.215.14")
+
+	err := testutil.CollectAndCompare(&cacheCollector{b: s.besticon}, strings.NewReader(`
+# HELP besticon_cache_gets_total Lookups of sites in the cache.
+# TYPE besticon_cache_gets_total counter
+besticon_cache_gets_total 2
+# HELP besticon_cache_hits_total Lookups of sites answered by the cache.
+# TYPE besticon_cache_hits_total counter
+besticon_cache_hits_total 1
+# HELP besticon_cache_misses_total Lookups of sites not in the cache.
+# TYPE besticon_cache_misses_total counter
+besticon_cache_misses_total 1
+# HELP besticon_cache_items Number of results in the cache.
+# TYPE besticon_cache_items gauge
+besticon_cache_items 1
+`), "besticon_cache_gets_total", "besticon_cache_hits_total", "besticon_cache_misses_total", "besticon_cache_items")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIconResultsByOutcome(t *testing.T) {
+	s := newTestServerWithResponses(map[string]string{"/": `<html><head></head></html>`})
+	fallback := testutil.ToFloat64(iconResults.WithLabelValues(outcomeFallbackIconURL))
+	letter := testutil.ToFloat64(iconResults.WithLabelValues(outcomeLettericon))
+
+	for _, query := range []string{"&fallback_icon_url=http://example.com/icon.png", ""} {
+		req := httptest.NewRequest("GET", "/icon?url=93.184.215.14&size=32"+query, nil)
+		s.iconHandler(httptest.NewRecorder(), req)
+	}
+
+	assertStringEquals(t, fmt.Sprint(fallback+1), fmt.Sprint(testutil.ToFloat64(iconResults.WithLabelValues(outcomeFallbackIconURL))))
+	assertStringEquals(t, fmt.Sprint(letter+1), fmt.Sprint(testutil.ToFloat64(iconResults.WithLabelValues(outcomeLettericon))))
+}
+
+// slowWriteDelay is how long a slowWriter takes per write, well above what
+// rendering takes even with the race detector.
+const slowWriteDelay = time.Second
+
+// slowWriter is a client on a slow connection.
+type slowWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(slowWriteDelay)
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestLettericonDurationExcludesWriting(t *testing.T) {
+	sum := func() float64 {
+		var m dto.Metric
+		if err := lettericonDuration.WithLabelValues("png").(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleSum()
+	}
+	before := sum()
+
+	w := slowWriter{httptest.NewRecorder()}
+	newTestServer().lettericonHandler(w, httptest.NewRequest("GET", "/lettericons/M-144-EFC25D.png", nil))
+	assertStringEquals(t, "200", fmt.Sprint(w.Code))
+	assertStringEquals(t, imagePNG, w.Header().Get(contentType))
+
+	if rendered := sum() - before; rendered >= slowWriteDelay.Seconds() {
+		t.Errorf("render took %fs, including writing the response", rendered)
+	}
+}
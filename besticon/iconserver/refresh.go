@@ -0,0 +1,203 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mat/besticon/v3/besticon"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxTrackedSites bounds the memory used to count requests. Sites requested
+// for the first time are ignored while that many are tracked.
+const maxTrackedSites = 100_000
+
+// refresher looks up the most requested sites again shortly before their
+// cached results expire, so that their users never wait for a lookup.
+//
+// Every interval it picks the topN sites by request count and refreshes the
+// ones expiring within the next lead, then halves all counts so that they
+// follow recent traffic.
+type refresher struct {
+	finder   func() *besticon.IconFinder
+	topN     int
+	lead     time.Duration
+	interval time.Duration
+	workers  int
+	now      func() time.Time
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// refresherFromEnv returns the refresher configured by REFRESH_TOP_N and
+// friends, nil if it's disabled.
+func refresherFromEnv(finder func() *besticon.IconFinder) (*refresher, error) {
+	topN, err := strconv.Atoi(getenvOrFallback("REFRESH_TOP_N", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("bad REFRESH_TOP_N: %w", err)
+	}
+	if topN <= 0 {
+		return nil, nil
+	}
+	lead, err := durationFromEnv("REFRESH_BEFORE_EXPIRY", "10m")
+	if err != nil {
+		return nil, err
+	}
+	interval, err := durationFromEnv("REFRESH_INTERVAL", "1m")
+	if err != nil {
+		return nil, err
+	}
+	workers, err := strconv.Atoi(getenvOrFallback("REFRESH_WORKERS", "4"))
+	if err != nil || workers <= 0 {
+		return nil, fmt.Errorf("bad REFRESH_WORKERS %q", getenvOrFallback("REFRESH_WORKERS", "4"))
+	}
+	return newRefresher(finder, topN, lead, interval, workers), nil
+}
+
+func newRefresher(finder func() *besticon.IconFinder, topN int, lead time.Duration, interval time.Duration, workers int) *refresher {
+	return &refresher{
+		finder:   finder,
+		topN:     topN,
+		lead:     lead,
+		interval: interval,
+		workers:  workers,
+		now:      time.Now,
+		counts:   map[string]int{},
+	}
+}
+
+// record counts a request for url. It does nothing on a nil refresher.
+func (r *refresher) record(url string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.counts[url]; ok || len(r.counts) < maxTrackedSites {
+		r.counts[url]++
+	}
+	refreshTrackedSites.Set(float64(len(r.counts)))
+}
+
+func (r *refresher) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.refresh(ctx)
+		}
+	}
+}
+
+// refresh refreshes the popular sites that are about to expire and waits
+// for it to finish.
+func (r *refresher) refresh(ctx context.Context) {
+	start := time.Now()
+	due := r.due(ctx, r.popular())
+
+	urls := make(chan string)
+	var wg sync.WaitGroup
+	for range min(r.workers, len(due)) {
+		wg.Go(func() {
+			for url := range urls {
+				err := r.finder().RefreshCache(ctx, url)
+				if err != nil {
+					logger.ErrorContext(ctx, "cannot refresh", "url", url, "error", err)
+					refreshes.WithLabelValues("failed").Inc()
+					continue
+				}
+				refreshes.WithLabelValues("refreshed").Inc()
+			}
+		})
+	}
+	for _, url := range due {
+		urls <- url
+	}
+	close(urls)
+	wg.Wait()
+
+	refreshDuration.Observe(time.Since(start).Seconds())
+}
+
+// popular returns the topN most requested sites and decays the counts.
+func (r *refresher) popular() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	urls := make([]string, 0, len(r.counts))
+	for url := range r.counts {
+		urls = append(urls, url)
+	}
+	slices.SortFunc(urls, func(a, b string) int {
+		return cmp.Or(cmp.Compare(r.counts[b], r.counts[a]), cmp.Compare(a, b))
+	})
+	urls = urls[:min(r.topN, len(urls))]
+
+	for url, n := range r.counts {
+		if n/2 == 0 {
+			delete(r.counts, url)
+		} else {
+			r.counts[url] = n / 2
+		}
+	}
+	refreshTrackedSites.Set(float64(len(r.counts)))
+	return urls
+}
+
+// due returns the urls whose cached results expire within the lead time.
+// Sites that are not cached at all are left to the next request, as are
+// failed lookups and sites without icons: their short negative TTL would
+// have them looked up again on every round.
+func (r *refresher) due(ctx context.Context, urls []string) []string {
+	var due []string
+	deadline := r.now().Add(r.lead)
+	for _, url := range urls {
+		entry, err := r.finder().CachedIcons(ctx, url)
+		switch {
+		case errors.Is(err, besticon.ErrCacheMiss):
+			refreshes.WithLabelValues("not_cached").Inc()
+		case err != nil:
+			logger.ErrorContext(ctx, "cannot check for refresh", "url", url, "error", err)
+		case entry.Error != nil || len(entry.Icons) == 0:
+			refreshes.WithLabelValues("not_found").Inc()
+		case entry.Expires.Before(deadline):
+			due = append(due, url)
+		}
+	}
+	return due
+}
+
+var (
+	refreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "refresh_sites_total",
+			Help: "Popular sites checked by the refresh worker by result: refreshed, failed, not_cached or not_found.",
+		},
+		[]string{"result"},
+	)
+	refreshTrackedSites = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "refresh_tracked_sites",
+		Help: "Number of sites whose requests are counted by the refresh worker.",
+	})
+	refreshDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "refresh_duration_seconds",
+		Help:    "How long a round of the refresh worker took.",
+		Buckets: []float64{.25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(refreshes, refreshTrackedSites, refreshDuration)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mat/besticon/v3/besticon"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRefresherPopular(t *testing.T) {
+	r := newRefresher(nil, 2, time.Minute, time.Minute, 1)
+	for _, url := range []string{"a.com", "b.com", "b.com", "c.com", "c.com", "c.com"} {
+		r.record(url)
+	}
+
+	assertStringEquals(t, "c.com b.com", strings.Join(r.popular(), " "))
+
+	// counts are halved, a.com is forgotten
+	assertStringEquals(t, "b.com c.com", strings.Join(r.popular(), " "))
+	assertStringEquals(t, "", strings.Join(r.popular(), " "))
+}
+
+func TestRefresherRefreshesBeforeExpiry(t *testing.T) {
+	var lookups atomic.Int32
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s := newAdminTestServer(t, &lookups, besticon.NewMemoryCache(1<<20),
+		besticon.WithCacheTTL(time.Hour),
+		besticon.WithClock(clock),
+	)
+	r := newRefresher(s.newIconFinder, 10, 10*time.Minute, time.Minute, 2)
+	r.now = clock
+
+	r.record("93.184.215.14")
+	r.record("93.184.215.14")
+	r.record("uncached.example.com")
+	s.newIconFinder().FetchIcons("93.184.215.14")
+	refreshed := testutil.ToFloat64(refreshes.WithLabelValues("refreshed"))
+
+	// not due yet
+	r.refresh(context.Background())
+	assertStringEquals(t, "1", fmt.Sprint(lookups.Load()))
+
+	now = now.Add(55 * time.Minute)
+	r.refresh(context.Background())
+	assertStringEquals(t, "2", fmt.Sprint(lookups.Load()))
+	assertStringEquals(t, fmt.Sprint(refreshed+1), fmt.Sprint(testutil.ToFloat64(refreshes.WithLabelValues("refreshed"))))
+
+	// the refreshed result is served without another lookup
+	now = now.Add(10 * time.Minute)
+	s.newIconFinder().FetchIcons("93.184.215.14")
+	assertStringEquals(t, "2", fmt.Sprint(lookups.Load()))
+}
+
+func TestRefresherSkipsFailedLookups(t *testing.T) {
+	var lookups atomic.Int32
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s := newTestServerWithTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		lookups.Add(1)
+		return nil, errors.New("connection refused")
+	}),
+		besticon.WithCacheBackend(besticon.NewMemoryCache(1<<20)),
+		besticon.WithNegativeCacheTTL(10*time.Minute),
+		besticon.WithClock(clock),
+	)
+	r := newRefresher(s.newIconFinder, 10, 10*time.Minute, time.Minute, 2)
+	r.now = clock
+
+	r.record("93.184.215.14")
+	s.newIconFinder().FetchIcons("93.184.215.14")
+	looked := lookups.Load()
+	notFound := testutil.ToFloat64(refreshes.WithLabelValues("not_found"))
+
+	now = now.Add(time.Minute)
+	r.record("93.184.215.14")
+	r.refresh(context.Background())
+	assertStringEquals(t, fmt.Sprint(looked), fmt.Sprint(lookups.Load()))
+	assertStringEquals(t, fmt.Sprint(notFound+1), fmt.Sprint(testutil.ToFloat64(refreshes.WithLabelValues("not_found"))))
+}
+
+func TestRecordOnNilRefresher(t *testing.T) {
+	var r *refresher
+	r.record("example.com")
+}
+
+func TestRefresherFromEnv(t *testing.T) {
+	r, err := refresherFromEnv(nil)
+	if r != nil || err != nil {
+		t.Errorf("expected no refresher by default, got %v, %v", r, err)
+	}
+
+	t.Setenv("REFRESH_TOP_N", "100")
+	t.Setenv("REFRESH_WORKERS", "0")
+	if _, err := refresherFromEnv(nil); err == nil {
+		t.Error("expected an error for REFRESH_WORKERS=0")
+	}
+
+	t.Setenv("REFRESH_WORKERS", "2")
+	r, err = refresherFromEnv(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStringEquals(t, "100 10m0s 1m0s 2", fmt.Sprint(r.topN, r.lead, r.interval, r.workers))
+}
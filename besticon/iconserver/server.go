@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"image"
 	"io"
 	"io/fs"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -23,6 +27,7 @@ import (
 	"github.com/mat/besticon/v3/besticon/iconserver/assets"
 	"github.com/mat/besticon/v3/lettericon"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 )
@@ -33,7 +38,9 @@ type server struct {
 	demoSites       []string
 	hostOnlyDomains []string
 
-	besticon *besticon.Besticon
+	besticon   *besticon.Besticon
+	imageStore besticon.ImageStore
+	refresher  *refresher
 }
 
 func (s *server) indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -59,6 +66,7 @@ func (s *server) iconsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.refresher.record(url)
 	finder := s.newIconFinder()
 
 	formats := r.FormValue("formats")
@@ -66,7 +74,7 @@ func (s *server) iconsHandler(w http.ResponseWriter, r *http.Request) {
 		finder.FormatsAllowed = strings.Split(r.FormValue("formats"), ",")
 	}
 
-	icons, e := finder.FetchIcons(url)
+	icons, e := finder.FetchIconsContext(r.Context(), url)
 	switch {
 	case e != nil:
 		renderHTMLTemplate(w, 404, templateFromAsset("icons.html", "icons.html"), pageInfo{URL: url, Error: e, DemoSites: s.demoSites})
@@ -96,27 +104,64 @@ func (s *server) iconHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	output, err := parseOutputOptions(r)
+	if err != nil {
+		writeAPIError(w, 400, err)
+		return
+	}
+
+	s.refresher.record(url)
 	finder := s.newIconFinder()
 	formats := r.FormValue("formats")
 	if formats != "" {
 		finder.FormatsAllowed = strings.Split(r.FormValue("formats"), ",")
 	}
 
-	finder.FetchIcons(url)
+	finder.FetchIconsContext(r.Context(), url)
+	if r.Context().Err() != nil {
+		// Client is gone, nobody is waiting for an icon anymore.
+		return
+	}
 
 	icon := finder.IconInSizeRange(*sizeRange)
 	if icon != nil {
-		s.returnIcon(w, r, icon.URL)
+		iconResults.WithLabelValues(outcomeIcon).Inc()
+		if output.enabled() {
+			s.transcodeAndReturn(w, r, icon, sizeRange.Perfect, output)
+			return
+		}
+		s.returnIcon(w, r, icon)
+		return
+	}
+
+	// Clients asking for e.g. png,ico would lose SVG-only sites' icons,
+	// render them for them instead.
+	rasterized, err := finder.RasterizedIconInSizeRange(*sizeRange)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "cannot rasterize svg", "error", err)
+	}
+	if rasterized != nil {
+		iconResults.WithLabelValues(outcomeIcon).Inc()
+		if output.enabled() {
+			s.transcodeAndReturn(w, r, rasterized, sizeRange.Perfect, output)
+			return
+		}
+		s.writeIcon(w, r, rasterized.ImageData, rasterized.Format, rasterized.Sha1sum)
 		return
 	}
 
 	fallbackIconURL := r.FormValue("fallback_icon_url")
 	if fallbackIconURL != "" {
-		s.returnIcon(w, r, fallbackIconURL)
+		iconResults.WithLabelValues(outcomeFallbackIconURL).Inc()
+		s.returnIcon(w, r, &besticon.Icon{URL: fallbackIconURL})
 		return
 	}
 
 	iconColor := finder.MainColorForIcons()
+	if iconColor == nil {
+		iconColor = finder.TileColor()
+	}
+	iconResults.WithLabelValues(outcomeLettericon).Inc()
 	letter := lettericon.MainLetterFromURL(url)
 
 	fallbackColorHex := r.FormValue("fallback_icon_color")
@@ -127,6 +172,11 @@ func (s *server) iconHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if output.format != "" && output.format != "png" {
+		s.letterIconAndReturn(w, r, letter, iconColor, sizeRange.Perfect, output)
+		return
+	}
+
 	// We support both PNG and SVG fallback. Only return SVG if requested.
 	format := "png"
 	if includesString(finder.FormatsAllowed, "svg") {
@@ -152,20 +202,26 @@ func (s *server) alliconsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.refresher.record(url)
 	finder := s.newIconFinder()
 	formats := r.FormValue("formats")
 	if formats != "" {
 		finder.FormatsAllowed = strings.Split(r.FormValue("formats"), ",")
 	}
 
-	icons, e := finder.FetchIcons(url)
+	icons, e := finder.FetchIconsContext(r.Context(), url)
 	if e != nil {
 		writeAPIError(w, 404, e)
 		return
 	}
 
+	apiIcons := make([]apiIcon, len(icons))
+	for i, icon := range icons {
+		apiIcons[i] = apiIcon{Icon: icon, ImageURL: s.imageURL(r, icon)}
+	}
+
 	addCacheControl(w, s.cacheDuration)
-	writeAPIIcons(w, url, icons)
+	writeAPIIcons(w, url, apiIcons)
 }
 
 func (s *server) lettericonHandler(w http.ResponseWriter, r *http.Request) {
@@ -175,29 +231,56 @@ func (s *server) lettericonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	addCacheControl(w, oneYear)
+	// Render into a buffer so the render time doesn't include sending the
+	// icon to the client.
+	var buf bytes.Buffer
+	var err error
+	if format == "svg" {
+		err = timeLettericon(r.Context(), "svg", func() error { return lettericon.RenderSVG(charParam, col, &buf) })
+	} else {
+		err = timeLettericon(r.Context(), "png", func() error { return lettericon.RenderPNG(charParam, col, size, &buf) })
+	}
+	if err != nil {
+		writeAPIError(w, 500, err)
+		return
+	}
 
+	addCacheControl(w, oneYear)
 	if format == "svg" {
 		w.Header().Add(contentType, imageSVG)
-		lettericon.RenderSVG(charParam, col, w)
 	} else {
 		w.Header().Add(contentType, imagePNG)
-		lettericon.RenderPNG(charParam, col, size, w)
 	}
+	w.Write(buf.Bytes())
 }
 
 func writeAPIError(w http.ResponseWriter, httpStatus int, e error) {
 	data := struct {
 		Error string `json:"error"`
+		Code  string `json:"code"`
 	}{
 		e.Error(),
+		apiErrorCode(httpStatus, e),
 	}
 	renderJSONResponse(w, httpStatus, data)
 }
 
-func writeAPIIcons(w http.ResponseWriter, url string, icons []besticon.Icon) {
+const codeBadRequest = "bad_request"
+
+// apiErrorCode returns the machine readable code for e. Errors from the
+// besticon package have their own codes, anything else we reject is the
+// client's fault.
+func apiErrorCode(httpStatus int, e error) string {
+	code := besticon.ErrorCode(e)
+	if code == besticon.CodeUnknown && httpStatus == http.StatusBadRequest {
+		return codeBadRequest
+	}
+	return code
+}
+
+func writeAPIIcons(w http.ResponseWriter, url string, icons []apiIcon) {
 	// Don't return whole image data
-	newIcons := []besticon.Icon{}
+	newIcons := []apiIcon{}
 	for _, ico := range icons {
 		newIcon := ico
 		newIcon.ImageData = nil
@@ -205,8 +288,8 @@ func writeAPIIcons(w http.ResponseWriter, url string, icons []besticon.Icon) {
 	}
 
 	data := &struct {
-		URL   string          `json:"url"`
-		Icons []besticon.Icon `json:"icons"`
+		URL   string    `json:"url"`
+		Icons []apiIcon `json:"icons"`
 	}{
 		url,
 		newIcons,
@@ -219,6 +302,12 @@ const (
 	applicationJSON = "application/json"
 	imagePNG        = "image/png"
 	imageSVG        = "image/svg+xml"
+	imageJPEG       = "image/jpeg"
+	imageGIF        = "image/gif"
+	imageICO        = "image/x-icon"
+
+	contentSecurityPolicy    = "Content-Security-Policy"
+	svgContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src data:"
 )
 
 func renderJSONResponse(w http.ResponseWriter, httpStatus int, data any) {
@@ -278,22 +367,40 @@ func renderHTMLTemplate(w http.ResponseWriter, httpStatus int, templ *template.T
 
 	err := templ.Execute(w, data)
 	if err != nil {
-		err = fmt.Errorf("server: could not generate output: %s", err)
-		logger.Print(err)
-		w.Write([]byte(err.Error()))
+		logger.Error("could not generate output", "error", err)
+		fmt.Fprintf(w, "server: could not generate output: %s", err)
 	}
 }
 
 func startServer(port string, address string) {
-	var opts []besticon.Option
+	var err error
+	logger, err = loggerFromEnv(os.Stdout)
+	if err != nil {
+		panic(err)
+	}
+	opts := []besticon.Option{besticon.WithSlogLogger(logger)}
 
-	cacheSize := os.Getenv("CACHE_SIZE_MB")
-	if cacheSize == "" {
-		opts = append(opts, besticon.WithCache(32))
-	} else {
-		n, _ := strconv.Atoi(cacheSize)
-		opts = append(opts, besticon.WithCache(int64(n)))
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		panic(err)
 	}
+	defer shutdownTracing(context.Background())
+
+	cache, err := cacheFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	opts = append(opts, besticon.WithCacheBackend(cache))
+	if g, ok := cache.(*besticon.Groupcache); ok {
+		registerGroupcacheMetrics(g)
+	}
+	startPeering(cache)
+
+	ttlOpts, err := cacheTTLsFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	opts = append(opts, ttlOpts...)
 
 	cacheDuration, err := time.ParseDuration(getenvOrFallback("HTTP_MAX_AGE_DURATION", "720h"))
 	if err != nil {
@@ -305,10 +412,38 @@ func startServer(port string, address string) {
 		panic(err)
 	}
 
+	addressPolicy, err := addressPolicyFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	opts = append(opts, besticon.WithAddressPolicy(addressPolicy))
+
+	proxy, err := proxyFromEnv()
+	if err != nil {
+		panic(err)
+	}
+
+	timeouts, err := timeoutsFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	opts = append(opts, besticon.WithTimeouts(timeouts))
+
 	httpClient := besticon.NewDefaultHTTPClient()
-	httpClient.Transport = besticon.NewDefaultHTTPTransport(getenvOrFallback("HTTP_USER_AGENT", "Mozilla/5.0 (iPhone; CPU iPhone OS 10_0 like Mac OS X) AppleWebKit/602.1.38 (KHTML, like Gecko) Version/10.0 Mobile/14A5297c Safari/602.1"))
+	httpClient.Transport = besticon.NewHTTPTransport(getenvOrFallback("HTTP_USER_AGENT", "Mozilla/5.0 (iPhone; CPU iPhone OS 10_0 like Mac OS X) AppleWebKit/602.1.38 (KHTML, like Gecko) Version/10.0 Mobile/14A5297c Safari/602.1"), addressPolicy, proxy, timeouts)
+
+	httpClient.Transport = &metricsTransport{next: httpClient.Transport}
+
+	opts = append(opts, besticon.WithHTTPClient(httpClient), besticon.WithLookupObserver(observeLookup))
+	opts = append(opts, besticon.WithCookies(!getTrueFromEnv("DISABLE_COOKIES")))
 
-	opts = append(opts, besticon.WithHTTPClient(httpClient))
+	imageStore, err := imageStoreFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	if imageStore != nil {
+		opts = append(opts, besticon.WithImageStore(imageStore))
+	}
 
 	s := &server{
 		maxIconSize:     maxIconSize,
@@ -316,13 +451,29 @@ func startServer(port string, address string) {
 		demoSites:       normalizedHostListFromEnv("DEMO_SITES"),
 		hostOnlyDomains: strings.Split(os.Getenv("HOST_ONLY_DOMAINS"), ","),
 
-		besticon: besticon.New(opts...),
+		besticon:   besticon.New(opts...),
+		imageStore: imageStore,
+	}
+	prometheus.MustRegister(&cacheCollector{b: s.besticon})
+
+	s.refresher, err = refresherFromEnv(s.newIconFinder)
+	if err != nil {
+		panic(err)
+	}
+	if _, ok := cache.(besticon.LoadingCache); s.refresher != nil && (ok || cache == nil) {
+		logger.Warn("refresh worker disabled, REFRESH_TOP_N needs CACHE_BACKEND=memory or disk")
+		s.refresher = nil
+	}
+	if s.refresher != nil {
+		go s.refresher.run(context.Background())
 	}
 
 	registerHandler("/icon", s.iconHandler)
+	registerHandler(imagePathPrefix, s.imageHandler)
 	registerHandler("/allicons.json", s.alliconsHandler)
 	registerHandler("/lettericons/", s.lettericonHandler)
 	registerHandler("/up", s.upHandler)
+	s.registerAdminHandlers(os.Getenv("ADMIN_TOKEN"))
 
 	disableBrowsePages := getTrueFromEnv("DISABLE_BROWSE_PAGES")
 
@@ -342,27 +493,27 @@ func startServer(port string, address string) {
 
 	if metricsPath != "disable" {
 		if !strings.HasPrefix(metricsPath, "/") {
-			logger.Fatalf("METRICS_PATH must start with a slash")
+			fatal("METRICS_PATH must start with a slash")
 		}
 
 		http.Handle(metricsPath, promhttp.Handler())
 	}
 
 	addr := address + ":" + port
-	logger.Print("Starting server on ", addr, "...")
+	logger.Info("starting server", "address", addr)
 	err = http.ListenAndServe(addr, httpHandler())
 	if err != nil {
-		logger.Fatalf("cannot start server: %s\n", err)
+		fatal("cannot start server", "error", err)
 	}
 }
 
 func httpHandler() http.Handler {
 	corsEnabled := getTrueFromEnv("CORS_ENABLED")
 	if corsEnabled {
-		logger.Print("Enabling CORS middleware")
-		return corsHandler(newLoggingMux())
+		logger.Info("enabling CORS middleware")
+		return corsHandler(newLoggingMux(http.DefaultServeMux))
 	} else {
-		return newLoggingMux()
+		return newLoggingMux(http.DefaultServeMux)
 	}
 }
 
@@ -383,29 +534,109 @@ const (
 	oneYear      = 365 * 24 * time.Hour
 )
 
-func (s *server) returnIcon(w http.ResponseWriter, r *http.Request, iconURL string) {
+func (s *server) returnIcon(w http.ResponseWriter, r *http.Request, icon *besticon.Icon) {
 	if os.Getenv("SERVER_MODE") == "download" {
-		s.downloadAndReturn(w, r, iconURL)
+		s.downloadAndReturn(w, r, icon)
 	} else {
-		s.redirectWithCacheControl(w, r, iconURL)
+		s.redirectWithCacheControl(w, r, icon.URL)
 	}
 }
 
-func (s *server) downloadAndReturn(w http.ResponseWriter, r *http.Request, iconURL string) {
-	response, err := s.besticon.Get(iconURL)
+// downloadAndReturn serves the icon's bytes. The finder usually has them
+// already, we only go to the network when it does not.
+func (s *server) downloadAndReturn(w http.ResponseWriter, r *http.Request, icon *besticon.Icon) {
+	if icon.ImageData != nil {
+		s.writeIcon(w, r, icon.ImageData, icon.Format, icon.Sha1sum)
+		return
+	}
+	if s.imageStore != nil && icon.Sha1sum != "" {
+		if data, err := s.imageStore.Get(r.Context(), icon.Sha1sum); err == nil {
+			s.writeIcon(w, r, data, icon.Format, icon.Sha1sum)
+			return
+		}
+	}
+
+	response, err := s.besticon.GetContext(r.Context(), icon.URL)
 	if err != nil {
-		s.redirectWithCacheControl(w, r, iconURL)
+		s.redirectWithCacheControl(w, r, icon.URL)
 		return
 	}
 
 	b, err := s.besticon.GetBodyBytes(response)
 	if err != nil {
-		s.redirectWithCacheControl(w, r, iconURL)
+		s.redirectWithCacheControl(w, r, icon.URL)
 		return
 	}
 
+	format := ""
+	if besticon.IsSVG(b) {
+		// We serve it from our origin, so it must not be able to run scripts
+		// or pull in anything else.
+		b, err = besticon.SanitizeSVG(b)
+		if err != nil {
+			s.redirectWithCacheControl(w, r, icon.URL)
+			return
+		}
+		format = "svg"
+	} else {
+		format = imageFormat(b)
+	}
+
+	s.writeIcon(w, r, b, format, fmt.Sprintf("%x", sha1.Sum(b)))
+}
+
+// imageFormat returns the format of data as named by image.DecodeConfig,
+// "svg" for SVG and "" if it's not an image.
+func imageFormat(data []byte) string {
+	if besticon.IsSVG(data) {
+		return "svg"
+	}
+	_, format, _ := image.DecodeConfig(bytes.NewReader(data))
+	return format
+}
+
+// Content types of the formats besticon detects.
+var formatContentTypes = map[string]string{
+	"bmp":  "image/bmp",
+	"gif":  imageGIF,
+	"ico":  imageICO,
+	"jpeg": imageJPEG,
+	"jpg":  imageJPEG,
+	"png":  imagePNG,
+	"svg":  imageSVG,
+	"webp": "image/webp",
+}
+
+// writeIcon serves data, an image in the given format, with sha1sum as its
+// ETag.
+func (s *server) writeIcon(w http.ResponseWriter, r *http.Request, data []byte, format string, sha1sum string) {
 	addCacheControl(w, s.cacheDuration)
-	w.Write(b)
+	etag := `"` + sha1sum + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if t, ok := formatContentTypes[format]; ok {
+		w.Header().Set(contentType, t)
+	}
+	if format == "svg" {
+		w.Header().Set(contentSecurityPolicy, svgContentSecurityPolicy)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *server) redirectWithCacheControl(w http.ResponseWriter, r *http.Request, redirectURL string) {
@@ -442,7 +673,7 @@ func serveAsset(path string, assetPath string, maxAge time.Duration) {
 }
 
 func registerHandler(path string, f http.HandlerFunc) {
-	http.Handle(path, newPrometheusHandler(path, f))
+	http.Handle(path, newTracingHandler(path, newPrometheusHandler(path, f)))
 }
 
 // /up is a simple health check endpoint (used by kamal deploy)
@@ -522,6 +753,160 @@ func (s *server) newIconFinder() *besticon.IconFinder {
 	return finder
 }
 
+// cacheFromEnv returns the cache backend selected by CACHE_BACKEND.
+func cacheFromEnv() (besticon.Cache, error) {
+	sizeInMB, err := strconv.ParseInt(getenvOrFallback("CACHE_SIZE_MB", "32"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad CACHE_SIZE_MB: %w", err)
+	}
+
+	switch backend := getenvOrFallback("CACHE_BACKEND", "groupcache"); backend {
+	case "groupcache":
+		return besticon.NewGroupcache("icons", sizeInMB), nil
+	case "memory":
+		return besticon.NewMemoryCache(sizeInMB << 20), nil
+	case "disk":
+		dirSizeInMB, err := strconv.ParseInt(getenvOrFallback("CACHE_DIR_SIZE_MB", "1024"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad CACHE_DIR_SIZE_MB: %w", err)
+		}
+		return besticon.NewDiskCache(getenvOrFallback("CACHE_DIR", filepath.Join(os.TempDir(), "besticon")), dirSizeInMB<<20)
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown CACHE_BACKEND %q", backend)
+	}
+}
+
+// cacheTTLsFromEnv returns the options for CACHE_TTL, CACHE_NEGATIVE_TTL
+// and CACHE_STALE_WHILE_REVALIDATE.
+func cacheTTLsFromEnv() ([]besticon.Option, error) {
+	ttl, err := durationFromEnv("CACHE_TTL", "24h")
+	if err != nil {
+		return nil, err
+	}
+	negativeTTL, err := durationFromEnv("CACHE_NEGATIVE_TTL", "10m")
+	if err != nil {
+		return nil, err
+	}
+	staleWhileRevalidate, err := durationFromEnv("CACHE_STALE_WHILE_REVALIDATE", "1h")
+	if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("bad CACHE_TTL: %s is not positive", ttl)
+	}
+	if negativeTTL <= 0 {
+		return nil, fmt.Errorf("bad CACHE_NEGATIVE_TTL: %s is not positive", negativeTTL)
+	}
+	if staleWhileRevalidate < 0 {
+		return nil, fmt.Errorf("bad CACHE_STALE_WHILE_REVALIDATE: %s is negative", staleWhileRevalidate)
+	}
+
+	return []besticon.Option{
+		besticon.WithCacheTTL(ttl),
+		besticon.WithNegativeCacheTTL(negativeTTL),
+		besticon.WithStaleWhileRevalidate(staleWhileRevalidate),
+	}, nil
+}
+
+// timeoutsFromEnv returns the timeouts of lookups. HTTP_CLIENT_TIMEOUT is
+// the default of HTTP_PAGE_TIMEOUT and HTTP_ICON_TIMEOUT, 0 disables a
+// timeout.
+func timeoutsFromEnv() (besticon.Timeouts, error) {
+	var t besticon.Timeouts
+	requestTimeout, err := durationFromEnv("HTTP_CLIENT_TIMEOUT", "5s")
+	if err != nil {
+		return t, err
+	}
+
+	for _, d := range []struct {
+		key           string
+		fallbackValue string
+		timeout       *time.Duration
+	}{
+		{"LOOKUP_TIMEOUT", "15s", &t.Lookup},
+		{"HTTP_PAGE_TIMEOUT", requestTimeout.String(), &t.Page},
+		{"HTTP_ICON_TIMEOUT", requestTimeout.String(), &t.Icon},
+		{"HTTP_DIAL_TIMEOUT", "5s", &t.Dial},
+		{"HTTP_TLS_HANDSHAKE_TIMEOUT", "5s", &t.TLSHandshake},
+		{"HTTP_RESPONSE_HEADER_TIMEOUT", "5s", &t.ResponseHeader},
+	} {
+		if *d.timeout, err = durationFromEnv(d.key, d.fallbackValue); err != nil {
+			return t, err
+		}
+		if *d.timeout <= 0 {
+			*d.timeout = besticon.NoTimeout
+		}
+	}
+	return t, nil
+}
+
+// proxyFromEnv returns the proxy configured by PROXY_URL and NO_PROXY, nil
+// if PROXY_URL is not set.
+func proxyFromEnv() (*besticon.ProxyConfig, error) {
+	proxyURL := os.Getenv("PROXY_URL")
+	if proxyURL == "" {
+		return nil, nil
+	}
+	proxy, err := besticon.ParseProxyConfig(proxyURL, os.Getenv("NO_PROXY"))
+	if err != nil {
+		return nil, fmt.Errorf("bad PROXY_URL: %w", err)
+	}
+	return proxy, nil
+}
+
+// addressPolicyFromEnv returns the default address policy with the networks
+// in ALLOWED_NETWORKS as exceptions and those in DENIED_NETWORKS denied as
+// well. Both are comma-separated lists of CIDR prefixes or IP addresses.
+func addressPolicyFromEnv() (*besticon.AddressPolicy, error) {
+	policy := besticon.DefaultAddressPolicy()
+
+	allow, err := prefixesFromEnv("ALLOWED_NETWORKS")
+	if err != nil {
+		return nil, err
+	}
+	deny, err := prefixesFromEnv("DENIED_NETWORKS")
+	if err != nil {
+		return nil, err
+	}
+	policy.Allow = allow
+	policy.Deny = append(policy.Deny, deny...)
+	return policy, nil
+}
+
+func prefixesFromEnv(key string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range stringSliceFromEnv(key) {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s: %w", key, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s: %w", key, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func durationFromEnv(key string, fallbackValue string) (time.Duration, error) {
+	d, err := time.ParseDuration(getenvOrFallback(key, fallbackValue))
+	if err != nil {
+		return 0, fmt.Errorf("bad %s: %w", key, err)
+	}
+	return d, nil
+}
+
 func getTrueFromEnv(s string) bool {
 	return getenvOrFallback(s, "") == "true"
 }
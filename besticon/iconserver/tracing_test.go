@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mat/besticon/v3/besticon"
+
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// testCollector is an in-process OTLP/HTTP trace collector.
+type testCollector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var req coltracepb.ExportTraceServiceRequest
+	if r.URL.Path != "/v1/traces" || proto.Unmarshal(body, &req) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	out, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Write(out)
+}
+
+func TestTracingExportsViaOTLP(t *testing.T) {
+	collector := &testCollector{}
+	otlp := httptest.NewServer(collector)
+	defer otlp.Close()
+
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", otlp.URL)
+
+	shutdown, err := setupTracing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServerWithTransport(respondWith(map[string]string{"/": `<html><head></head></html>`}),
+		besticon.WithCacheBackend(besticon.NewMemoryCache(1<<20)))
+	handler := newTracingHandler("/icon", http.HandlerFunc(s.iconHandler))
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/icon?url=93.184.215.14&size=32&output=gif", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	byName := map[string]*tracepb.Span{}
+	for _, span := range collector.spans {
+		assertStringEquals(t, traceID, hex.EncodeToString(span.TraceId))
+		byName[span.Name] = span
+	}
+	for _, name := range []string{"GET /icon", "besticon.cache", "besticon.lookup", "besticon.fetchHTML", "lettericon.render"} {
+		if byName[name] == nil {
+			t.Fatalf("no span %q in %d spans", name, len(collector.spans))
+		}
+	}
+
+	root := byName["GET /icon"]
+	assertStringEquals(t, "00f067aa0ba902b7", hex.EncodeToString(root.ParentSpanId))
+	assertStringEquals(t, hex.EncodeToString(root.SpanId), hex.EncodeToString(byName["lettericon.render"].ParentSpanId))
+	for _, attr := range root.Attributes {
+		if attr.Key == "http.response.status_code" {
+			assertStringEquals(t, "200", fmt.Sprint(attr.Value.GetIntValue()))
+		}
+	}
+}
+
+func TestTracingDisabledWithoutEndpoint(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	previous := otel.GetTracerProvider()
+	shutdown, err := setupTracing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if otel.GetTracerProvider() != previous {
+		t.Error("tracer provider was replaced without an OTLP endpoint")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mat/besticon/v3/besticon"
+	"github.com/mat/besticon/v3/ico"
+	"github.com/mat/besticon/v3/lettericon"
+	"github.com/mat/besticon/v3/svgraster"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Formats /icon can convert icons to, see the output parameter.
+var outputFormats = map[string]string{
+	"png": imagePNG,
+	"jpg": imageJPEG,
+	"gif": imageGIF,
+	"ico": imageICO,
+}
+
+// outputOptions tell /icon to serve a converted icon instead of the original
+// one.
+type outputOptions struct {
+	// format to encode to, "" keeps the format of the icon if possible
+	format string
+	// exact scales the icon to exactly the perfect size
+	exact bool
+}
+
+func (o outputOptions) enabled() bool {
+	return o.format != "" || o.exact
+}
+
+var errBadOutput = errors.New("bad output parameter")
+
+func parseOutputOptions(r *http.Request) (outputOptions, error) {
+	var o outputOptions
+
+	o.format = strings.ToLower(strings.TrimSpace(r.FormValue("output")))
+	if o.format == "jpeg" {
+		o.format = "jpg"
+	}
+	if _, ok := outputFormats[o.format]; o.format != "" && !ok {
+		return o, errBadOutput
+	}
+
+	if exact := r.FormValue("exact"); exact != "" {
+		var err error
+		o.exact, err = strconv.ParseBool(exact)
+		if err != nil {
+			return o, errors.New("bad exact parameter")
+		}
+	}
+	return o, nil
+}
+
+// transcodeAndReturn serves icon converted according to o. If that fails we
+// serve the original.
+func (s *server) transcodeAndReturn(w http.ResponseWriter, r *http.Request, icon *besticon.Icon, size int, o outputOptions) {
+	data, sha1sum := icon.ImageData, icon.Sha1sum
+	if data == nil && s.imageStore != nil && sha1sum != "" {
+		data, _ = s.imageStore.Get(r.Context(), sha1sum)
+	}
+	if data == nil {
+		response, err := s.besticon.GetContext(r.Context(), icon.URL)
+		if err == nil {
+			data, err = s.besticon.GetBodyBytes(response)
+		}
+		if err != nil {
+			s.returnIcon(w, r, icon)
+			return
+		}
+		sha1sum = fmt.Sprintf("%x", sha1.Sum(data))
+	}
+
+	addCacheControl(w, s.cacheDuration)
+	etag := transcodedETag(sha1sum, size, o)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var out bytes.Buffer
+	mimeType, err := transcodeIcon(&out, data, icon.Format, size, o)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "cannot convert icon", "url", icon.URL, "error", err)
+		w.Header().Del(cacheControl)
+		w.Header().Del("ETag")
+		s.returnIcon(w, r, icon)
+		return
+	}
+
+	w.Header().Set(contentType, mimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	w.Write(out.Bytes())
+}
+
+// transcodedETag identifies the icon with the given sha1sum as converted
+// to size according to o.
+func transcodedETag(sha1sum string, size int, o outputOptions) string {
+	format := o.format
+	if format == "" {
+		format = "auto"
+	}
+	return fmt.Sprintf(`"%s-%s-%d-%t"`, sha1sum, format, size, o.exact)
+}
+
+// letterIconAndReturn serves the letter icon in a format /lettericons does
+// not support.
+func (s *server) letterIconAndReturn(w http.ResponseWriter, r *http.Request, letter string, col *color.RGBA, size int, o outputOptions) {
+	if col == nil {
+		col = lettericon.DefaultBackgroundColor
+	}
+
+	var rendered, out bytes.Buffer
+	err := timeLettericon(r.Context(), "png", func() error { return lettericon.RenderPNG(letter, col, size, &rendered) })
+	var mimeType string
+	if err == nil {
+		mimeType, err = transcodeIcon(&out, rendered.Bytes(), "png", size, o)
+	}
+	if err != nil {
+		writeAPIError(w, 500, err)
+		return
+	}
+
+	addCacheControl(w, s.cacheDuration)
+	w.Header().Set(contentType, mimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	w.Write(out.Bytes())
+}
+
+// transcodeIcon decodes data, an image in the given format, scales it to
+// size x size if o.exact and encodes it to out. It returns the content type
+// of what it wrote.
+func transcodeIcon(out io.Writer, data []byte, format string, size int, o outputOptions) (string, error) {
+	img, err := decodeIcon(data, format, size)
+	if err != nil {
+		return "", err
+	}
+	if o.exact {
+		img = resizeImage(img, size)
+	}
+
+	outFormat := o.format
+	if outFormat == "" {
+		outFormat = format
+		if _, ok := outputFormats[outFormat]; !ok {
+			outFormat = "png"
+		}
+	}
+	return outputFormats[outFormat], encodeImage(out, img, outFormat)
+}
+
+// decodeIcon decodes the image in data that looks best at size x size:
+// SVGs are rendered at that size and ICOs give us the fitting entry.
+func decodeIcon(data []byte, format string, size int) (image.Image, error) {
+	switch format {
+	case "svg":
+		return svgraster.Render(data, size, size)
+	case "ico":
+		return ico.DecodeSize(bytes.NewReader(data), size)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// resizeImage scales img to fit into size x size, keeping its aspect ratio.
+// Non-square images are centered on a transparent background.
+func resizeImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	if b.Dx() == size && b.Dy() == size {
+		return img
+	}
+
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = max(1, size*b.Dy()/b.Dx())
+	} else if b.Dy() > b.Dx() {
+		w = max(1, size*b.Dx()/b.Dy())
+	}
+	x, y := (size-w)/2, (size-h)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	xdraw.CatmullRom.Scale(dst, image.Rect(x, y, x+w, y+h), img, b, xdraw.Over, nil)
+	return dst
+}
+
+func encodeImage(out io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpg":
+		// no alpha channel in JPEG, so put it on white like browsers would
+		b := img.Bounds()
+		flat := image.NewRGBA(b)
+		draw.Draw(flat, b, image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, b, img, b.Min, draw.Over)
+		return jpeg.Encode(out, flat, &jpeg.Options{Quality: 90})
+	case "gif":
+		return gif.Encode(out, img, &gif.Options{NumColors: 256, Drawer: draw.FloydSteinberg})
+	case "ico":
+		if b := img.Bounds(); b.Dx() > 256 || b.Dy() > 256 {
+			img = resizeImage(img, 256)
+		}
+		return ico.Encode(out, img)
+	}
+
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	return encoder.Encode(out, img)
+}
@@ -0,0 +1,240 @@
+package besticon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// ErrImageNotFound is returned by ImageStore.Get for unknown images.
+var ErrImageNotFound = errors.New("besticon: image not found")
+
+// ImageStore keeps icon images by their SHA-1 sum, see Icon.Sha1sum. With
+// one set via WithImageStore, cached results only keep the sums and images
+// shared by several sites are stored once.
+//
+// Implementations must be safe for concurrent use.
+type ImageStore interface {
+	// Get returns the image with the given sum or ErrImageNotFound.
+	Get(ctx context.Context, sha1sum string) ([]byte, error)
+
+	// Put stores data, which has the given sum.
+	Put(ctx context.Context, sha1sum string, data []byte) error
+}
+
+var sha1sumRe = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// IsSha1sum tells whether s looks like an Icon.Sha1sum.
+func IsSha1sum(s string) bool {
+	return sha1sumRe.MatchString(s)
+}
+
+// FileImageStore is an ImageStore keeping images as files in a directory.
+type FileImageStore struct {
+	dir string
+}
+
+var _ ImageStore = (*FileImageStore)(nil)
+
+// NewFileImageStore returns a FileImageStore storing its files in dir,
+// creating it if needed.
+func NewFileImageStore(dir string) (*FileImageStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileImageStore{dir: dir}, nil
+}
+
+// Get implements ImageStore.
+func (s *FileImageStore) Get(ctx context.Context, sha1sum string) ([]byte, error) {
+	if !IsSha1sum(sha1sum) {
+		return nil, ErrImageNotFound
+	}
+	data, err := os.ReadFile(s.path(sha1sum))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrImageNotFound
+	}
+	return data, err
+}
+
+// Put implements ImageStore.
+func (s *FileImageStore) Put(ctx context.Context, sha1sum string, data []byte) error {
+	if !IsSha1sum(sha1sum) {
+		return fmt.Errorf("besticon: invalid sha1sum %q", sha1sum)
+	}
+
+	path := s.path(sha1sum)
+	if _, err := os.Stat(path); err == nil {
+		// Same sum, same bytes.
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// path spreads the files over subdirectories named by the first two hex
+// digits, like git does.
+func (s *FileImageStore) path(sha1sum string) string {
+	return filepath.Join(s.dir, sha1sum[:2], sha1sum[2:])
+}
+
+type imageStoreOption struct {
+	store ImageStore
+}
+
+func (o *imageStoreOption) applyOption(b *Besticon) {
+	b.imageStore = o.store
+}
+
+// WithImageStore stores all icon images found in s.
+func WithImageStore(s ImageStore) Option {
+	return &imageStoreOption{store: s}
+}
+
+// storeImage queues data to be put into the image store, if there is one.
+// Images are stored in the background, loadImages finds them while they
+// are queued.
+func (b *Besticon) storeImage(ctx context.Context, sha1sum string, data []byte) {
+	if b.images == nil {
+		return
+	}
+	b.images.put(ctx, sha1sum, data)
+}
+
+const (
+	// imageQueueSize bounds the images waiting to be stored. Images found
+	// while it's full are dropped, to be stored on a later lookup.
+	imageQueueSize = 1000
+	imageWorkers   = 4
+	// maxSeenImages bounds the memory used to remember stored images.
+	maxSeenImages = 100_000
+)
+
+// imageWriter puts images into an ImageStore in the background, skipping
+// the ones it already stored.
+type imageWriter struct {
+	store ImageStore
+	log   *slog.Logger
+	queue chan storedImage
+	start sync.Once
+	// pending counts queued images, for tests to wait on.
+	pending sync.WaitGroup
+
+	mu   sync.Mutex
+	seen map[string]bool
+	// queued are the images not stored yet.
+	queued map[string][]byte
+}
+
+type storedImage struct {
+	ctx     context.Context
+	sha1sum string
+	data    []byte
+}
+
+func newImageWriter(store ImageStore, log *slog.Logger) *imageWriter {
+	return &imageWriter{
+		store:  store,
+		log:    log,
+		queue:  make(chan storedImage, imageQueueSize),
+		seen:   map[string]bool{},
+		queued: map[string][]byte{},
+	}
+}
+
+func (w *imageWriter) put(ctx context.Context, sha1sum string, data []byte) {
+	w.start.Do(func() {
+		for range imageWorkers {
+			go w.work()
+		}
+	})
+
+	w.mu.Lock()
+	if w.seen[sha1sum] {
+		w.mu.Unlock()
+		return
+	}
+	if len(w.seen) >= maxSeenImages {
+		clear(w.seen)
+	}
+	w.seen[sha1sum] = true
+	w.queued[sha1sum] = data
+	w.mu.Unlock()
+
+	w.pending.Add(1)
+	select {
+	case w.queue <- storedImage{context.WithoutCancel(ctx), sha1sum, data}:
+	default:
+		w.done(sha1sum, false)
+		w.log.WarnContext(ctx, "image store queue full, dropped image", "sha1sum", sha1sum)
+	}
+}
+
+func (w *imageWriter) work() {
+	for img := range w.queue {
+		err := w.store.Put(img.ctx, img.sha1sum, img.data)
+		if err != nil {
+			w.log.ErrorContext(img.ctx, "failed to store image", "sha1sum", img.sha1sum, "error", err)
+		}
+		w.done(img.sha1sum, err == nil)
+	}
+}
+
+// done takes sha1sum off the queue. Images that weren't stored may be
+// queued again.
+func (w *imageWriter) done(sha1sum string, stored bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.queued, sha1sum)
+	if !stored {
+		delete(w.seen, sha1sum)
+	}
+	w.pending.Done()
+}
+
+// get returns the image with the given sum if it's still queued.
+func (w *imageWriter) get(sha1sum string) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data, ok := w.queued[sha1sum]
+	return data, ok
+}
+
+// loadImages fills in the image data of icons from the image store.
+func (b *Besticon) loadImages(ctx context.Context, icons []Icon) {
+	if b.imageStore == nil || b.discardImageBytes {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := range icons {
+		ico := &icons[i]
+		if ico.ImageData != nil || ico.Error != nil || ico.Sha1sum == "" {
+			continue
+		}
+		if data, ok := b.images.get(ico.Sha1sum); ok {
+			ico.ImageData = data
+			continue
+		}
+		wg.Go(func() {
+			data, err := b.imageStore.Get(ctx, ico.Sha1sum)
+			if err != nil {
+				if !errors.Is(err, ErrImageNotFound) {
+					b.log.ErrorContext(ctx, "failed to load image", "sha1sum", ico.Sha1sum, "error", err)
+				}
+				return
+			}
+			ico.ImageData = data
+		})
+	}
+	wg.Wait()
+}
@@ -1,9 +1,15 @@
 package besticon
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -48,3 +54,117 @@ func (d *defaultLogger) LogResponse(req *http.Request, resp *http.Response, dura
 		)
 	}
 }
+
+type slogLoggerOption struct {
+	logger *slog.Logger
+}
+
+func (s *slogLoggerOption) applyOption(b *Besticon) {
+	b.logger = NewSlogLogger(s.logger)
+	b.log = s.logger
+}
+
+// WithSlogLogger logs structured records to logger instead of a Logger.
+// Besides errors and upstream responses it logs debug events for cache
+// hits and misses, rejected icons and the icon IconInSizeRange selects.
+// Records are logged with the context of the lookup, so a handler can add
+// e.g. a request ID to them.
+func WithSlogLogger(logger *slog.Logger) Option {
+	return &slogLoggerOption{logger: logger}
+}
+
+// NewSlogLogger returns a Logger that logs to l.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return &slogLogger{logger: l}
+}
+
+var _ Logger = (*slogLogger)(nil)
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (s *slogLogger) LogError(err error) {
+	s.logger.Error(err.Error())
+}
+
+func (s *slogLogger) LogResponse(req *http.Request, resp *http.Response, duration time.Duration, err error) {
+	attrs := []slog.Attr{
+		slog.String("method", req.Method),
+		slog.String("url", req.URL.String()),
+		slog.Float64("duration_ms", float64(duration)/float64(time.Millisecond)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+		s.logger.LogAttrs(req.Context(), slog.LevelWarn, "upstream request failed", attrs...)
+		return
+	}
+	attrs = append(attrs, slog.Int("status", resp.StatusCode), slog.Int64("content_length", resp.ContentLength))
+	s.logger.LogAttrs(req.Context(), slog.LevelInfo, "upstream response", attrs...)
+}
+
+// NewLoggerHandler returns a slog.Handler that passes error records to l,
+// for code that logs with slog but is configured with a Logger. Records
+// below slog.LevelError are dropped, Logger has nothing for them.
+func NewLoggerHandler(l Logger) slog.Handler {
+	return &loggerHandler{logger: l}
+}
+
+type loggerHandler struct {
+	logger Logger
+	attrs  []slog.Attr
+	group  string
+}
+
+func (h *loggerHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelError
+}
+
+// Handle turns r into the error "<message>: <error> (key=value ...)".
+func (h *loggerHandler) Handle(_ context.Context, r slog.Record) error {
+	var cause error
+	var fields []string
+	add := func(a slog.Attr) {
+		if err, ok := a.Value.Any().(error); ok && a.Key == "error" && cause == nil {
+			cause = err
+			return
+		}
+		key := a.Key
+		if h.group != "" {
+			key = h.group + "." + key
+		}
+		fields = append(fields, key+"="+a.Value.String())
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		add(a)
+		return true
+	})
+
+	err := errors.New(r.Message)
+	if cause != nil {
+		err = fmt.Errorf("%s: %w", r.Message, cause)
+	}
+	if len(fields) > 0 {
+		err = fmt.Errorf("%w (%s)", err, strings.Join(fields, " "))
+	}
+	h.logger.LogError(err)
+	return nil
+}
+
+func (h *loggerHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(slices.Clip(h.attrs), attrs...)
+	return &c
+}
+
+func (h *loggerHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.group = name
+	if h.group != "" {
+		c.group = h.group + "." + name
+	}
+	return &c
+}
@@ -0,0 +1,98 @@
+package besticon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type requestIDKey struct{}
+
+// requestIDHandler adds the request ID in the context to records.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(requestIDHandler{slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})})
+	b := newTestBesticon(map[string]testResponse{
+		"/": {body: []byte(`<html><head>
+			<link rel="icon" href="/missing.png">
+			<link rel="icon" href="/pixel.gif">
+		</head></html>`)},
+		"/favicon.ico": {body: mustReadFile("testdata/favicon.ico")},
+		"/pixel.gif":   {body: []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x01D\x00;")},
+	}, WithCacheBackend(NewMemoryCache(1<<20)), WithSlogLogger(logger))
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-1")
+	finder := b.NewIconFinder()
+	_, err := finder.FetchIconsContext(ctx, testSiteURL)
+	check(err)
+	finder.IconInSizeRange(SizeRange{16, 32, 64})
+	b.NewIconFinder().FetchIconsContext(ctx, testSiteURL)
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]any
+		check(json.Unmarshal([]byte(line), &rec))
+		assertEquals(t, "req-1", rec["request_id"])
+		records = append(records, rec)
+	}
+
+	find := func(msg, key, value string) map[string]any {
+		for _, rec := range records {
+			if rec["msg"] == msg && (key == "" || rec[key] == value) {
+				return rec
+			}
+		}
+		t.Fatalf("no record %q with %s=%s in %s", msg, key, value, buf.String())
+		return nil
+	}
+	assertEquals(t, testSiteURL, find("cache miss", "", "")["url"])
+	assertEquals(t, testSiteURL, find("cache hit", "", "")["url"])
+	assertEquals(t, "INFO", find("upstream response", "url", testSiteURL+"/favicon.ico")["level"])
+	assertEquals(t, "decode_failed", find("icon rejected", "url", testSiteURL+"/missing.png")["reason"])
+	assertEquals(t, "too_small", find("icon rejected", "url", testSiteURL+"/pixel.gif")["reason"])
+	selected := find("icon selected", "", "")
+	assertEquals(t, testSiteURL+"/favicon.ico", selected["icon"])
+	assertEquals(t, "ico", selected["format"])
+}
+
+type recordingLogger struct {
+	errs []error
+}
+
+func (r *recordingLogger) LogError(err error) {
+	r.errs = append(r.errs, err)
+}
+
+func (r *recordingLogger) LogResponse(*http.Request, *http.Response, time.Duration, error) {}
+
+func TestLoggerHandler(t *testing.T) {
+	l := &recordingLogger{}
+	logger := slog.New(NewLoggerHandler(l))
+	cause := errors.New("disk full")
+
+	logger.Debug("cache miss", "url", "http://example.com")
+	logger.With("url", "http://example.com").Error("failed to store icon in cache", "error", cause)
+	logger.WithGroup("image").Error("failed to load image", "sha1sum", "abc")
+
+	assertEquals(t, 2, len(l.errs))
+	assertEquals(t, "failed to store icon in cache: disk full (url=http://example.com)", l.errs[0].Error())
+	assertEquals(t, true, errors.Is(l.errs[0], cause))
+	assertEquals(t, "failed to load image (image.sha1sum=abc)", l.errs[1].Error())
+}
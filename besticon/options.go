@@ -17,6 +17,11 @@ func (h *httpClientOption) applyOption(b *Besticon) {
 }
 
 // WithHTTPClient sets the http client to use for requests.
+//
+// The address policy is only enforced for every address connected to, the
+// ones names resolve to included, by transports from NewHTTPTransport.
+// With other transports only URLs and redirects to literal IP addresses
+// are checked against it.
 func WithHTTPClient(client *http.Client) Option {
 	return &httpClientOption{
 		client: client,
@@ -29,6 +34,7 @@ type loggerOption struct {
 
 func (l *loggerOption) applyOption(b *Besticon) {
 	b.logger = l.logger
+	b.log = nil
 }
 
 // WithLogger sets the logger to use for logging.
@@ -67,3 +73,36 @@ func WithDiscardImageBytes(discardImageBytes bool) Option {
 		discardImageBytes: discardImageBytes,
 	}
 }
+
+type cookiesOption struct {
+	enabled bool
+}
+
+func (c *cookiesOption) applyOption(b *Besticon) {
+	b.disableCookies = !c.enabled
+}
+
+// WithCookies sets whether sites may set cookies, true by default. Each
+// lookup keeps its cookies to itself, the Jar of the HTTP client is not
+// used.
+func WithCookies(enabled bool) Option {
+	return &cookiesOption{
+		enabled: enabled,
+	}
+}
+
+type lookupObserverOption struct {
+	observe func(siteURL string, icons []Icon, err error)
+}
+
+func (l *lookupObserverOption) applyOption(b *Besticon) {
+	b.lookupObserver = l.observe
+}
+
+// WithLookupObserver calls observe after every lookup of a site, e.g. to
+// record metrics. Results served from the cache are not lookups.
+func WithLookupObserver(observe func(siteURL string, icons []Icon, err error)) Option {
+	return &lookupObserverOption{
+		observe: observe,
+	}
+}
@@ -0,0 +1,237 @@
+package besticon
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyConfig routes the connections of lookups through a proxy.
+//
+// Lookups resolve host names themselves and check the addresses against
+// the address policy before asking the proxy to connect to the address,
+// so the policy applies to the sites looked up, not to the proxy. Plain
+// HTTP requests are tunneled with CONNECT too, so HTTP proxies must allow
+// CONNECT to port 80.
+type ProxyConfig struct {
+	// URL is the proxy, http://host:port for an HTTP proxy or
+	// socks5://host:port for a SOCKS5 proxy. The user and password in the
+	// URL, if any, are used to authenticate.
+	URL *url.URL
+
+	// NoProxy lists the hosts to connect to directly, separated by commas.
+	// Entries are domain names, which match their subdomains as well, IP
+	// addresses or CIDR prefixes. "*" matches all hosts.
+	NoProxy string
+}
+
+// ParseProxyConfig returns the ProxyConfig for the proxy at rawURL.
+func ParseProxyConfig(rawURL, noProxy string) (*ProxyConfig, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return nil, fmt.Errorf("besticon: unsupported proxy scheme %q, want http or socks5", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("besticon: proxy URL %q has no host", rawURL)
+	}
+	return &ProxyConfig{URL: u, NoProxy: noProxy}, nil
+}
+
+type proxyOption struct {
+	proxy *ProxyConfig
+}
+
+func (p *proxyOption) applyOption(b *Besticon) {
+	b.proxy = p.proxy
+}
+
+// WithProxy makes the default HTTP client connect through proxy. Clients
+// passed to WithHTTPClient need a transport from NewHTTPTransport for
+// that.
+func WithProxy(proxy *ProxyConfig) Option {
+	return &proxyOption{proxy: proxy}
+}
+
+// bypass reports whether host is in the NoProxy list.
+func (c *ProxyConfig) bypass(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip, ipErr := netip.ParseAddr(host)
+
+	for _, entry := range strings.Split(c.NoProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case entry == "*":
+			return true
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err == nil && ipErr == nil && prefix.Contains(ip.Unmap()) {
+				return true
+			}
+		default:
+			entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// address returns the host:port of the proxy.
+func (c *ProxyConfig) address() string {
+	port := c.URL.Port()
+	if port == "" {
+		port = "80"
+		if c.URL.Scheme == "socks5" {
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(c.URL.Hostname(), port)
+}
+
+// proxyDialer connects to addresses policy allows through a proxy.
+type proxyDialer struct {
+	config *ProxyConfig
+	policy *AddressPolicy
+
+	// direct is for the hosts in NoProxy, forward for the proxy itself.
+	direct  *net.Dialer
+	forward *net.Dialer
+}
+
+func newProxyDialer(config *ProxyConfig, policy *AddressPolicy, timeout time.Duration) *proxyDialer {
+	direct := NewDialer(policy)
+	direct.Timeout = timeout
+	return &proxyDialer{
+		config:  config,
+		policy:  policy,
+		direct:  direct,
+		forward: &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second},
+	}
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if d.config.bypass(host) {
+		return d.direct.DialContext(ctx, network, address)
+	}
+
+	ip, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	target := net.JoinHostPort(ip.String(), port)
+
+	switch d.config.URL.Scheme {
+	case "http":
+		return d.dialConnect(ctx, target)
+	case "socks5":
+		return d.dialSOCKS5(ctx, target)
+	default:
+		return nil, fmt.Errorf("besticon: unsupported proxy scheme %q", d.config.URL.Scheme)
+	}
+}
+
+// resolve returns the first address of host the policy allows. Passing
+// the address rather than host to the proxy keeps it from resolving host
+// to a different one.
+func (d *proxyDialer) resolve(ctx context.Context, host string) (netip.Addr, error) {
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, ip := range ips {
+		if d.policy.Allowed(ip) {
+			return ip.Unmap(), nil
+		}
+	}
+	return netip.Addr{}, &PrivateAddressError{Host: host, IP: net.IP(ips[0].Unmap().AsSlice())}
+}
+
+func (d *proxyDialer) dialSOCKS5(ctx context.Context, target string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if user := d.config.URL.User; user != nil {
+		password, _ := user.Password()
+		auth = &proxy.Auth{User: user.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", d.config.address(), auth, d.forward)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+}
+
+func (d *proxyDialer) dialConnect(ctx context.Context, target string) (_ net.Conn, err error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.config.address())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	// Abort the handshake once ctx is done.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: http.Header{},
+	}
+	if user := d.config.URL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("besticon: proxy refused to connect to %s: %s", target, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection of which some bytes have already been read
+// into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,282 @@
+package besticon
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// proxyStandIn records the targets a test proxy was asked to connect to.
+type proxyStandIn struct {
+	mu      sync.Mutex
+	targets []string
+	auth    []string
+}
+
+func (p *proxyStandIn) record(target, auth string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.targets = append(p.targets, target)
+	p.auth = append(p.auth, auth)
+}
+
+func (p *proxyStandIn) seen() ([]string, []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.targets), slices.Clone(p.auth)
+}
+
+// pipe copies between a and b until either is closed.
+func pipe(a, b net.Conn) {
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(a, b)
+	io.Copy(b, a)
+}
+
+// newConnectProxy starts an HTTP proxy that only supports CONNECT.
+func newConnectProxy(t *testing.T) (*httptest.Server, *proxyStandIn) {
+	standIn := &proxyStandIn{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		standIn.record(r.Host, r.Header.Get("Proxy-Authorization"))
+		if r.Host == "0.0.0.0:1" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		pipe(conn, upstream)
+	}))
+	t.Cleanup(server.Close)
+	return server, standIn
+}
+
+// newSOCKS5Proxy starts a SOCKS5 proxy that requires a user and password
+// and supports CONNECT to IPv4 addresses.
+func newSOCKS5Proxy(t *testing.T) (string, *proxyStandIn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	standIn := &proxyStandIn{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, standIn)
+		}
+	}()
+	return ln.Addr().String(), standIn
+}
+
+func serveSOCKS5(conn net.Conn, standIn *proxyStandIn) {
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil
+		}
+		return buf
+	}
+
+	// Greeting, then username/password authentication (RFC 1929).
+	greeting := read(2)
+	if greeting == nil || read(int(greeting[1])) == nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 2})
+	version := read(2)
+	if version == nil {
+		conn.Close()
+		return
+	}
+	user := string(read(int(version[1])))
+	password := string(read(int(read(1)[0])))
+	conn.Write([]byte{1, 0})
+
+	// CONNECT request with an IPv4 address.
+	req := read(4)
+	if req == nil || req[1] != 1 || req[3] != 1 {
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	addr := read(6)
+	target := net.JoinHostPort(net.IP(addr[:4]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(addr[4:]))))
+	standIn.record(target, user+":"+password)
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(conn, upstream)
+}
+
+// newProxiedSite starts a site on 127.0.0.2, which the returned policy
+// allows, unlike the 127.0.0.1 the proxies listen on.
+func newProxiedSite(t *testing.T) (*httptest.Server, *AddressPolicy) {
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("cannot bind 127.0.0.2: %v", err)
+	}
+	site := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("site"))
+	})}}
+	site.Start()
+	t.Cleanup(site.Close)
+
+	policy := DefaultAddressPolicy()
+	policy.Allow = mustParsePrefixes("127.0.0.2/32")
+	return site, policy
+}
+
+func getBody(t *testing.T, b *Besticon, url string) string {
+	resp, err := b.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := b.GetBodyBytes(resp)
+	check(err)
+	return string(body)
+}
+
+func TestProxyConnect(t *testing.T) {
+	site, policy := newProxiedSite(t)
+	proxyServer, standIn := newConnectProxy(t)
+	config, err := ParseProxyConfig("http://user:secret@"+proxyServer.Listener.Addr().String(), "")
+	check(err)
+	b := New(WithAddressPolicy(policy), WithProxy(config), WithLogger(NewDefaultLogger(io.Discard)))
+
+	assertEquals(t, "site", getBody(t, b, site.URL))
+	targets, auth := standIn.seen()
+	assertEquals(t, []string{site.Listener.Addr().String()}, targets)
+	assertEquals(t, []string{"Basic dXNlcjpzZWNyZXQ="}, auth)
+
+	// The proxy itself is on a denied address, asking it to connect there
+	// must fail without it ever being asked.
+	u, _ := url.Parse(proxyServer.URL)
+	_, err = b.Get("http://localhost:" + u.Port() + "/")
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("expected request to localhost to be rejected, got %v", err)
+	}
+	targets, _ = standIn.seen()
+	assertEquals(t, 1, len(targets))
+}
+
+func TestProxyConnectRefused(t *testing.T) {
+	proxyServer, _ := newConnectProxy(t)
+	config, err := ParseProxyConfig(proxyServer.URL, "")
+	check(err)
+	b := New(WithAddressPolicy(&AddressPolicy{}), WithProxy(config), WithLogger(NewDefaultLogger(io.Discard)))
+
+	_, err = b.Get("http://0.0.0.0:1/")
+	if err == nil || !strings.Contains(err.Error(), "proxy refused to connect to 0.0.0.0:1: 403 Forbidden") {
+		t.Fatalf("expected the proxy to refuse, got %v", err)
+	}
+}
+
+func TestProxySOCKS5(t *testing.T) {
+	site, policy := newProxiedSite(t)
+	proxyAddr, standIn := newSOCKS5Proxy(t)
+	config, err := ParseProxyConfig("socks5://user:secret@"+proxyAddr, "")
+	check(err)
+	b := New(WithAddressPolicy(policy), WithProxy(config), WithLogger(NewDefaultLogger(io.Discard)))
+
+	assertEquals(t, "site", getBody(t, b, site.URL))
+	targets, auth := standIn.seen()
+	assertEquals(t, []string{site.Listener.Addr().String()}, targets)
+	assertEquals(t, []string{"user:secret"}, auth)
+
+	_, err = b.Get("http://localhost:1/")
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("expected request to localhost to be rejected, got %v", err)
+	}
+	targets, _ = standIn.seen()
+	assertEquals(t, 1, len(targets))
+}
+
+func TestNoProxy(t *testing.T) {
+	site, policy := newProxiedSite(t)
+	proxyServer, standIn := newConnectProxy(t)
+	config, err := ParseProxyConfig(proxyServer.URL, "example.com, 127.0.0.0/24")
+	check(err)
+	b := New(WithAddressPolicy(policy), WithProxy(config), WithLogger(NewDefaultLogger(io.Discard)))
+
+	assertEquals(t, "site", getBody(t, b, site.URL))
+	targets, _ := standIn.seen()
+	assertEquals(t, 0, len(targets))
+}
+
+func TestProxyConfigBypass(t *testing.T) {
+	config := &ProxyConfig{NoProxy: "example.com, .internal, *.corp.test, 10.0.0.0/8, 192.168.1.1"}
+	for host, bypass := range map[string]bool{
+		"example.com":      true,
+		"www.example.com":  true,
+		"EXAMPLE.COM.":     true,
+		"notexample.com":   false,
+		"wiki.internal":    true,
+		"internal":         true,
+		"git.corp.test":    true,
+		"10.1.2.3":         true,
+		"11.1.2.3":         false,
+		"192.168.1.1":      true,
+		"192.168.1.2":      false,
+		"example.org":      false,
+		"::ffff:10.0.0.1":  true,
+		"10.0.0.1.nip.io":  false,
+		"www.example.com2": false,
+	} {
+		if config.bypass(host) != bypass {
+			t.Errorf("bypass(%s) = %t, want %t", host, !bypass, bypass)
+		}
+	}
+
+	assertEquals(t, false, (&ProxyConfig{}).bypass("example.com"))
+	assertEquals(t, true, (&ProxyConfig{NoProxy: "*"}).bypass("example.com"))
+}
+
+func TestParseProxyConfig(t *testing.T) {
+	config, err := ParseProxyConfig("socks5://proxy.internal", "")
+	check(err)
+	assertEquals(t, "proxy.internal:1080", config.address())
+
+	config, err = ParseProxyConfig("http://proxy.internal", "")
+	check(err)
+	assertEquals(t, "proxy.internal:80", config.address())
+
+	for _, rawURL := range []string{"https://proxy.internal:443", "proxy.internal:3128", "http://", "socks5h://proxy.internal"} {
+		if _, err := ParseProxyConfig(rawURL, ""); err == nil {
+			t.Errorf("expected an error for %q", rawURL)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package besticon
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3ImageStore.
+type S3Config struct {
+	// Endpoint is the base URL of the S3 API, e.g.
+	// "https://s3.eu-central-1.amazonaws.com" or a MinIO server.
+	Endpoint string
+	Bucket   string
+	Region   string
+	// Prefix is prepended to the object keys.
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// HTTPClient defaults to a client with a timeout of 30 seconds.
+	HTTPClient *http.Client
+}
+
+// S3ImageStore is an ImageStore keeping images in an S3 compatible bucket.
+// Objects are addressed path-style, as endpoint/bucket/key.
+type S3ImageStore struct {
+	cfg S3Config
+	now func() time.Time
+}
+
+var _ ImageStore = (*S3ImageStore)(nil)
+
+// NewS3ImageStore returns an S3ImageStore for cfg.
+func NewS3ImageStore(cfg S3Config) *S3ImageStore {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	return &S3ImageStore{cfg: cfg, now: time.Now}
+}
+
+// Get implements ImageStore.
+func (s *S3ImageStore) Get(ctx context.Context, sha1sum string) ([]byte, error) {
+	if !IsSha1sum(sha1sum) {
+		return nil, ErrImageNotFound
+	}
+
+	res, err := s.do(ctx, http.MethodGet, sha1sum, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, ErrImageNotFound
+	case res.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("besticon: s3 get %s: %s", sha1sum, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
+
+// Put implements ImageStore.
+func (s *S3ImageStore) Put(ctx context.Context, sha1sum string, data []byte) error {
+	if !IsSha1sum(sha1sum) {
+		return fmt.Errorf("besticon: invalid sha1sum %q", sha1sum)
+	}
+
+	// Same sum, same bytes.
+	res, err := s.do(ctx, http.MethodHead, sha1sum, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	res, err = s.do(ctx, http.MethodPut, sha1sum, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("besticon: s3 put %s: %s", sha1sum, res.Status)
+	}
+	return nil
+}
+
+func (s *S3ImageStore) do(ctx context.Context, method string, sha1sum string, body []byte) (*http.Response, error) {
+	u := s.cfg.Endpoint + "/" + s.cfg.Bucket + "/" + s.cfg.Prefix + sha1sum
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, body, s.cfg.AccessKeyID, s.cfg.SecretAccessKey, s.cfg.Region, "s3", s.now())
+	return s.cfg.HTTPClient.Do(req)
+}
+
+// signV4 signs req with AWS Signature Version 4. It signs the host and all
+// headers set on req.
+func signV4(req *http.Request, body []byte, accessKeyID, secretAccessKey, region, service string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := slices.Clone(query[k])
+		slices.Sort(values)
+		for _, v := range values {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters.
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,313 @@
+package besticon
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html/charset"
+)
+
+var (
+	errSVGSize    = errors.New("besticon: svg without usable width, height or viewBox")
+	errSVGNesting = errors.New("besticon: svg with unbalanced elements")
+)
+
+// parseSVGSize returns the intrinsic size of the SVG document in data as
+// given by the width and height attributes of its root element, falling
+// back to the viewBox for missing or relative (%, em) values.
+func parseSVGSize(data []byte) (float64, float64, error) {
+	root, e := svgRoot(data)
+	if e != nil {
+		return 0, 0, e
+	}
+
+	width, hasWidth := parseSVGLength(attrValue(root, "width"))
+	height, hasHeight := parseSVGLength(attrValue(root, "height"))
+	vbWidth, vbHeight, hasViewBox := parseViewBox(attrValue(root, "viewBox"))
+
+	switch {
+	case hasWidth && hasHeight:
+		return width, height, nil
+	case hasWidth && hasViewBox:
+		return width, width * vbHeight / vbWidth, nil
+	case hasHeight && hasViewBox:
+		return height * vbWidth / vbHeight, height, nil
+	case hasViewBox:
+		return vbWidth, vbHeight, nil
+	}
+	return 0, 0, errSVGSize
+}
+
+// svgRoot returns the root <svg> element of data.
+func svgRoot(data []byte) (*xml.StartElement, error) {
+	d := newSVGDecoder(data)
+	for {
+		t, e := d.Token()
+		if e != nil {
+			return nil, e
+		}
+		if start, ok := t.(xml.StartElement); ok {
+			if start.Name.Local != "svg" {
+				return nil, errSVGSize
+			}
+			return &start, nil
+		}
+	}
+}
+
+func newSVGDecoder(data []byte) *xml.Decoder {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.CharsetReader = charset.NewReaderLabel
+	d.Entity = xml.HTMLEntity
+	return d
+}
+
+func attrValue(el *xml.StartElement, name string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == name {
+			return strings.TrimSpace(a.Value)
+		}
+	}
+	return ""
+}
+
+// parseSVGLength parses absolute lengths like "32", "32px" or "2.5in" into
+// pixels.
+func parseSVGLength(s string) (float64, bool) {
+	units := map[string]float64{
+		"":   1,
+		"px": 1,
+		"pt": 4.0 / 3,
+		"pc": 16,
+		"in": 96,
+		"cm": 96 / 2.54,
+		"mm": 96 / 25.4,
+	}
+
+	num := strings.TrimRight(s, "abcdefghijklmnopqrstuvwxyz%")
+	factor, ok := units[strings.ToLower(s[len(num):])]
+	if !ok {
+		return 0, false
+	}
+	n, e := strconv.ParseFloat(num, 64)
+	if e != nil || n <= 0 || math.IsInf(n, 0) {
+		return 0, false
+	}
+	return n * factor, true
+}
+
+func parseViewBox(s string) (float64, float64, bool) {
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' })
+	if len(fields) != 4 {
+		return 0, 0, false
+	}
+	width, e1 := strconv.ParseFloat(fields[2], 64)
+	height, e2 := strconv.ParseFloat(fields[3], 64)
+	if e1 != nil || e2 != nil || width <= 0 || height <= 0 || math.IsInf(width, 0) || math.IsInf(height, 0) {
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// svgFitsSizeRange tells whether an SVG of the given aspect ratio, scaled so
+// that its longer side is r.Perfect, still has its shorter side in range.
+// This lets square logos win while wide wordmarks are passed over.
+func svgFitsSizeRange(width, height int, r SizeRange) bool {
+	if width <= 0 || height <= 0 {
+		return false
+	}
+	shorter := float64(min(width, height)) / float64(max(width, height)) * float64(r.Perfect)
+	return math.Round(shorter) >= float64(r.Min)
+}
+
+// Elements removed by SanitizeSVG together with everything inside them.
+var svgForbiddenElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"handler":       true,
+	"listener":      true,
+}
+
+var (
+	cssURLRe     = regexp.MustCompile(`(?i)url\s*\(\s*['"]?\s*([^'")\s]*)`)
+	cssCommentRe = regexp.MustCompile(`(?s)/\*.*?(\*/|$)`)
+	dataImageRe  = regexp.MustCompile(`(?i)^data:image/(png|jpeg|gif|webp);`)
+)
+
+// SanitizeSVG returns a copy of the SVG document in data that is safe to
+// embed into a page. It strips scripts, event handler attributes,
+// foreignObject and other embedding elements, and all references to
+// external resources. Comments, processing instructions and DOCTYPEs (with
+// their entities) are dropped as well.
+func SanitizeSVG(data []byte) ([]byte, error) {
+	d := newSVGDecoder(data)
+
+	var out bytes.Buffer
+	var open []xml.Name
+	skipDepth := 0
+	inStyle := false
+	for {
+		t, e := d.RawToken()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			open = append(open, t.Name)
+			if skipDepth > 0 || forbiddenSVGElement(t) {
+				skipDepth++
+				continue
+			}
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, a := range t.Attr {
+				if !safeSVGAttr(t.Name.Local, a) {
+					continue
+				}
+				out.WriteString(" " + qualifiedName(a.Name) + `="`)
+				xml.EscapeText(&out, []byte(a.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+			inStyle = strings.EqualFold(t.Name.Local, "style")
+		case xml.EndElement:
+			// RawToken doesn't check nesting, we do
+			if len(open) == 0 || open[len(open)-1] != t.Name {
+				return nil, errSVGNesting
+			}
+			open = open[:len(open)-1]
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+			inStyle = false
+		case xml.CharData:
+			if skipDepth > 0 || (inStyle && !safeCSS(string(t))) {
+				continue
+			}
+			xml.EscapeText(&out, t)
+		}
+	}
+
+	if len(open) != 0 {
+		return nil, errSVGNesting
+	}
+	return out.Bytes(), nil
+}
+
+func forbiddenSVGElement(el xml.StartElement) bool {
+	name := strings.ToLower(el.Name.Local)
+	if svgForbiddenElements[name] {
+		return true
+	}
+
+	// <set attributeName="href" to="javascript:..."> and friends
+	switch name {
+	case "set", "animate", "animatemotion", "animatetransform":
+		target := strings.ToLower(attrValue(&el, "attributeName"))
+		return target == "href" || strings.HasSuffix(target, ":href") || strings.HasPrefix(target, "on")
+	}
+	return false
+}
+
+// safeCSS tells whether a stylesheet or style attribute stays inside the
+// document.
+func safeCSS(css string) bool {
+	css = decodeCSS(css)
+	if strings.Contains(strings.ToLower(css), "@import") {
+		return false
+	}
+	for _, m := range cssURLRe.FindAllStringSubmatch(css, -1) {
+		if !isLocalReference(m[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeCSS strips the comments from css and decodes its escapes, so
+// u\72l( and @\69mport are seen as what browsers read them as.
+func decodeCSS(css string) string {
+	css = cssCommentRe.ReplaceAllString(css, "")
+	if !strings.Contains(css, `\`) {
+		return css
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(css); i++ {
+		if css[i] != '\\' || i+1 == len(css) {
+			b.WriteByte(css[i])
+			continue
+		}
+		i++
+		hex := 0
+		for hex < 6 && i+hex < len(css) && isHexDigit(css[i+hex]) {
+			hex++
+		}
+		if hex == 0 {
+			// \ followed by a newline continues the line, anything else
+			// stands for itself.
+			if css[i] != '\n' {
+				b.WriteByte(css[i])
+			}
+			continue
+		}
+
+		r, _ := strconv.ParseUint(css[i:i+hex], 16, 32)
+		if r == 0 || r > unicode.MaxRune || (r >= 0xd800 && r <= 0xdfff) {
+			r = unicode.ReplacementChar
+		}
+		b.WriteRune(rune(r))
+		i += hex - 1
+		// One whitespace character ends the escape.
+		if i+1 < len(css) && strings.IndexByte(" \t\n\r\f", css[i+1]) >= 0 {
+			i++
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func safeSVGAttr(element string, a xml.Attr) bool {
+	name := strings.ToLower(a.Name.Local)
+	value := strings.TrimSpace(a.Value)
+
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return false
+	case name == "href" || name == "src":
+		return isLocalReference(value) || (strings.EqualFold(element, "image") && dataImageRe.MatchString(value))
+	}
+
+	// url(...) in presentation attributes and inline styles may only point
+	// into the document.
+	return safeCSS(value)
+}
+
+func isLocalReference(ref string) bool {
+	return strings.HasPrefix(ref, "#")
+}
+
+func qualifiedName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
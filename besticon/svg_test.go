@@ -0,0 +1,215 @@
+package besticon
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestParseSVGSize(t *testing.T) {
+	tests := []struct {
+		svg           string
+		width, height float64
+	}{
+		{`<svg width="32" height="16"></svg>`, 32, 16},
+		{`<svg width="32px" height="16px" viewBox="0 0 1 1"></svg>`, 32, 16},
+		{`<svg width="1in" height="0.5in"></svg>`, 96, 48},
+		{`<svg viewBox="0 0 180 180"></svg>`, 180, 180},
+		{`<svg viewBox="0,0,800,40" width="100%" height="100%"></svg>`, 800, 40},
+		{`<svg viewBox="0 0 200 100" width="50"></svg>`, 50, 25},
+		{`<svg viewBox="0 0 200 100" height="50"></svg>`, 100, 50},
+		{`<?xml version="1.0"?><!DOCTYPE svg><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"/>`, 24, 24},
+	}
+	for _, test := range tests {
+		width, height, e := parseSVGSize([]byte(test.svg))
+		check(e)
+		assertEquals(t, test.width, width)
+		assertEquals(t, test.height, height)
+	}
+
+	width, height, e := parseSVGSize(mustReadFile("testdata/svg.svg"))
+	check(e)
+	assertEquals(t, 180.0, width)
+	assertEquals(t, 180.0, height)
+
+	for _, svg := range []string{
+		`<svg></svg>`,
+		`<svg width="100%" height="2em"></svg>`,
+		`<svg viewBox="0 0 0 10"></svg>`,
+		`<html><svg viewBox="0 0 10 10"></svg></html>`,
+	} {
+		_, _, e := parseSVGSize([]byte(svg))
+		assertEquals(t, errSVGSize, e)
+	}
+}
+
+func TestSVGFitsSizeRange(t *testing.T) {
+	assertEquals(t, true, svgFitsSizeRange(24, 24, SizeRange{120, 120, 500}))
+	assertEquals(t, true, svgFitsSizeRange(180, 160, SizeRange{16, 32, 64}))
+	assertEquals(t, false, svgFitsSizeRange(800, 40, SizeRange{16, 32, 64}))
+	assertEquals(t, false, svgFitsSizeRange(512, 500, SizeRange{120, 120, 500}))
+	assertEquals(t, true, svgFitsSizeRange(800, 40, SizeRange{0, 80, 200}))
+}
+
+func TestIconInSizeRangeRespectsSVGAspectRatio(t *testing.T) {
+	finder := &IconFinder{
+		b:              New(),
+		FormatsAllowed: []string{"png", "svg"},
+		icons: []Icon{
+			{URL: "http://example.com/wordmark.svg", Format: "svg", Width: 800, Height: 40},
+			{URL: "http://example.com/icon.png", Format: "png", Width: 64, Height: 64},
+		},
+	}
+	assertEquals(t, "http://example.com/icon.png", finder.IconInSizeRange(SizeRange{16, 32, 64}).URL)
+
+	finder.icons = append(finder.icons, Icon{URL: "http://example.com/logo.svg", Format: "svg", Width: 24, Height: 24})
+	assertEquals(t, "http://example.com/logo.svg", finder.IconInSizeRange(SizeRange{16, 32, 64}).URL)
+}
+
+func TestSanitizeSVG(t *testing.T) {
+	dirty := `<?xml version="1.0"?>
+<?xml-stylesheet href="http://evil.example/x.css"?>
+<!DOCTYPE svg [<!ENTITY x "y">]>
+<!-- comment -->
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 10 10" onload="alert(1)">
+<script>alert(2)</script>
+<style>@import url(http://evil.example/x.css); rect { fill: red }</style>
+<style>circle > * { fill: url(#g) }</style>
+<defs><linearGradient id="g"><stop offset="0" stop-color="#fff"/></linearGradient></defs>
+<foreignObject><body xmlns="http://www.w3.org/1999/xhtml"><iframe src="http://evil.example"/></body></foreignObject>
+<a xlink:href="javascript:alert(3)"><rect width="10" height="10" fill="url(#g)" onclick="alert(4)"/></a>
+<use href="http://evil.example/sprite.svg#icon"/>
+<use xlink:href="#g"/>
+<image href="data:image/png;base64,iVBORw0KGgo="/>
+<image href="http://evil.example/tracker.png"/>
+<rect style="fill: url('http://evil.example/x')"/>
+<set attributeName="href" to="javascript:alert(5)"/>
+<circle r="1"/>
+</svg>`
+
+	clean, e := SanitizeSVG([]byte(dirty))
+	check(e)
+	out := string(clean)
+
+	for _, forbidden := range []string{"alert", "evil.example", "<script", "foreignObject", "<!", "<?", "onload", "onclick", "<set"} {
+		if strings.Contains(out, forbidden) {
+			t.Errorf("sanitized svg still contains %q: %s", forbidden, out)
+		}
+	}
+	for _, kept := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 10 10">`,
+		`<rect width="10" height="10" fill="url(#g)"></rect>`,
+		`<use xlink:href="#g"></use>`,
+		`<image href="data:image/png;base64,iVBORw0KGgo="></image>`,
+		`circle &gt; * { fill: url(#g) }`,
+		`<circle r="1"></circle>`,
+	} {
+		assertStringContains(t, out, kept)
+	}
+
+	// Still a valid svg with the same size
+	width, height, e := parseSVGSize(clean)
+	check(e)
+	assertEquals(t, 10.0, width)
+	assertEquals(t, 10.0, height)
+
+	_, e = SanitizeSVG([]byte(`<svg><g>`))
+	if e == nil {
+		t.Error("expected error for truncated svg")
+	}
+}
+
+func TestSanitizeSVGDecodesCSSEscapes(t *testing.T) {
+	for _, css := range []string{
+		`@\69mport "https://evil.example/x.css";`,
+		`@\000069 mport "https://evil.example/x.css";`,
+		`@\import "https://evil.example/x.css";`,
+		`@im/**/port "https://evil.example/x.css";`,
+		`rect { fill:\75rl(https://evil.example/t) }`,
+		`rect { fill:\55 RL(https://evil.example/t) }`,
+		`rect { fill:u\rl(https://evil.example/t) }`,
+		`rect { fill:url(\68ttps://evil.example/t) }`,
+		`rect { fill:u/* */rl(https://evil.example/t) }`,
+	} {
+		clean, e := SanitizeSVG([]byte(`<svg><style>` + css + `</style><rect style="` + strings.ReplaceAll(css, `"`, "&quot;") + `"/></svg>`))
+		check(e)
+		if strings.Contains(string(clean), "evil.example") {
+			t.Errorf("sanitized svg still contains %q: %s", css, clean)
+		}
+	}
+
+	// Escapes that stay inside the document are fine.
+	clean, e := SanitizeSVG([]byte(`<svg><rect style="fill:\75rl(\23 g)"/></svg>`))
+	check(e)
+	assertEquals(t, `<svg><rect style="fill:\75rl(\23 g)"></rect></svg>`, string(clean))
+}
+
+func TestDecodeCSS(t *testing.T) {
+	for css, decoded := range map[string]string{
+		`\75rl(`:        "url(",
+		`\000075rl(`:    "url(",
+		`\75 rl(`:       "url(",
+		`\75  rl(`:      "u rl(",
+		`\"`:            `"`,
+		"a\\\nb":        "ab",
+		`a/* x */b/* y`: "ab",
+		`\0`:            "\uFFFD",
+		`\110000`:       "\uFFFD",
+		`trailing\`:     `trailing\`,
+		`fill: url(#g)`: "fill: url(#g)",
+	} {
+		assertEquals(t, decoded, decodeCSS(css))
+	}
+}
+
+func TestFetchIconDetailsSanitizesSVG(t *testing.T) {
+	b := newTestBesticon(map[string]testResponse{
+		"/icon.svg": {contentType: "image/svg+xml", body: []byte(`<svg viewBox="0 0 64 48"><script>alert(1)</script><rect width="64" height="48"/></svg>`)},
+	})
+
+	icon := b.fetchIconDetails(t.Context(), iconLink{URL: testSiteURL + "/icon.svg"})
+	check(icon.Error)
+	assertEquals(t, "svg", icon.Format)
+	assertEquals(t, 64, icon.Width)
+	assertEquals(t, 48, icon.Height)
+	assertEquals(t, `<svg viewBox="0 0 64 48"><rect width="64" height="48"></rect></svg>`, string(icon.ImageData))
+	assertEquals(t, len(icon.ImageData), icon.Bytes)
+	assertEquals(t, sha1Sum(icon.ImageData), icon.Sha1sum)
+}
+
+func TestRasterizedIconInSizeRange(t *testing.T) {
+	b := newTestBesticon(map[string]testResponse{
+		"/":         {contentType: "text/html", body: []byte(`<html><head><link rel="icon" href="/logo.svg"></head></html>`)},
+		"/logo.svg": {contentType: "image/svg+xml", body: []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 16 16"><rect width="16" height="16" fill="#f00"/></svg>`)},
+	})
+	finder := b.NewIconFinder()
+	finder.FormatsAllowed = []string{"png", "ico"}
+	_, e := finder.FetchIcons(testSiteURL)
+	check(e)
+	assertEquals(t, (*Icon)(nil), finder.IconInSizeRange(SizeRange{16, 48, 64}))
+
+	icon, e := finder.RasterizedIconInSizeRange(SizeRange{16, 48, 64})
+	check(e)
+	assertEquals(t, testSiteURL+"/logo.svg", icon.URL)
+	assertEquals(t, "png", icon.Format)
+	assertEquals(t, 48, icon.Width)
+	assertEquals(t, SourceLinkTag, icon.Provenance.Source)
+
+	img, e := icon.Image()
+	check(e)
+	assertEquals(t, image.Rect(0, 0, 48, 48), (*img).Bounds())
+	assertEquals(t, color.RGBA{255, 0, 0, 255}, color.RGBAModel.Convert((*img).At(24, 24)))
+
+	finder.FormatsAllowed = []string{"ico"}
+	icon, e = finder.RasterizedIconInSizeRange(SizeRange{16, 48, 64})
+	check(e)
+	assertEquals(t, (*Icon)(nil), icon)
+}
+
+func assertStringContains(t *testing.T, haystack string, needle string) {
+	t.Helper()
+	if !strings.Contains(haystack, needle) {
+		fail(t, "Expected '"+needle+"' to be contained in '"+haystack+"'")
+	}
+}
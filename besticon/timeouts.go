@@ -0,0 +1,90 @@
+package besticon
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts are the time budgets of lookups and their requests. Zero fields
+// take their value from DefaultTimeouts, NoTimeout means no limit.
+type Timeouts struct {
+	// Lookup bounds a whole lookup, fallbacks and retries included. Icons
+	// fetched by then are kept, the others are given up on.
+	Lookup time.Duration
+	// Page bounds fetching the HTML page of a site, for every attempt, and
+	// its manifest and browserconfig.xml.
+	Page time.Duration
+	// Icon bounds fetching each icon, so a slow one doesn't hold up the
+	// lookup. It also bounds requests made with Get and GetContext without
+	// a deadline of their own.
+	Icon time.Duration
+
+	// Dial, TLSHandshake and ResponseHeader bound connecting, the TLS
+	// handshake and waiting for the response headers of every request. They
+	// apply to transports from NewHTTPTransport.
+	Dial           time.Duration
+	TLSHandshake   time.Duration
+	ResponseHeader time.Duration
+}
+
+// NoTimeout lifts a limit of Timeouts.
+const NoTimeout time.Duration = -1
+
+// DefaultTimeouts are the timeouts used unless configured otherwise.
+var DefaultTimeouts = Timeouts{
+	Lookup:         15 * time.Second,
+	Page:           5 * time.Second,
+	Icon:           5 * time.Second,
+	Dial:           5 * time.Second,
+	TLSHandshake:   5 * time.Second,
+	ResponseHeader: 5 * time.Second,
+}
+
+type timeoutsOption struct {
+	timeouts Timeouts
+}
+
+func (t *timeoutsOption) applyOption(b *Besticon) {
+	timeouts := t.timeouts.withDefaults()
+	b.timeouts = &timeouts
+}
+
+// WithTimeouts sets the time budgets of lookups, DefaultTimeouts for the
+// fields left zero. The transport timeouts only apply to the default HTTP client,
+// clients passed to WithHTTPClient need a transport from NewHTTPTransport
+// for them.
+func WithTimeouts(t Timeouts) Option {
+	return &timeoutsOption{timeouts: t}
+}
+
+// withDefaults returns t with its zero fields taken from DefaultTimeouts.
+func (t Timeouts) withDefaults() Timeouts {
+	for _, d := range []struct{ field, fallback *time.Duration }{
+		{&t.Lookup, &DefaultTimeouts.Lookup},
+		{&t.Page, &DefaultTimeouts.Page},
+		{&t.Icon, &DefaultTimeouts.Icon},
+		{&t.Dial, &DefaultTimeouts.Dial},
+		{&t.TLSHandshake, &DefaultTimeouts.TLSHandshake},
+		{&t.ResponseHeader, &DefaultTimeouts.ResponseHeader},
+	} {
+		if *d.field == 0 {
+			*d.field = *d.fallback
+		}
+	}
+	return t
+}
+
+// limit returns d as the net and net/http packages take it, where 0 means
+// no limit.
+func limit(d time.Duration) time.Duration {
+	return max(d, 0)
+}
+
+// withTimeout is like context.WithTimeout, but without a deadline for
+// d <= 0.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
@@ -0,0 +1,179 @@
+package besticon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stallOn answers requests for the paths in slow only once they are
+// canceled, the others from responses.
+func stallOn(responses map[string]testResponse, slow ...string) roundTripperFunc {
+	respond := respondWith(responses)
+	return func(req *http.Request) (*http.Response, error) {
+		if includesString(slow, req.URL.Path) {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		return respond(req)
+	}
+}
+
+func TestIconTimeout(t *testing.T) {
+	responses := map[string]testResponse{
+		"/":            {body: []byte(`<html><head><link rel="icon" href="/slow.png"><link rel="icon" href="/favicon.ico"></head></html>`)},
+		"/favicon.ico": {body: mustReadFile("testdata/favicon.ico")},
+	}
+	b := newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: stallOn(responses, "/slow.png")}),
+		WithTimeouts(Timeouts{Lookup: time.Minute, Icon: 50 * time.Millisecond}))
+
+	start := time.Now()
+	icons, err := b.NewIconFinder().FetchIcons(testSiteURL)
+	check(err)
+	assertEquals(t, 1, len(icons))
+	assertEquals(t, testSiteURL+"/favicon.ico", icons[0].URL)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("lookup took %s", elapsed)
+	}
+}
+
+func TestLookupTimeoutKeepsFetchedIcons(t *testing.T) {
+	responses := map[string]testResponse{
+		"/":            {body: []byte(`<html><head><link rel="icon" href="/slow.png"><link rel="icon" href="/favicon.ico"></head></html>`)},
+		"/favicon.ico": {body: mustReadFile("testdata/favicon.ico")},
+	}
+	b := newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: stallOn(responses, "/slow.png")}),
+		WithTimeouts(Timeouts{Lookup: 100 * time.Millisecond}))
+
+	icons, err := b.NewIconFinder().FetchIcons(testSiteURL)
+	check(err)
+	assertEquals(t, 1, len(icons))
+	assertEquals(t, testSiteURL+"/favicon.ico", icons[0].URL)
+}
+
+func TestLookupTimeoutFetchingPage(t *testing.T) {
+	b := newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: stallOn(nil, "", "/")}),
+		WithTimeouts(Timeouts{Lookup: 50 * time.Millisecond}))
+
+	_, err := b.NewIconFinder().FetchIcons(testSiteURL)
+	assertEquals(t, CodeTimeout, ErrorCode(err))
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestPageTimeout(t *testing.T) {
+	responses := map[string]testResponse{
+		"/favicon.ico": {body: mustReadFile("testdata/favicon.ico")},
+	}
+	b := newTestBesticon(nil,
+		WithHTTPClient(&http.Client{Transport: stallOn(responses, "", "/")}),
+		WithTimeouts(Timeouts{Lookup: time.Minute, Page: 50 * time.Millisecond}))
+
+	finder := b.NewIconFinder()
+	icons, err := finder.FetchIcons(testSiteURL)
+	check(err)
+	assertEquals(t, []Attempt{{URL: testSiteURL, ErrorCode: CodeTimeout}}, finder.Attempts())
+	assertEquals(t, 1, len(icons))
+}
+
+func TestTransportTimeouts(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer site.Close()
+
+	b := New(
+		WithAddressPolicy(&AddressPolicy{}),
+		WithTimeouts(Timeouts{ResponseHeader: 50 * time.Millisecond}),
+		WithLogger(NewDefaultLogger(io.Discard)))
+
+	_, err := b.Get(site.URL)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestGetWithoutDeadlineUsesIconTimeout(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Send the headers, then trickle the body.
+		for range 20 {
+			w.Write([]byte("."))
+			http.NewResponseController(w).Flush()
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer site.Close()
+
+	b := New(
+		WithAddressPolicy(&AddressPolicy{}),
+		WithTimeouts(Timeouts{Icon: 50 * time.Millisecond}),
+		WithLogger(NewDefaultLogger(io.Discard)))
+
+	start := time.Now()
+	resp, err := b.Get(site.URL)
+	check(err)
+	_, err = b.GetBodyBytes(resp)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the body to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Get took %s", elapsed)
+	}
+
+	// A deadline of the caller's own takes precedence.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err = b.GetContext(ctx, site.URL)
+	check(err)
+	body, err := b.GetBodyBytes(resp)
+	check(err)
+	assertEquals(t, 20, len(body))
+}
+
+func TestWithTimeoutsKeepsDefaults(t *testing.T) {
+	b := New(WithTimeouts(Timeouts{Lookup: time.Minute, Icon: NoTimeout}))
+	expected := DefaultTimeouts
+	expected.Lookup, expected.Icon = time.Minute, NoTimeout
+	assertEquals(t, expected, *b.timeouts)
+
+	// Changing the defaults later doesn't change existing instances.
+	b = New()
+	previous := DefaultTimeouts
+	t.Cleanup(func() { DefaultTimeouts = previous })
+	DefaultTimeouts.Page = time.Hour
+	assertEquals(t, previous, *b.timeouts)
+}
+
+func TestNoTimeout(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer site.Close()
+
+	b := New(
+		WithAddressPolicy(&AddressPolicy{}),
+		WithTimeouts(Timeouts{Icon: NoTimeout, Dial: NoTimeout, TLSHandshake: NoTimeout, ResponseHeader: NoTimeout}),
+		WithLogger(NewDefaultLogger(io.Discard)))
+
+	resp, err := b.Get(site.URL)
+	check(err)
+	body, err := b.GetBodyBytes(resp)
+	check(err)
+	assertEquals(t, "slow", string(body))
+}
@@ -0,0 +1,58 @@
+package besticon
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/mat/besticon/v3/besticon"
+
+// Span attributes besides the OpenTelemetry semantic conventions.
+const (
+	attrCacheHit   = attribute.Key("besticon.cache.hit")
+	attrCacheStale = attribute.Key("besticon.cache.stale")
+	attrIconCount  = attribute.Key("besticon.icons")
+	attrIconFormat = attribute.Key("besticon.icon.format")
+	attrIconWidth  = attribute.Key("besticon.icon.width")
+	attrIconHeight = attribute.Key("besticon.icon.height")
+
+	attrURL        = attribute.Key("url.full")
+	attrStatusCode = attribute.Key("http.response.status_code")
+	attrBodySize   = attribute.Key("http.response.body.size")
+)
+
+type tracerProviderOption struct {
+	tp trace.TracerProvider
+}
+
+func (t *tracerProviderOption) applyOption(b *Besticon) {
+	b.tracer = t.tp.Tracer(tracerName)
+}
+
+// WithTracerProvider sets where the spans of lookups go, the global
+// OpenTelemetry tracer provider by default.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return &tracerProviderOption{tp: tp}
+}
+
+func (b *Besticon) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := b.tracer
+	if tracer == nil {
+		tracer = otel.Tracer(tracerName)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("error.type", ErrorCode(err)))
+	}
+	span.End()
+}
@@ -0,0 +1,74 @@
+package besticon
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	b := newTestBesticon(map[string]testResponse{
+		"/":            {body: []byte(`<html><head><link rel="icon" href="/missing.png"></head></html>`)},
+		"/favicon.ico": {body: mustReadFile("testdata/favicon.ico")},
+	}, WithCacheBackend(NewMemoryCache(1<<20)), WithTracerProvider(tp))
+
+	ctx, root := tp.Tracer("test").Start(context.Background(), "request")
+	_, err := b.NewIconFinder().FetchIconsContext(ctx, testSiteURL)
+	check(err)
+	root.End()
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = append(spans[s.Name()], s)
+	}
+	assertEquals(t, 1, len(spans["besticon.cache"]))
+	assertEquals(t, 1, len(spans["besticon.lookup"]))
+	assertEquals(t, 1, len(spans["besticon.fetchHTML"]))
+
+	details := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range spans["besticon.fetchIconDetails"] {
+		details[spanAttr(s, attrURL).AsString()] = s
+	}
+
+	cache := spans["besticon.cache"][0]
+	assertEquals(t, root.SpanContext().SpanID(), cache.Parent().SpanID())
+	assertEquals(t, false, spanAttr(cache, attrCacheHit).AsBool())
+	lookup := spans["besticon.lookup"][0]
+	assertEquals(t, cache.SpanContext().SpanID(), lookup.Parent().SpanID())
+	assertEquals(t, int64(1), spanAttr(lookup, attrIconCount).AsInt64())
+
+	html := spans["besticon.fetchHTML"][0]
+	assertEquals(t, lookup.SpanContext().SpanID(), html.Parent().SpanID())
+	assertEquals(t, int64(http.StatusOK), spanAttr(html, attrStatusCode).AsInt64())
+
+	favicon := details[testSiteURL+"/favicon.ico"]
+	assertEquals(t, lookup.SpanContext().SpanID(), favicon.Parent().SpanID())
+	assertEquals(t, "ico", spanAttr(favicon, attrIconFormat).AsString())
+	assertEquals(t, int64(len(mustReadFile("testdata/favicon.ico"))), spanAttr(favicon, attrBodySize).AsInt64())
+
+	missing := details[testSiteURL+"/missing.png"]
+	assertEquals(t, int64(http.StatusNotFound), spanAttr(missing, attrStatusCode).AsInt64())
+	assertEquals(t, "Error", missing.Status().Code.String())
+
+	// served from the cache
+	recorder = tracetest.NewSpanRecorder()
+	tp.RegisterSpanProcessor(recorder)
+	b.NewIconFinder().FetchIconsContext(context.Background(), testSiteURL)
+	assertEquals(t, 1, len(recorder.Ended()))
+	assertEquals(t, true, spanAttr(recorder.Ended()[0], attrCacheHit).AsBool())
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
@@ -22,6 +22,8 @@ import (
 	_ "image/png"
 
 	_ "github.com/mat/besticon/v3/ico"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
 )
 
 //lint:ignore U1000 unused main function
@@ -22,6 +22,8 @@ func TestImageFormats(t *testing.T) {
 	assertFindsRightColor(t, "white1x1.gif", "ffffff")
 	assertFindsRightColor(t, "white1x1.jpg", "ffffff")
 	assertFindsRightColor(t, "white1x1.png", "ffffff")
+	assertFindsRightColor(t, "white1x1.webp", "ffffff")
+	assertFindsRightColor(t, "white1x1.bmp", "ffffff")
 }
 
 func TestFindColors01(t *testing.T) {
@@ -46,6 +46,25 @@ func (dir *icondir) FindBestIcon() *icondirEntry {
 	return &best
 }
 
+// FindIconForSize returns the smallest entry at least size pixels wide and
+// high, so it can be scaled down to size nicely, or the largest one if
+// none is that big.
+func (dir *icondir) FindIconForSize(size int) *icondirEntry {
+	var best *icondirEntry
+	for i, e := range dir.Entries {
+		if e.width() < size || e.height() < size {
+			continue
+		}
+		if best == nil || e.width() < best.width() || (e.width() == best.width() && e.BitsPerPixel > best.BitsPerPixel) {
+			best = &dir.Entries[i]
+		}
+	}
+	if best == nil {
+		return dir.FindBestIcon()
+	}
+	return best
+}
+
 // ParseIco parses the icon and returns meta information for the icons as icondir.
 func ParseIco(r io.Reader) (*icondir, error) {
 	dir := icondir{}
@@ -181,6 +200,27 @@ func Decode(r io.Reader) (image.Image, error) {
 	return parseImage(best, icoBytes)
 }
 
+// DecodeSize is like Decode but returns the image best suited to be shown at
+// size x size pixels, see FindIconForSize.
+func DecodeSize(r io.Reader, size int) (image.Image, error) {
+	icoBytes, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ParseIco(bytes.NewReader(icoBytes))
+	if err != nil {
+		return nil, errInvalid
+	}
+
+	entry := dir.FindIconForSize(size)
+	if entry == nil {
+		return nil, errInvalid
+	}
+
+	return parseImage(entry, icoBytes)
+}
+
 func parseImage(entry *icondirEntry, icoBytes []byte) (image.Image, error) {
 	r := bytes.NewReader(icoBytes)
 	r.Seek(int64(entry.Offset), 0)
@@ -247,6 +287,47 @@ func makeFullBMPBytes(entry *icondirEntry, icoBytes []byte) (*bytes.Buffer, erro
 	return buf, nil
 }
 
+var errTooLarge = errors.New("ico: image larger than 256x256")
+
+// Encode writes m as an icon holding a single PNG image, which all current
+// browsers and Windows since Vista understand. Icons can't be larger than
+// 256x256 pixels.
+func Encode(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	if b.Dx() > 256 || b.Dy() > 256 {
+		return errTooLarge
+	}
+
+	var pngBytes bytes.Buffer
+	if err := png.Encode(&pngBytes, m); err != nil {
+		return err
+	}
+
+	dir := struct {
+		Reserved uint16
+		Type     uint16
+		Count    uint16
+		Entry    icondirEntry
+	}{
+		Type:  1,
+		Count: 1,
+		Entry: icondirEntry{
+			// 0 means 256
+			Width:        byte(b.Dx()),
+			Height:       byte(b.Dy()),
+			ColorPlanes:  1,
+			BitsPerPixel: 32,
+			Size:         uint32(pngBytes.Len()),
+			Offset:       6 + 16,
+		},
+	}
+	if err := binary.Write(w, binary.LittleEndian, &dir); err != nil {
+		return err
+	}
+	_, err := w.Write(pngBytes.Bytes())
+	return err
+}
+
 const icoHeader = "\x00\x00\x01\x00"
 
 func init() {
@@ -1,9 +1,11 @@
 package ico
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"os"
 	"reflect"
 	"testing"
@@ -35,6 +37,45 @@ func TestFindBestIcon(t *testing.T) {
 		best)
 }
 
+func TestFindIconForSize(t *testing.T) {
+	dir := mustParseIcoFile(t, "favicon.ico")
+	assertEquals(t, 0x20, int(dir.FindIconForSize(20).Width))
+	assertEquals(t, 0x10, int(dir.FindIconForSize(16).Width))
+	assertEquals(t, 0x30, int(dir.FindIconForSize(64).Width))
+}
+
+func TestDecodeSize(t *testing.T) {
+	f, err := os.Open("favicon.ico")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, err := DecodeSize(f, 32)
+	assertEquals(t, nil, err)
+	assertEquals(t, image.Rect(0, 0, 32, 32), img.Bounds())
+}
+
+func TestEncode(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	src.Set(3, 4, color.RGBA{0xff, 0, 0, 0xff})
+
+	var buf bytes.Buffer
+	assertEquals(t, nil, Encode(&buf, src))
+
+	dir, err := ParseIco(bytes.NewReader(buf.Bytes()))
+	assertEquals(t, nil, err)
+	assertEquals(t, uint16(1), dir.Count)
+
+	img, format, err := image.Decode(&buf)
+	assertEquals(t, nil, err)
+	assertEquals(t, "ico", format)
+	assertEquals(t, image.Rect(0, 0, 256, 256), img.Bounds())
+	assertEquals(t, color.RGBA{0xff, 0, 0, 0xff}, color.RGBAModel.Convert(img.At(3, 4)))
+
+	assertEquals(t, errTooLarge, Encode(&buf, image.NewRGBA(image.Rect(0, 0, 257, 16))))
+}
+
 func TestColorCount(t *testing.T) {
 	dir := mustParseIcoFile(t, "favicon.ico")
 	best := dir.FindBestIcon()
@@ -0,0 +1,161 @@
+package svgraster
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// cssRule is a rule from a <style> element. Only simple selectors like
+// "path", ".cls-1", "#logo" or "g.a.b" are supported, rules with
+// combinators, pseudo classes or attribute selectors are dropped.
+type cssRule struct {
+	selector     selector
+	declarations []declaration
+	order        int
+}
+
+type declaration struct {
+	property, value string
+}
+
+type selector struct {
+	tag     string
+	id      string
+	classes []string
+}
+
+func (s selector) specificity() int {
+	n := 0
+	if s.id != "" {
+		n += 10000
+	}
+	n += 100 * len(s.classes)
+	if s.tag != "" {
+		n++
+	}
+	return n
+}
+
+func (s selector) matches(n *node) bool {
+	if s.tag != "" && s.tag != n.name {
+		return false
+	}
+	if s.id != "" && s.id != n.attrs["id"] {
+		return false
+	}
+	classes := strings.Fields(n.attrs["class"])
+	for _, c := range s.classes {
+		if !slices.Contains(classes, c) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	cssCommentRe  = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssSelectorRe = regexp.MustCompile(`^(\*|[a-zA-Z][\w-]*)?((?:[.#][\w-]+)*)$`)
+	cssPartRe     = regexp.MustCompile(`[.#][\w-]+`)
+)
+
+// parseStylesheet parses the rules in css, numbering them from order on.
+func parseStylesheet(css string, order int) []cssRule {
+	css = cssCommentRe.ReplaceAllString(css, "")
+	css = strings.NewReplacer("<![CDATA[", "", "]]>", "").Replace(css)
+
+	var rules []cssRule
+	for {
+		open := strings.IndexByte(css, '{')
+		if open < 0 {
+			return rules
+		}
+		prelude := strings.TrimSpace(css[:open])
+		end := blockEnd(css, open)
+		body := css[open+1 : max(open+1, end-1)]
+		css = css[end:]
+
+		// at-rules like @media or @font-face are skipped as a whole
+		if strings.HasPrefix(prelude, "@") {
+			continue
+		}
+
+		declarations := parseDeclarations(body)
+		for _, sel := range strings.Split(prelude, ",") {
+			s, ok := parseSelector(strings.TrimSpace(sel))
+			if !ok {
+				continue
+			}
+			rules = append(rules, cssRule{selector: s, declarations: declarations, order: order})
+			order++
+		}
+	}
+}
+
+// blockEnd returns the index after the brace closing the block opened at
+// css[open].
+func blockEnd(css string, open int) int {
+	depth := 0
+	for i := open; i < len(css); i++ {
+		switch css[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(css)
+}
+
+func parseSelector(s string) (selector, bool) {
+	m := cssSelectorRe.FindStringSubmatch(s)
+	if m == nil || s == "" {
+		return selector{}, false
+	}
+
+	var sel selector
+	if m[1] != "*" {
+		sel.tag = m[1]
+	}
+	for _, part := range cssPartRe.FindAllString(m[2], -1) {
+		if part[0] == '#' {
+			sel.id = part[1:]
+		} else {
+			sel.classes = append(sel.classes, part[1:])
+		}
+	}
+	return sel, true
+}
+
+// sortRules orders rules by ascending specificity so that applying them in
+// order lets the more specific ones win.
+func sortRules(rules []cssRule) {
+	slices.SortStableFunc(rules, func(a, b cssRule) int {
+		if d := a.selector.specificity() - b.selector.specificity(); d != 0 {
+			return d
+		}
+		return a.order - b.order
+	})
+}
+
+// parseDeclarations parses a declaration block like the one in a style
+// attribute.
+func parseDeclarations(s string) []declaration {
+	var declarations []declaration
+	for _, d := range strings.Split(s, ";") {
+		property, value, ok := strings.Cut(d, ":")
+		if !ok {
+			continue
+		}
+		property = strings.ToLower(strings.TrimSpace(property))
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important"))
+		if property == "" || value == "" {
+			continue
+		}
+		declarations = append(declarations, declaration{property, value})
+	}
+	return declarations
+}
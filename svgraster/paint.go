@@ -0,0 +1,284 @@
+package svgraster
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// rgba is a non-premultiplied color with components in [0, 1].
+type rgba struct {
+	r, g, b, a float64
+}
+
+// painter returns the color at a pixel center in device space.
+type painter interface {
+	at(x, y float64) rgba
+}
+
+type solid rgba
+
+func (s solid) at(x, y float64) rgba {
+	return rgba(s)
+}
+
+// parseColor parses CSS color values: hex notations, rgb(), rgba(), hsl(),
+// hsla() and names.
+func parseColor(s string) (rgba, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if hex, ok := strings.CutPrefix(s, "#"); ok {
+		return parseHexColor(hex)
+	}
+	if name, args, ok := strings.Cut(s, "("); ok {
+		args, ok = strings.CutSuffix(strings.TrimSpace(args), ")")
+		if !ok {
+			return rgba{}, false
+		}
+		return parseColorFunction(strings.TrimSpace(name), args)
+	}
+	if s == "transparent" {
+		return rgba{}, true
+	}
+	if v, ok := namedColors[s]; ok {
+		return rgba{float64(v>>16) / 255, float64(v>>8&0xff) / 255, float64(v&0xff) / 255, 1}, true
+	}
+	return rgba{}, false
+}
+
+func parseHexColor(hex string) (rgba, bool) {
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return rgba{}, false
+	}
+
+	digit := func(shift uint) float64 { return float64(v>>shift&0xf) / 15 }
+	byte := func(shift uint) float64 { return float64(v>>shift&0xff) / 255 }
+	switch len(hex) {
+	case 3:
+		return rgba{digit(8), digit(4), digit(0), 1}, true
+	case 4:
+		return rgba{digit(12), digit(8), digit(4), digit(0)}, true
+	case 6:
+		return rgba{byte(16), byte(8), byte(0), 1}, true
+	case 8:
+		return rgba{byte(24), byte(16), byte(8), byte(0)}, true
+	}
+	return rgba{}, false
+}
+
+func parseColorFunction(name, args string) (rgba, bool) {
+	// both "1, 2, 3, 0.5" and "1 2 3 / 0.5" are valid
+	fields := strings.FieldsFunc(args, func(r rune) bool {
+		return r == ',' || r == '/' || r == ' ' || r == '\t' || r == '\n'
+	})
+	if len(fields) != 3 && len(fields) != 4 {
+		return rgba{}, false
+	}
+
+	alpha := 1.0
+	if len(fields) == 4 {
+		a, ok := parseFraction(fields[3], 1)
+		if !ok {
+			return rgba{}, false
+		}
+		alpha = a
+	}
+
+	switch name {
+	case "rgb", "rgba":
+		var c [3]float64
+		for i := range c {
+			v, ok := parseFraction(fields[i], 255)
+			if !ok {
+				return rgba{}, false
+			}
+			c[i] = v
+		}
+		return rgba{c[0], c[1], c[2], alpha}, true
+	case "hsl", "hsla":
+		h, err := strconv.ParseFloat(strings.TrimSuffix(fields[0], "deg"), 64)
+		sat, ok1 := parseFraction(fields[1], 100)
+		light, ok2 := parseFraction(fields[2], 100)
+		if err != nil || !ok1 || !ok2 {
+			return rgba{}, false
+		}
+		r, g, b := hslToRGB(h, sat, light)
+		return rgba{r, g, b, alpha}, true
+	}
+	return rgba{}, false
+}
+
+// parseFraction parses a number relative to scale, or a percentage, into
+// [0, 1].
+func parseFraction(s string, scale float64) (float64, bool) {
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		s, scale = pct, 100
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, false
+	}
+	return math.Max(0, math.Min(1, v/scale)), true
+}
+
+func hslToRGB(h, s, l float64) (float64, float64, float64) {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return r + m, g + m, b + m
+}
+
+type gradientStop struct {
+	offset float64
+	color  rgba
+}
+
+// gradient paints a linear or radial gradient. Coordinates are in gradient
+// space, which toGradient maps device pixels into.
+type gradient struct {
+	radial     bool
+	toGradient matrix
+	spread     string
+	stops      []gradientStop
+
+	x1, y1, x2, y2 float64 // linear
+	cx, cy, r      float64 // radial
+	fx, fy         float64
+}
+
+func (g *gradient) at(x, y float64) rgba {
+	p := g.toGradient.apply(point{x, y})
+
+	var t float64
+	if g.radial {
+		// find the circle between the focal point and the outer circle p
+		// lies on, see the canvas spec on radial gradients
+		d := point{p.x - g.fx, p.y - g.fy}
+		e := point{g.cx - g.fx, g.cy - g.fy}
+		a := e.dot(e) - g.r*g.r
+		de := d.dot(e)
+		if math.Abs(a) < 1e-12 {
+			t = d.dot(d) / (2 * de)
+		} else {
+			t = (de - math.Sqrt(math.Max(0, de*de-a*d.dot(d)))) / a
+		}
+	} else {
+		v := point{g.x2 - g.x1, g.y2 - g.y1}
+		t = point{p.x - g.x1, p.y - g.y1}.dot(v) / v.dot(v)
+	}
+	if math.IsNaN(t) || math.IsInf(t, 0) {
+		t = 1
+	}
+
+	switch g.spread {
+	case "repeat":
+		t -= math.Floor(t)
+	case "reflect":
+		t = math.Mod(math.Abs(t), 2)
+		if t > 1 {
+			t = 2 - t
+		}
+	default:
+		t = math.Max(0, math.Min(1, t))
+	}
+	return g.colorAt(t)
+}
+
+func (g *gradient) colorAt(t float64) rgba {
+	first, last := g.stops[0], g.stops[len(g.stops)-1]
+	if t <= first.offset {
+		return first.color
+	}
+	for i := 1; i < len(g.stops); i++ {
+		a, b := g.stops[i-1], g.stops[i]
+		if t > b.offset {
+			continue
+		}
+		if b.offset == a.offset {
+			return b.color
+		}
+		f := (t - a.offset) / (b.offset - a.offset)
+		return rgba{
+			a.color.r + (b.color.r-a.color.r)*f,
+			a.color.g + (b.color.g-a.color.g)*f,
+			a.color.b + (b.color.b-a.color.b)*f,
+			a.color.a + (b.color.a-a.color.a)*f,
+		}
+	}
+	return last.color
+}
+
+// CSS named colors.
+var namedColors = map[string]uint32{
+	"aliceblue": 0xf0f8ff, "antiquewhite": 0xfaebd7, "aqua": 0x00ffff,
+	"aquamarine": 0x7fffd4, "azure": 0xf0ffff, "beige": 0xf5f5dc,
+	"bisque": 0xffe4c4, "black": 0x000000, "blanchedalmond": 0xffebcd,
+	"blue": 0x0000ff, "blueviolet": 0x8a2be2, "brown": 0xa52a2a,
+	"burlywood": 0xdeb887, "cadetblue": 0x5f9ea0, "chartreuse": 0x7fff00,
+	"chocolate": 0xd2691e, "coral": 0xff7f50, "cornflowerblue": 0x6495ed,
+	"cornsilk": 0xfff8dc, "crimson": 0xdc143c, "cyan": 0x00ffff,
+	"darkblue": 0x00008b, "darkcyan": 0x008b8b, "darkgoldenrod": 0xb8860b,
+	"darkgray": 0xa9a9a9, "darkgreen": 0x006400, "darkgrey": 0xa9a9a9,
+	"darkkhaki": 0xbdb76b, "darkmagenta": 0x8b008b, "darkolivegreen": 0x556b2f,
+	"darkorange": 0xff8c00, "darkorchid": 0x9932cc, "darkred": 0x8b0000,
+	"darksalmon": 0xe9967a, "darkseagreen": 0x8fbc8f, "darkslateblue": 0x483d8b,
+	"darkslategray": 0x2f4f4f, "darkslategrey": 0x2f4f4f, "darkturquoise": 0x00ced1,
+	"darkviolet": 0x9400d3, "deeppink": 0xff1493, "deepskyblue": 0x00bfff,
+	"dimgray": 0x696969, "dimgrey": 0x696969, "dodgerblue": 0x1e90ff,
+	"firebrick": 0xb22222, "floralwhite": 0xfffaf0, "forestgreen": 0x228b22,
+	"fuchsia": 0xff00ff, "gainsboro": 0xdcdcdc, "ghostwhite": 0xf8f8ff,
+	"gold": 0xffd700, "goldenrod": 0xdaa520, "gray": 0x808080,
+	"green": 0x008000, "greenyellow": 0xadff2f, "grey": 0x808080,
+	"honeydew": 0xf0fff0, "hotpink": 0xff69b4, "indianred": 0xcd5c5c,
+	"indigo": 0x4b0082, "ivory": 0xfffff0, "khaki": 0xf0e68c,
+	"lavender": 0xe6e6fa, "lavenderblush": 0xfff0f5, "lawngreen": 0x7cfc00,
+	"lemonchiffon": 0xfffacd, "lightblue": 0xadd8e6, "lightcoral": 0xf08080,
+	"lightcyan": 0xe0ffff, "lightgoldenrodyellow": 0xfafad2, "lightgray": 0xd3d3d3,
+	"lightgreen": 0x90ee90, "lightgrey": 0xd3d3d3, "lightpink": 0xffb6c1,
+	"lightsalmon": 0xffa07a, "lightseagreen": 0x20b2aa, "lightskyblue": 0x87cefa,
+	"lightslategray": 0x778899, "lightslategrey": 0x778899, "lightsteelblue": 0xb0c4de,
+	"lightyellow": 0xffffe0, "lime": 0x00ff00, "limegreen": 0x32cd32,
+	"linen": 0xfaf0e6, "magenta": 0xff00ff, "maroon": 0x800000,
+	"mediumaquamarine": 0x66cdaa, "mediumblue": 0x0000cd, "mediumorchid": 0xba55d3,
+	"mediumpurple": 0x9370db, "mediumseagreen": 0x3cb371, "mediumslateblue": 0x7b68ee,
+	"mediumspringgreen": 0x00fa9a, "mediumturquoise": 0x48d1cc, "mediumvioletred": 0xc71585,
+	"midnightblue": 0x191970, "mintcream": 0xf5fffa, "mistyrose": 0xffe4e1,
+	"moccasin": 0xffe4b5, "navajowhite": 0xffdead, "navy": 0x000080,
+	"oldlace": 0xfdf5e6, "olive": 0x808000, "olivedrab": 0x6b8e23,
+	"orange": 0xffa500, "orangered": 0xff4500, "orchid": 0xda70d6,
+	"palegoldenrod": 0xeee8aa, "palegreen": 0x98fb98, "paleturquoise": 0xafeeee,
+	"palevioletred": 0xdb7093, "papayawhip": 0xffefd5, "peachpuff": 0xffdab9,
+	"peru": 0xcd853f, "pink": 0xffc0cb, "plum": 0xdda0dd,
+	"powderblue": 0xb0e0e6, "purple": 0x800080, "rebeccapurple": 0x663399,
+	"red": 0xff0000, "rosybrown": 0xbc8f8f, "royalblue": 0x4169e1,
+	"saddlebrown": 0x8b4513, "salmon": 0xfa8072, "sandybrown": 0xf4a460,
+	"seagreen": 0x2e8b57, "seashell": 0xfff5ee, "sienna": 0xa0522d,
+	"silver": 0xc0c0c0, "skyblue": 0x87ceeb, "slateblue": 0x6a5acd,
+	"slategray": 0x708090, "slategrey": 0x708090, "snow": 0xfffafa,
+	"springgreen": 0x00ff7f, "steelblue": 0x4682b4, "tan": 0xd2b48c,
+	"teal": 0x008080, "thistle": 0xd8bfd8, "tomato": 0xff6347,
+	"turquoise": 0x40e0d0, "violet": 0xee82ee, "wheat": 0xf5deb3,
+	"white": 0xffffff, "whitesmoke": 0xf5f5f5, "yellow": 0xffff00,
+	"yellowgreen": 0x9acd32,
+}
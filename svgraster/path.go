@@ -0,0 +1,471 @@
+package svgraster
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+type point struct {
+	x, y float64
+}
+
+func (p point) add(q point) point             { return point{p.x + q.x, p.y + q.y} }
+func (p point) sub(q point) point             { return point{p.x - q.x, p.y - q.y} }
+func (p point) mul(f float64) point           { return point{p.x * f, p.y * f} }
+func (p point) dot(q point) float64           { return p.x*q.x + p.y*q.y }
+func (p point) cross(q point) float64         { return p.x*q.y - p.y*q.x }
+func (p point) length() float64               { return math.Hypot(p.x, p.y) }
+func (p point) lerp(q point, t float64) point { return p.add(q.sub(p).mul(t)) }
+
+// subpath is a flattened sequence of connected line segments.
+type subpath struct {
+	points []point
+	closed bool
+}
+
+// path collects subpaths in user space, flattening curves on the way.
+type path struct {
+	subpaths []subpath
+
+	// tolerance is the maximum distance in user units between a curve and
+	// the line segments approximating it.
+	tolerance float64
+}
+
+func (p *path) moveTo(pt point) {
+	p.subpaths = append(p.subpaths, subpath{points: []point{pt}})
+}
+
+func (p *path) lineTo(pt point) {
+	if len(p.subpaths) == 0 {
+		p.moveTo(point{})
+	}
+	sp := &p.subpaths[len(p.subpaths)-1]
+	if sp.closed {
+		// drawing on after "Z" starts a new subpath at the old start
+		p.moveTo(sp.points[0])
+		sp = &p.subpaths[len(p.subpaths)-1]
+	}
+	sp.points = append(sp.points, pt)
+}
+
+func (p *path) close() {
+	if len(p.subpaths) > 0 {
+		p.subpaths[len(p.subpaths)-1].closed = true
+	}
+}
+
+func (p *path) current() point {
+	if len(p.subpaths) == 0 {
+		return point{}
+	}
+	sp := p.subpaths[len(p.subpaths)-1]
+	if sp.closed {
+		return sp.points[0]
+	}
+	return sp.points[len(sp.points)-1]
+}
+
+// segments returns how many lines approximate a curve whose control polygon
+// bends by dd, see Wang's formula.
+func (p *path) segments(dd, factor float64) int {
+	n := math.Ceil(math.Sqrt(factor * dd / p.tolerance))
+	if math.IsNaN(n) || n < 1 {
+		return 1
+	}
+	return int(min(n, 1000))
+}
+
+func (p *path) quadTo(c, end point) {
+	start := p.current()
+	dd := start.sub(c.mul(2)).add(end).length()
+	n := p.segments(dd, 0.25)
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		p.lineTo(start.lerp(c, t).lerp(c.lerp(end, t), t))
+	}
+}
+
+func (p *path) cubicTo(c1, c2, end point) {
+	start := p.current()
+	dd := max(start.sub(c1.mul(2)).add(c2).length(), c1.sub(c2.mul(2)).add(end).length())
+	n := p.segments(dd, 0.75)
+	for i := 1; i <= n; i++ {
+		t := float64(i) / float64(n)
+		a, b, c := start.lerp(c1, t), c1.lerp(c2, t), c2.lerp(end, t)
+		d, e := a.lerp(b, t), b.lerp(c, t)
+		p.lineTo(d.lerp(e, t))
+	}
+}
+
+// ellipticArc continues the path along the ellipse around (cx, cy) rotated
+// by phi radians, from angle theta by delta radians. The current point must
+// be the start of the arc.
+func (p *path) ellipticArc(cx, cy, rx, ry, phi, theta, delta float64) {
+	sinPhi, cosPhi := math.Sincos(phi)
+	at := func(t float64) (point, point) {
+		sin, cos := math.Sincos(t)
+		pt := point{cx + rx*cos*cosPhi - ry*sin*sinPhi, cy + rx*cos*sinPhi + ry*sin*cosPhi}
+		deriv := point{-rx*sin*cosPhi - ry*cos*sinPhi, -rx*sin*sinPhi + ry*cos*cosPhi}
+		return pt, deriv
+	}
+
+	n := int(math.Ceil(math.Abs(delta) / (math.Pi / 2)))
+	step := delta / float64(n)
+	k := 4.0 / 3 * math.Tan(step/4)
+	for i := range n {
+		p0, d0 := at(theta + float64(i)*step)
+		p1, d1 := at(theta + float64(i+1)*step)
+		p.cubicTo(p0.add(d0.mul(k)), p1.sub(d1.mul(k)), p1)
+	}
+}
+
+// arcTo implements the "A" path command, see "Elliptical arc
+// implementation notes" in the SVG spec.
+func (p *path) arcTo(rx, ry, angle float64, large, sweep bool, end point) {
+	start := p.current()
+	if start == end {
+		return
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		p.lineTo(end)
+		return
+	}
+
+	phi := angle * math.Pi / 180
+	sinPhi, cosPhi := math.Sincos(phi)
+	dx, dy := (start.x-end.x)/2, (start.y-end.y)/2
+	x1 := cosPhi*dx + sinPhi*dy
+	y1 := -sinPhi*dx + cosPhi*dy
+
+	if lambda := x1*x1/(rx*rx) + y1*y1/(ry*ry); lambda > 1 {
+		rx *= math.Sqrt(lambda)
+		ry *= math.Sqrt(lambda)
+	}
+
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := math.Sqrt(max(0, num/den))
+	if large == sweep {
+		coef = -coef
+	}
+	cx1 := coef * rx * y1 / ry
+	cy1 := -coef * ry * x1 / rx
+
+	cx := cosPhi*cx1 - sinPhi*cy1 + (start.x+end.x)/2
+	cy := sinPhi*cx1 + cosPhi*cy1 + (start.y+end.y)/2
+
+	u := point{(x1 - cx1) / rx, (y1 - cy1) / ry}
+	v := point{(-x1 - cx1) / rx, (-y1 - cy1) / ry}
+	theta := math.Atan2(u.y, u.x)
+	delta := math.Atan2(u.cross(v), u.dot(v))
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+
+	p.ellipticArc(cx, cy, rx, ry, phi, theta, delta)
+}
+
+func (p *path) ellipse(cx, cy, rx, ry float64) {
+	p.moveTo(point{cx + rx, cy})
+	p.ellipticArc(cx, cy, rx, ry, 0, 0, 2*math.Pi)
+	p.close()
+}
+
+func (p *path) rect(x, y, w, h, rx, ry float64) {
+	if rx <= 0 || ry <= 0 {
+		p.moveTo(point{x, y})
+		p.lineTo(point{x + w, y})
+		p.lineTo(point{x + w, y + h})
+		p.lineTo(point{x, y + h})
+		p.close()
+		return
+	}
+
+	rx, ry = min(rx, w/2), min(ry, h/2)
+	p.moveTo(point{x + rx, y})
+	p.lineTo(point{x + w - rx, y})
+	p.ellipticArc(x+w-rx, y+ry, rx, ry, 0, -math.Pi/2, math.Pi/2)
+	p.lineTo(point{x + w, y + h - ry})
+	p.ellipticArc(x+w-rx, y+h-ry, rx, ry, 0, 0, math.Pi/2)
+	p.lineTo(point{x + rx, y + h})
+	p.ellipticArc(x+rx, y+h-ry, rx, ry, 0, math.Pi/2, math.Pi/2)
+	p.lineTo(point{x, y + ry})
+	p.ellipticArc(x+rx, y+ry, rx, ry, 0, math.Pi, math.Pi/2)
+	p.close()
+}
+
+func (p *path) bounds() (min, max point) {
+	first := true
+	for _, sp := range p.subpaths {
+		for _, pt := range sp.points {
+			if first {
+				min, max = pt, pt
+				first = false
+				continue
+			}
+			min.x, min.y = math.Min(min.x, pt.x), math.Min(min.y, pt.y)
+			max.x, max.y = math.Max(max.x, pt.x), math.Max(max.y, pt.y)
+		}
+	}
+	return min, max
+}
+
+// parsePathData appends the path described by d to p. Like browsers we
+// render everything up to the first error.
+func parsePathData(d string, p *path) {
+	s := &scanner{s: d}
+	var cmd byte
+	var lastControl point
+	var lastCmd byte
+	for {
+		s.skipSeparators()
+		if s.done() {
+			return
+		}
+		if c := s.s[s.pos]; strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) >= 0 {
+			cmd = c
+			s.pos++
+		} else if cmd == 0 || cmd == 'Z' || cmd == 'z' {
+			return
+		}
+
+		cur := p.current()
+		rel := func(pt point) point {
+			if cmd >= 'a' {
+				return pt.add(cur)
+			}
+			return pt
+		}
+
+		var ok bool
+		switch cmd {
+		case 'M', 'm':
+			var pt point
+			if pt, ok = s.point(); ok {
+				pt = rel(pt)
+				p.moveTo(pt)
+				// further coordinates are implicit "L" commands, M-1 == L
+				cmd--
+			}
+		case 'L', 'l':
+			var pt point
+			if pt, ok = s.point(); ok {
+				p.lineTo(rel(pt))
+			}
+		case 'H', 'h':
+			var x float64
+			if x, ok = s.number(); ok {
+				if cmd == 'h' {
+					x += cur.x
+				}
+				p.lineTo(point{x, cur.y})
+			}
+		case 'V', 'v':
+			var y float64
+			if y, ok = s.number(); ok {
+				if cmd == 'v' {
+					y += cur.y
+				}
+				p.lineTo(point{cur.x, y})
+			}
+		case 'C', 'c':
+			var c1, c2, end point
+			if c1, c2, end, ok = s.threePoints(); ok {
+				p.cubicTo(rel(c1), rel(c2), rel(end))
+				lastControl = rel(c2)
+			}
+		case 'S', 's':
+			var c2, end point
+			if c2, end, ok = s.twoPoints(); ok {
+				c1 := cur
+				if lastCmd == 'C' || lastCmd == 'S' {
+					c1 = cur.mul(2).sub(lastControl)
+				}
+				p.cubicTo(c1, rel(c2), rel(end))
+				lastControl = rel(c2)
+			}
+		case 'Q', 'q':
+			var c, end point
+			if c, end, ok = s.twoPoints(); ok {
+				p.quadTo(rel(c), rel(end))
+				lastControl = rel(c)
+			}
+		case 'T', 't':
+			var end point
+			if end, ok = s.point(); ok {
+				c := cur
+				if lastCmd == 'Q' || lastCmd == 'T' {
+					c = cur.mul(2).sub(lastControl)
+				}
+				p.quadTo(c, rel(end))
+				lastControl = c
+			}
+		case 'A', 'a':
+			var rx, ry, angle, large, sweep float64
+			var end point
+			rx, ok = s.number()
+			ok = ok && s.numberInto(&ry) && s.numberInto(&angle) && s.flagInto(&large) && s.flagInto(&sweep)
+			if ok {
+				end, ok = s.point()
+			}
+			if ok {
+				p.arcTo(rx, ry, angle, large == 1, sweep == 1, rel(end))
+			}
+		case 'Z', 'z':
+			p.close()
+			ok = true
+		}
+		if !ok {
+			return
+		}
+		lastCmd = cmd &^ 0x20 // upper case
+	}
+}
+
+// scanner reads numbers from path data and attribute lists, where
+// separators are optional as long as the numbers stay unambiguous:
+// "M1.5.5-2" is M 1.5 0.5 -2.
+type scanner struct {
+	s   string
+	pos int
+}
+
+func (s *scanner) done() bool {
+	return s.pos >= len(s.s)
+}
+
+func (s *scanner) skipSeparators() {
+	comma := false
+	for !s.done() {
+		switch c := s.s[s.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+		case c == ',' && !comma:
+			comma = true
+		default:
+			return
+		}
+		s.pos++
+	}
+}
+
+func (s *scanner) number() (float64, bool) {
+	s.skipSeparators()
+	start := s.pos
+	if !s.done() && (s.s[s.pos] == '+' || s.s[s.pos] == '-') {
+		s.pos++
+	}
+	digits := s.digits()
+	if !s.done() && s.s[s.pos] == '.' {
+		s.pos++
+		digits += s.digits()
+	}
+	if digits == 0 {
+		s.pos = start
+		return 0, false
+	}
+	if !s.done() && (s.s[s.pos] == 'e' || s.s[s.pos] == 'E') {
+		mark := s.pos
+		s.pos++
+		if !s.done() && (s.s[s.pos] == '+' || s.s[s.pos] == '-') {
+			s.pos++
+		}
+		if s.digits() == 0 {
+			// not an exponent after all
+			s.pos = mark
+		}
+	}
+	f, err := strconv.ParseFloat(s.s[start:s.pos], 64)
+	if err != nil || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+func (s *scanner) digits() int {
+	n := 0
+	for !s.done() && s.s[s.pos] >= '0' && s.s[s.pos] <= '9' {
+		s.pos++
+		n++
+	}
+	return n
+}
+
+func (s *scanner) numberInto(f *float64) bool {
+	var ok bool
+	*f, ok = s.number()
+	return ok
+}
+
+// flagInto reads an arc flag, which may be written without separator as in
+// "a1 1 0 00.5.5".
+func (s *scanner) flagInto(f *float64) bool {
+	s.skipSeparators()
+	if s.done() || (s.s[s.pos] != '0' && s.s[s.pos] != '1') {
+		return false
+	}
+	*f = float64(s.s[s.pos] - '0')
+	s.pos++
+	return true
+}
+
+func (s *scanner) point() (point, bool) {
+	x, ok1 := s.number()
+	if !ok1 {
+		return point{}, false
+	}
+	y, ok2 := s.number()
+	return point{x, y}, ok2
+}
+
+func (s *scanner) twoPoints() (point, point, bool) {
+	a, ok1 := s.point()
+	if !ok1 {
+		return a, point{}, false
+	}
+	b, ok2 := s.point()
+	return a, b, ok2
+}
+
+func (s *scanner) threePoints() (point, point, point, bool) {
+	a, b, ok1 := s.twoPoints()
+	if !ok1 {
+		return a, b, point{}, false
+	}
+	c, ok2 := s.point()
+	return a, b, c, ok2
+}
+
+// parseNumbers parses a whitespace and/or comma separated list of numbers.
+func parseNumbers(str string) ([]float64, bool) {
+	s := &scanner{s: str}
+	var numbers []float64
+	for {
+		if strings.TrimSpace(s.s[s.pos:]) == "" {
+			return numbers, true
+		}
+		f, ok := s.number()
+		if !ok {
+			return nil, false
+		}
+		numbers = append(numbers, f)
+	}
+}
+
+// parsePoints parses the points attribute of polylines and polygons. An
+// odd number of coordinates drops the last one.
+func parsePoints(str string) []point {
+	s := &scanner{s: str}
+	var points []point
+	for {
+		pt, ok := s.point()
+		if !ok {
+			return points
+		}
+		points = append(points, pt)
+	}
+}
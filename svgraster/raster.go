@@ -0,0 +1,329 @@
+package svgraster
+
+import (
+	"image"
+	"math"
+	"slices"
+)
+
+// Subsamples per pixel row. Horizontal coverage is computed exactly.
+const subsamples = 16
+
+// canvas is a premultiplied floating point RGBA bitmap.
+type canvas struct {
+	width, height int
+	pix           []float32
+}
+
+func newCanvas(width, height int) *canvas {
+	return &canvas{width: width, height: height, pix: make([]float32, 4*width*height)}
+}
+
+// composite draws layer onto c with the given opacity.
+func (c *canvas) composite(layer *canvas, opacity float64) {
+	o := float32(opacity)
+	for i := 0; i < len(c.pix); i += 4 {
+		sa := layer.pix[i+3] * o
+		if sa == 0 {
+			continue
+		}
+		for j := range 4 {
+			c.pix[i+j] = layer.pix[i+j]*o + c.pix[i+j]*(1-sa)
+		}
+	}
+}
+
+func (c *canvas) image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, c.width, c.height))
+	for i, v := range c.pix {
+		img.Pix[i] = uint8(math.Round(float64(min(max(v, 0), 1)) * 255))
+	}
+	return img
+}
+
+type edge struct {
+	x0, y0, x1, y1 float64
+	dir            int
+}
+
+type crossing struct {
+	x   float64
+	dir int
+}
+
+// fill paints the area enclosed by the polygons, given in device space,
+// according to the nonzero or evenodd fill rule.
+func (c *canvas) fill(polygons [][]point, evenOdd bool, p painter, opacity float64) {
+	var edges []edge
+	ymax := 0.0
+	for _, poly := range polygons {
+		for i := range poly {
+			a, b := poly[i], poly[(i+1)%len(poly)]
+			if a.y == b.y || math.IsNaN(a.x+a.y+b.x+b.y) {
+				continue
+			}
+			dir := 1
+			if a.y > b.y {
+				a, b, dir = b, a, -1
+			}
+			edges = append(edges, edge{a.x, a.y, b.x, b.y, dir})
+			ymax = max(ymax, b.y)
+		}
+	}
+	if len(edges) == 0 {
+		return
+	}
+	slices.SortFunc(edges, func(a, b edge) int {
+		switch {
+		case a.y0 < b.y0:
+			return -1
+		case a.y0 > b.y0:
+			return 1
+		}
+		return 0
+	})
+
+	inside := func(winding int) bool {
+		if evenOdd {
+			return winding%2 != 0
+		}
+		return winding != 0
+	}
+
+	coverage := make([]float32, c.width+1)
+	var active []*edge
+	var crossings []crossing
+	next := 0
+	top := max(0, int(math.Floor(edges[0].y0)))
+	bottom := min(c.height, int(math.Ceil(ymax)))
+	for py := top; py < bottom; py++ {
+		clear(coverage)
+		left, right := c.width, 0
+		for k := range subsamples {
+			sy := float64(py) + (float64(k)+0.5)/subsamples
+			for next < len(edges) && edges[next].y0 <= sy {
+				active = append(active, &edges[next])
+				next++
+			}
+
+			crossings = crossings[:0]
+			n := 0
+			for _, e := range active {
+				if e.y1 <= sy {
+					continue
+				}
+				active[n] = e
+				n++
+				crossings = append(crossings, crossing{e.x0 + (sy-e.y0)*(e.x1-e.x0)/(e.y1-e.y0), e.dir})
+			}
+			active = active[:n]
+			slices.SortFunc(crossings, func(a, b crossing) int {
+				switch {
+				case a.x < b.x:
+					return -1
+				case a.x > b.x:
+					return 1
+				}
+				return 0
+			})
+
+			winding := 0
+			var spanStart float64
+			for _, cr := range crossings {
+				was := inside(winding)
+				winding += cr.dir
+				switch is := inside(winding); {
+				case !was && is:
+					spanStart = cr.x
+				case was && !is:
+					l, r := addSpan(coverage[:c.width], spanStart, cr.x, 1.0/subsamples)
+					left, right = min(left, l), max(right, r)
+				}
+			}
+		}
+
+		for px := left; px < right; px++ {
+			cov := min(coverage[px], 1)
+			if cov <= 0 {
+				continue
+			}
+			col := p.at(float64(px)+0.5, float64(py)+0.5)
+			sa := float32(col.a*opacity) * cov
+			i := 4 * (py*c.width + px)
+			c.pix[i] = float32(col.r)*sa + c.pix[i]*(1-sa)
+			c.pix[i+1] = float32(col.g)*sa + c.pix[i+1]*(1-sa)
+			c.pix[i+2] = float32(col.b)*sa + c.pix[i+2]*(1-sa)
+			c.pix[i+3] = sa + c.pix[i+3]*(1-sa)
+		}
+	}
+}
+
+// addSpan adds amount to the coverage of [x0, x1), partially covered pixels
+// get their share. It returns the range of pixels touched.
+func addSpan(coverage []float32, x0, x1 float64, amount float32) (int, int) {
+	x0 = max(x0, 0)
+	x1 = min(x1, float64(len(coverage)))
+	if x1 <= x0 {
+		return len(coverage), 0
+	}
+
+	i0, i1 := int(x0), int(x1)
+	if i0 == i1 {
+		coverage[i0] += float32(x1-x0) * amount
+		return i0, i0 + 1
+	}
+	coverage[i0] += float32(float64(i0+1)-x0) * amount
+	for i := i0 + 1; i < i1; i++ {
+		coverage[i] += amount
+	}
+	if i1 < len(coverage) {
+		coverage[i1] += float32(x1-float64(i1)) * amount
+		return i0, i1 + 1
+	}
+	return i0, i1
+}
+
+type strokeStyle struct {
+	width      float64
+	cap, join  string
+	miterLimit float64
+}
+
+// strokePolygons outlines the subpaths as a set of equally oriented
+// polygons, one per segment, join and cap, to be filled with the nonzero
+// rule. tolerance is the maximum error for round joins and caps.
+func strokePolygons(subpaths []subpath, st strokeStyle, tolerance float64) [][]point {
+	hw := st.width / 2
+	var polys [][]point
+	add := func(poly ...point) {
+		if polygonArea(poly) < 0 {
+			slices.Reverse(poly)
+		}
+		polys = append(polys, poly)
+	}
+	circle := func(c point) {
+		n := 8
+		if tolerance < hw {
+			n = max(n, int(math.Ceil(math.Pi/math.Acos(1-tolerance/hw))))
+		}
+		n = min(n, 256)
+		poly := make([]point, n)
+		for i := range poly {
+			sin, cos := math.Sincos(2 * math.Pi * float64(i) / float64(n))
+			poly[i] = point{c.x + hw*cos, c.y + hw*sin}
+		}
+		add(poly...)
+	}
+
+	for _, sp := range subpaths {
+		pts := dedupe(sp.points, sp.closed)
+		if len(pts) == 1 {
+			// zero length subpaths only show their caps
+			switch st.cap {
+			case "round":
+				circle(pts[0])
+			case "square":
+				p := pts[0]
+				add(point{p.x - hw, p.y - hw}, point{p.x + hw, p.y - hw}, point{p.x + hw, p.y + hw}, point{p.x - hw, p.y + hw})
+			}
+			continue
+		}
+
+		n := len(pts) - 1
+		if sp.closed {
+			n = len(pts)
+		}
+		dirs := make([]point, n)
+		for i := range n {
+			a, b := pts[i], pts[(i+1)%len(pts)]
+			d := b.sub(a)
+			d = d.mul(1 / d.length())
+			dirs[i] = d
+			normal := point{-d.y, d.x}.mul(hw)
+			add(a.add(normal), b.add(normal), b.sub(normal), a.sub(normal))
+		}
+
+		for i := range n {
+			if !sp.closed && i == 0 {
+				continue
+			}
+			prev := (i - 1 + n) % n
+			joinPolygon(pts[i], dirs[prev], dirs[i], hw, st, add, circle)
+		}
+
+		if !sp.closed {
+			first, last := pts[0], pts[len(pts)-1]
+			switch st.cap {
+			case "round":
+				circle(first)
+				circle(last)
+			case "square":
+				capSquare(first, dirs[0].mul(-1), hw, add)
+				capSquare(last, dirs[n-1], hw, add)
+			}
+		}
+	}
+	return polys
+}
+
+func joinPolygon(v, in, out point, hw float64, st strokeStyle, add func(...point), circle func(point)) {
+	cross := in.cross(out)
+	if math.Abs(cross) < 1e-9 && in.dot(out) > 0 {
+		return
+	}
+	if st.join == "round" {
+		circle(v)
+		return
+	}
+
+	side := 1.0
+	if cross > 0 {
+		side = -1
+	}
+	n0 := point{-in.y, in.x}.mul(side)
+	n1 := point{-out.y, out.x}.mul(side)
+	o0, o1 := v.add(n0.mul(hw)), v.add(n1.mul(hw))
+
+	if st.join != "bevel" {
+		m := n0.add(n1)
+		if l := m.length(); l > 1e-9 {
+			m = m.mul(1 / l)
+			cosHalf := m.dot(n0)
+			if cosHalf > 1e-9 && 1/cosHalf <= st.miterLimit {
+				add(v, o0, v.add(m.mul(hw/cosHalf)), o1)
+				return
+			}
+		}
+	}
+	add(v, o0, o1)
+}
+
+func capSquare(p, dir point, hw float64, add func(...point)) {
+	normal := point{-dir.y, dir.x}.mul(hw)
+	end := p.add(dir.mul(hw))
+	add(p.add(normal), end.add(normal), end.sub(normal), p.sub(normal))
+}
+
+// dedupe drops consecutive duplicate points, including a closing point that
+// repeats the start of a closed subpath.
+func dedupe(points []point, closed bool) []point {
+	out := make([]point, 0, len(points))
+	for _, p := range points {
+		if len(out) > 0 && out[len(out)-1].sub(p).length() < 1e-9 {
+			continue
+		}
+		out = append(out, p)
+	}
+	if closed && len(out) > 1 && out[0].sub(out[len(out)-1]).length() < 1e-9 {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+func polygonArea(poly []point) float64 {
+	area := 0.0
+	for i := range poly {
+		area += poly[i].cross(poly[(i+1)%len(poly)])
+	}
+	return area / 2
+}
@@ -0,0 +1,770 @@
+// Package svgraster renders SVG documents into bitmaps.
+//
+// It covers the subset of SVG that icons use: paths and basic shapes, solid
+// and gradient fills and strokes, transforms, <use> and simple stylesheets.
+// Text, filters, clipping, masks, patterns, markers, dashes and embedded
+// images are ignored. It never loads external resources.
+package svgraster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"maps"
+	"math"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+var (
+	ErrNotSVG = errors.New("svgraster: not an svg document")
+	errSize   = errors.New("svgraster: invalid image size")
+)
+
+const (
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+
+	// Limits against documents that expand to huge amounts of work, like
+	// nested <use> elements referencing each other.
+	maxDepth    = 64
+	maxElements = 20000
+	maxLayers   = 4
+)
+
+// Render rasterizes the SVG document in data into a width x height image.
+// The document is scaled to fit, keeping its aspect ratio, and centered on
+// a transparent background.
+func Render(data []byte, width, height int) (*image.RGBA, error) {
+	if width <= 0 || height <= 0 {
+		return nil, errSize
+	}
+
+	root, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRenderer(root)
+	c := newCanvas(width, height)
+	r.renderRoot(c, root)
+	return c.image(), nil
+}
+
+// RenderPNG rasterizes the SVG document in data into a size x size PNG.
+func RenderPNG(data []byte, size int, out io.Writer) error {
+	img, err := Render(data, size, size)
+	if err != nil {
+		return err
+	}
+
+	b := bufio.NewWriter(out)
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	err = encoder.Encode(b, img)
+	if err != nil {
+		return err
+	}
+	return b.Flush()
+}
+
+type node struct {
+	name     string
+	attrs    map[string]string
+	children []*node
+	text     string
+}
+
+func parseDocument(data []byte) (*node, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.CharsetReader = charset.NewReaderLabel
+	d.Entity = xml.HTMLEntity
+
+	var root *node
+	var open []*node
+	skip := 0 // depth inside foreign elements
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			if skip > 0 || (t.Name.Space != "" && t.Name.Space != svgNamespace) {
+				skip++
+				continue
+			}
+			n := &node{name: t.Name.Local, attrs: map[string]string{}}
+			for _, a := range t.Attr {
+				if a.Name.Space == "" || a.Name.Space == xlinkNamespace || a.Name.Space == "xlink" {
+					n.attrs[a.Name.Local] = strings.TrimSpace(a.Value)
+				}
+			}
+			if root == nil {
+				if n.name != "svg" {
+					return nil, ErrNotSVG
+				}
+				root = n
+			} else {
+				parent := open[len(open)-1]
+				parent.children = append(parent.children, n)
+			}
+			open = append(open, n)
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			open = open[:len(open)-1]
+		case xml.CharData:
+			if skip == 0 && len(open) > 0 {
+				open[len(open)-1].text += string(t)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, ErrNotSVG
+	}
+	return root, nil
+}
+
+// properties are the computed style properties of an element.
+type properties map[string]string
+
+// Properties inherited by child elements.
+var inheritedProperties = map[string]bool{
+	"color":             true,
+	"fill":              true,
+	"fill-opacity":      true,
+	"fill-rule":         true,
+	"stroke":            true,
+	"stroke-linecap":    true,
+	"stroke-linejoin":   true,
+	"stroke-miterlimit": true,
+	"stroke-opacity":    true,
+	"stroke-width":      true,
+	"visibility":        true,
+}
+
+// Properties that may be given as attributes, too.
+var presentationAttributes = []string{
+	"color", "display", "fill", "fill-opacity", "fill-rule", "opacity",
+	"stop-color", "stop-opacity", "stroke", "stroke-linecap",
+	"stroke-linejoin", "stroke-miterlimit", "stroke-opacity", "stroke-width",
+	"visibility",
+}
+
+type renderer struct {
+	root   *node
+	ids    map[string]*node
+	rules  []cssRule
+	budget int
+	layers int
+}
+
+func newRenderer(root *node) *renderer {
+	r := &renderer{root: root, ids: map[string]*node{}, budget: maxElements}
+
+	var index func(n *node)
+	index = func(n *node) {
+		if id := n.attrs["id"]; id != "" {
+			if _, dup := r.ids[id]; !dup {
+				r.ids[id] = n
+			}
+		}
+		if n.name == "style" {
+			r.rules = append(r.rules, parseStylesheet(n.text, len(r.rules))...)
+		}
+		for _, c := range n.children {
+			index(c)
+		}
+	}
+	index(root)
+	sortRules(r.rules)
+	return r
+}
+
+// computeStyle cascades presentation attributes, stylesheet rules and the
+// style attribute of n, in that order, on top of what n inherits.
+func (r *renderer) computeStyle(n *node, parent properties) properties {
+	declared := properties{}
+	for _, name := range presentationAttributes {
+		if v, ok := n.attrs[name]; ok {
+			declared[name] = v
+		}
+	}
+	for _, rule := range r.rules {
+		if rule.selector.matches(n) {
+			for _, d := range rule.declarations {
+				declared[d.property] = d.value
+			}
+		}
+	}
+	for _, d := range parseDeclarations(n.attrs["style"]) {
+		declared[d.property] = d.value
+	}
+
+	style := properties{}
+	for k, v := range parent {
+		if inheritedProperties[k] {
+			style[k] = v
+		}
+	}
+	for k, v := range declared {
+		if v == "inherit" {
+			if pv, ok := parent[k]; ok {
+				style[k] = pv
+			}
+			continue
+		}
+		style[k] = v
+	}
+	return style
+}
+
+// state is what an element inherits from its ancestors, apart from style.
+type state struct {
+	ctm            matrix
+	style          properties
+	viewportWidth  float64
+	viewportHeight float64
+	depth          int
+}
+
+func (r *renderer) renderRoot(c *canvas, root *node) {
+	w, h := float64(c.width), float64(c.height)
+	docWidth, hasWidth := parseAbsoluteLength(root.attrs["width"])
+	docHeight, hasHeight := parseAbsoluteLength(root.attrs["height"])
+	vb, hasViewBox := parseViewBox(root.attrs["viewBox"])
+
+	switch {
+	case hasWidth && hasHeight:
+	case hasWidth && hasViewBox:
+		docHeight = docWidth * vb[3] / vb[2]
+	case hasHeight && hasViewBox:
+		docWidth = docHeight * vb[2] / vb[3]
+	case hasViewBox:
+		docWidth, docHeight = vb[2], vb[3]
+	default:
+		docWidth, docHeight = w, h
+	}
+
+	// fit the document into the canvas, then its viewBox into the document
+	s := math.Min(w/docWidth, h/docHeight)
+	ctm := translate((w-docWidth*s)/2, (h-docHeight*s)/2).mul(scale(s, s))
+	st := state{ctm: ctm, viewportWidth: docWidth, viewportHeight: docHeight}
+	if hasViewBox {
+		st.ctm = ctm.mul(viewBoxTransform(vb, root.attrs["preserveAspectRatio"], docWidth, docHeight))
+		st.viewportWidth, st.viewportHeight = vb[2], vb[3]
+	}
+	r.render(c, root, st)
+}
+
+func (r *renderer) render(c *canvas, n *node, st state) {
+	r.budget--
+	if r.budget < 0 || st.depth > maxDepth {
+		return
+	}
+
+	style := r.computeStyle(n, st.style)
+	if style["display"] == "none" {
+		return
+	}
+	child := st
+	child.style = style
+	child.depth++
+	if n != r.root {
+		child.ctm = st.ctm.mul(parseTransform(n.attrs["transform"]))
+	}
+
+	if opacity := parseOpacity(style["opacity"]); opacity < 1 {
+		if opacity <= 0 {
+			return
+		}
+		// group opacity needs an offscreen layer, past maxLayers we
+		// rather draw opaque than allocate more
+		if r.layers < maxLayers {
+			r.layers++
+			layer := newCanvas(c.width, c.height)
+			r.renderContent(layer, n, child)
+			c.composite(layer, opacity)
+			r.layers--
+			return
+		}
+	}
+	r.renderContent(c, n, child)
+}
+
+func (r *renderer) renderContent(c *canvas, n *node, st state) {
+	switch n.name {
+	case "svg":
+		if n != r.root {
+			st = r.nestedViewport(n, st)
+		}
+		r.renderChildren(c, n, st)
+	case "g", "a":
+		r.renderChildren(c, n, st)
+	case "switch":
+		// we don't evaluate conditions, so take the first child
+		if len(n.children) > 0 {
+			r.render(c, n.children[0], st)
+		}
+	case "use":
+		r.renderUse(c, n, st)
+	case "path", "rect", "circle", "ellipse", "line", "polyline", "polygon":
+		r.renderShape(c, n, st)
+	}
+}
+
+func (r *renderer) renderChildren(c *canvas, n *node, st state) {
+	for _, child := range n.children {
+		r.render(c, child, st)
+	}
+}
+
+func (r *renderer) nestedViewport(n *node, st state) state {
+	x, _ := parseLength(n.attrs["x"], st.viewportWidth)
+	y, _ := parseLength(n.attrs["y"], st.viewportHeight)
+	w, hasWidth := parseLength(n.attrs["width"], st.viewportWidth)
+	h, hasHeight := parseLength(n.attrs["height"], st.viewportHeight)
+	if !hasWidth {
+		w = st.viewportWidth
+	}
+	if !hasHeight {
+		h = st.viewportHeight
+	}
+
+	st.ctm = st.ctm.mul(translate(x, y))
+	st.viewportWidth, st.viewportHeight = w, h
+	if vb, ok := parseViewBox(n.attrs["viewBox"]); ok {
+		st.ctm = st.ctm.mul(viewBoxTransform(vb, n.attrs["preserveAspectRatio"], w, h))
+		st.viewportWidth, st.viewportHeight = vb[2], vb[3]
+	}
+	return st
+}
+
+func (r *renderer) renderUse(c *canvas, n *node, st state) {
+	target := r.reference(n.attrs["href"])
+	if target == nil {
+		return
+	}
+
+	x, _ := parseLength(n.attrs["x"], st.viewportWidth)
+	y, _ := parseLength(n.attrs["y"], st.viewportHeight)
+	st.ctm = st.ctm.mul(translate(x, y))
+
+	if target.name == "symbol" {
+		symbol := *target
+		symbol.name = "svg"
+		symbol.attrs = maps.Clone(target.attrs)
+		for _, a := range []string{"width", "height"} {
+			if v, ok := n.attrs[a]; ok {
+				symbol.attrs[a] = v
+			}
+		}
+		r.render(c, &symbol, st)
+		return
+	}
+	r.render(c, target, st)
+}
+
+// reference returns the element a local reference like "#id" points to.
+func (r *renderer) reference(ref string) *node {
+	id, ok := strings.CutPrefix(strings.TrimSpace(ref), "#")
+	if !ok {
+		return nil
+	}
+	return r.ids[id]
+}
+
+func (r *renderer) renderShape(c *canvas, n *node, st state) {
+	if v := st.style["visibility"]; v == "hidden" || v == "collapse" {
+		return
+	}
+	s := st.ctm.scale()
+	if s == 0 || math.IsNaN(s) {
+		return
+	}
+
+	p := &path{tolerance: 0.1 / s}
+	r.buildShape(p, n, st)
+	if len(p.subpaths) == 0 {
+		return
+	}
+
+	fill := r.painter(st.style["fill"], "black", p, st)
+	if fill != nil {
+		polys := make([][]point, len(p.subpaths))
+		for i, sp := range p.subpaths {
+			polys[i] = transformPoints(sp.points, st.ctm)
+		}
+		c.fill(polys, st.style["fill-rule"] == "evenodd", fill, parseOpacity(st.style["fill-opacity"]))
+	}
+
+	stroke := r.painter(st.style["stroke"], "none", p, st)
+	if stroke == nil {
+		return
+	}
+	width := 1.0
+	if v, ok := st.style["stroke-width"]; ok {
+		width, _ = parseLength(v, diagonal(st))
+	}
+	if width <= 0 {
+		return
+	}
+	miterLimit, ok := parseNumber(st.style["stroke-miterlimit"])
+	if !ok || miterLimit < 1 {
+		miterLimit = 4
+	}
+	outline := strokePolygons(p.subpaths, strokeStyle{
+		width:      width,
+		cap:        st.style["stroke-linecap"],
+		join:       st.style["stroke-linejoin"],
+		miterLimit: miterLimit,
+	}, p.tolerance)
+	for i := range outline {
+		outline[i] = transformPoints(outline[i], st.ctm)
+	}
+	c.fill(outline, false, stroke, parseOpacity(st.style["stroke-opacity"]))
+}
+
+func (r *renderer) buildShape(p *path, n *node, st state) {
+	vw, vh, diag := st.viewportWidth, st.viewportHeight, diagonal(st)
+	length := func(name string, ref float64) float64 {
+		v, _ := parseLength(n.attrs[name], ref)
+		return v
+	}
+
+	switch n.name {
+	case "path":
+		parsePathData(n.attrs["d"], p)
+	case "rect":
+		w, h := length("width", vw), length("height", vh)
+		if w <= 0 || h <= 0 {
+			return
+		}
+		rx, hasRx := parseLength(n.attrs["rx"], vw)
+		ry, hasRy := parseLength(n.attrs["ry"], vh)
+		if !hasRx {
+			rx = ry
+		}
+		if !hasRy {
+			ry = rx
+		}
+		p.rect(length("x", vw), length("y", vh), w, h, rx, ry)
+	case "circle":
+		if radius := length("r", diag); radius > 0 {
+			p.ellipse(length("cx", vw), length("cy", vh), radius, radius)
+		}
+	case "ellipse":
+		rx, ry := length("rx", vw), length("ry", vh)
+		if rx > 0 && ry > 0 {
+			p.ellipse(length("cx", vw), length("cy", vh), rx, ry)
+		}
+	case "line":
+		p.moveTo(point{length("x1", vw), length("y1", vh)})
+		p.lineTo(point{length("x2", vw), length("y2", vh)})
+	case "polyline", "polygon":
+		points := parsePoints(n.attrs["points"])
+		if len(points) == 0 {
+			return
+		}
+		p.moveTo(points[0])
+		for _, pt := range points[1:] {
+			p.lineTo(pt)
+		}
+		if n.name == "polygon" {
+			p.close()
+		}
+	}
+}
+
+// painter resolves a fill or stroke value for the shape p. It returns nil
+// for "none".
+func (r *renderer) painter(value, initial string, p *path, st state) painter {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		value = initial
+	}
+
+	if rest, ok := strings.CutPrefix(value, "url("); ok {
+		ref, fallback, _ := strings.Cut(rest, ")")
+		ref = strings.Trim(strings.TrimSpace(ref), `'"`)
+		if g := r.gradient(r.reference(ref), p, st); g != nil {
+			return g
+		}
+		value = strings.TrimSpace(fallback)
+		if value == "" {
+			return nil
+		}
+	}
+
+	switch value {
+	case "none":
+		return nil
+	case "currentColor", "currentcolor":
+		value = st.style["color"]
+	}
+	col, ok := parseColor(value)
+	if !ok {
+		if value != "" {
+			return nil
+		}
+		col = rgba{0, 0, 0, 1}
+	}
+	return solid(col)
+}
+
+// gradient returns the painter for the gradient element n used on the
+// shape p, or nil if n is no usable gradient.
+func (r *renderer) gradient(n *node, p *path, st state) painter {
+	if n == nil || (n.name != "linearGradient" && n.name != "radialGradient") {
+		return nil
+	}
+
+	// gradients inherit attributes and stops through href chains
+	chain := []*node{n}
+	for len(chain) < 8 {
+		next := r.reference(chain[len(chain)-1].attrs["href"])
+		if next == nil || (next.name != "linearGradient" && next.name != "radialGradient") {
+			break
+		}
+		chain = append(chain, next)
+	}
+	attr := func(name string) (string, bool) {
+		for _, g := range chain {
+			if v, ok := g.attrs[name]; ok {
+				return v, true
+			}
+		}
+		return "", false
+	}
+
+	var stops []gradientStop
+	for _, g := range chain {
+		stops = r.gradientStops(g, st)
+		if len(stops) > 0 {
+			break
+		}
+	}
+	if len(stops) == 0 {
+		return nil
+	}
+	if len(stops) == 1 {
+		return solid(stops[0].color)
+	}
+
+	// gradient space to user space
+	userSpace, _ := attr("gradientUnits")
+	space := identity
+	refWidth, refHeight := 1.0, 1.0
+	if userSpace == "userSpaceOnUse" {
+		refWidth, refHeight = st.viewportWidth, st.viewportHeight
+	} else {
+		min, max := p.bounds()
+		if max.x-min.x <= 0 || max.y-min.y <= 0 {
+			return nil
+		}
+		space = translate(min.x, min.y).mul(scale(max.x-min.x, max.y-min.y))
+	}
+	transform, _ := attr("gradientTransform")
+	toGradient, ok := st.ctm.mul(space).mul(parseTransform(transform)).invert()
+	if !ok {
+		return nil
+	}
+
+	coord := func(name, initial string, ref float64) float64 {
+		v, ok := attr(name)
+		if !ok {
+			v = initial
+		}
+		f, _ := parseLength(v, ref)
+		return f
+	}
+	spread, _ := attr("spreadMethod")
+	g := &gradient{toGradient: toGradient, spread: spread, stops: stops}
+	if n.name == "radialGradient" {
+		g.radial = true
+		g.cx = coord("cx", "50%", refWidth)
+		g.cy = coord("cy", "50%", refHeight)
+		g.r = coord("r", "50%", math.Sqrt((refWidth*refWidth+refHeight*refHeight)/2))
+		g.fx, g.fy = g.cx, g.cy
+		if _, ok := attr("fx"); ok {
+			g.fx = coord("fx", "", refWidth)
+		}
+		if _, ok := attr("fy"); ok {
+			g.fy = coord("fy", "", refHeight)
+		}
+		if g.r <= 0 {
+			return solid(stops[len(stops)-1].color)
+		}
+	} else {
+		g.x1 = coord("x1", "0%", refWidth)
+		g.y1 = coord("y1", "0%", refHeight)
+		g.x2 = coord("x2", "100%", refWidth)
+		g.y2 = coord("y2", "0%", refHeight)
+		if g.x1 == g.x2 && g.y1 == g.y2 {
+			return solid(stops[len(stops)-1].color)
+		}
+	}
+	return g
+}
+
+func (r *renderer) gradientStops(g *node, st state) []gradientStop {
+	var stops []gradientStop
+	for _, s := range g.children {
+		if s.name != "stop" {
+			continue
+		}
+		style := r.computeStyle(s, st.style)
+
+		offset, _ := parseLength(s.attrs["offset"], 1)
+		offset = math.Max(0, math.Min(1, offset))
+		if len(stops) > 0 {
+			offset = math.Max(offset, stops[len(stops)-1].offset)
+		}
+
+		value := style["stop-color"]
+		if value == "currentColor" || value == "currentcolor" {
+			value = style["color"]
+		}
+		col, ok := parseColor(value)
+		if !ok {
+			col = rgba{0, 0, 0, 1}
+		}
+		col.a *= parseOpacity(style["stop-opacity"])
+		stops = append(stops, gradientStop{offset, col})
+	}
+	return stops
+}
+
+func transformPoints(points []point, m matrix) []point {
+	out := make([]point, len(points))
+	for i, p := range points {
+		out[i] = m.apply(p)
+	}
+	return out
+}
+
+// diagonal is the reference for percentages that are neither horizontal nor
+// vertical, like a circle's radius.
+func diagonal(st state) float64 {
+	return math.Sqrt((st.viewportWidth*st.viewportWidth + st.viewportHeight*st.viewportHeight) / 2)
+}
+
+// viewBoxTransform maps the viewBox vb into a viewport of the given size
+// according to preserveAspectRatio.
+func viewBoxTransform(vb [4]float64, preserveAspectRatio string, width, height float64) matrix {
+	sx, sy := width/vb[2], height/vb[3]
+	fields := strings.Fields(preserveAspectRatio)
+	align, meetOrSlice := "xmidymid", "meet"
+	if len(fields) > 0 {
+		align = strings.ToLower(fields[0])
+	}
+	if len(fields) > 1 {
+		meetOrSlice = strings.ToLower(fields[1])
+	}
+	if align == "none" {
+		return scale(sx, sy).mul(translate(-vb[0], -vb[1]))
+	}
+
+	s := math.Min(sx, sy)
+	if meetOrSlice == "slice" {
+		s = math.Max(sx, sy)
+	}
+	tx, ty := -vb[0]*s, -vb[1]*s
+	switch {
+	case strings.HasPrefix(align, "xmid"):
+		tx += (width - vb[2]*s) / 2
+	case strings.HasPrefix(align, "xmax"):
+		tx += width - vb[2]*s
+	}
+	switch {
+	case strings.HasSuffix(align, "ymid"):
+		ty += (height - vb[3]*s) / 2
+	case strings.HasSuffix(align, "ymax"):
+		ty += height - vb[3]*s
+	}
+	return translate(tx, ty).mul(scale(s, s))
+}
+
+func parseViewBox(s string) ([4]float64, bool) {
+	var vb [4]float64
+	numbers, ok := parseNumbers(s)
+	if !ok || len(numbers) != 4 || numbers[2] <= 0 || numbers[3] <= 0 {
+		return vb, false
+	}
+	copy(vb[:], numbers)
+	return vb, true
+}
+
+// Pixels per unit of absolute lengths.
+var lengthUnits = map[string]float64{
+	"":   1,
+	"px": 1,
+	"pt": 4.0 / 3,
+	"pc": 16,
+	"in": 96,
+	"cm": 96 / 2.54,
+	"mm": 96 / 25.4,
+	"em": 16,
+	"ex": 8,
+}
+
+// parseLength parses a length in user units. Percentages are relative to
+// ref.
+func parseLength(s string, ref float64) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		f, ok := parseNumber(pct)
+		return f * ref / 100, ok
+	}
+
+	num := strings.TrimRight(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	factor, ok := lengthUnits[strings.ToLower(s[len(num):])]
+	if !ok {
+		return 0, false
+	}
+	f, ok := parseNumber(num)
+	return f * factor, ok
+}
+
+// parseAbsoluteLength parses the size of the root element, where relative
+// values say nothing about the drawing.
+func parseAbsoluteLength(s string) (float64, bool) {
+	if strings.HasSuffix(s, "%") {
+		return 0, false
+	}
+	f, ok := parseLength(s, 0)
+	return f, ok && f > 0
+}
+
+func parseNumber(s string) (float64, bool) {
+	sc := &scanner{s: strings.TrimSpace(s)}
+	f, ok := sc.number()
+	if !ok || !sc.done() {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseOpacity parses opacity values, which default to 1.
+func parseOpacity(s string) float64 {
+	if s == "" {
+		return 1
+	}
+	f, ok := parseFraction(strings.TrimSpace(s), 1)
+	if !ok {
+		return 1
+	}
+	return f
+}
@@ -0,0 +1,299 @@
+package svgraster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+var (
+	transparent = color.RGBA{}
+	red         = color.RGBA{255, 0, 0, 255}
+	green       = color.RGBA{0, 128, 0, 255}
+	blue        = color.RGBA{0, 0, 255, 255}
+	black       = color.RGBA{0, 0, 0, 255}
+)
+
+func TestRenderRect(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 10"><rect x="5" width="5" height="10" fill="red"/></svg>`, 20)
+	assertPixel(t, img, 5, 10, transparent)
+	assertPixel(t, img, 15, 10, red)
+}
+
+func TestRenderDefaultFillIsBlack(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><path d="M0 0H10V10H0Z"/></svg>`, 10)
+	assertPixel(t, img, 5, 5, black)
+}
+
+func TestRenderAntialiasesEdges(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="5.5" height="10"/></svg>`, 10)
+	assertEquals(t, uint8(128), img.RGBAAt(5, 5).A)
+}
+
+func TestRenderCircleAndEllipse(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">
+		<circle cx="50" cy="50" r="40" fill="blue"/>
+		<ellipse cx="50" cy="50" rx="10" ry="40" fill="red"/>
+	</svg>`, 100)
+	assertPixel(t, img, 50, 50, red)
+	assertPixel(t, img, 30, 50, blue)
+	assertPixel(t, img, 12, 12, transparent)
+}
+
+func TestRenderFillRules(t *testing.T) {
+	square := `M0 0H10V10H0Z M3 3H7V7H3Z`
+	nonzero := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><path d="`+square+`"/></svg>`, 10)
+	assertPixel(t, nonzero, 5, 5, black)
+
+	evenodd := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><path fill-rule="evenodd" d="`+square+`"/></svg>`, 10)
+	assertPixel(t, evenodd, 5, 5, transparent)
+	assertPixel(t, evenodd, 1, 1, black)
+}
+
+func TestRenderPathCommands(t *testing.T) {
+	// relative commands, implicit lineto, curves and an arc in compact notation
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">
+		<path d="m10 10 20 0v20h-20z"/>
+		<path d="M60 10c10 0 30 0 30 20s-20 20-30 20z" fill="red"/>
+		<path d="M10 60q20 0 20 20t-20 20z" fill="blue"/>
+		<path d="M60 80a20 20 0 1 1 30 0z" fill="green"/>
+	</svg>`, 100)
+	assertPixel(t, img, 20, 20, black)
+	assertPixel(t, img, 70, 30, red)
+	assertPixel(t, img, 15, 80, blue)
+	assertPixel(t, img, 75, 70, green)
+	assertPixel(t, img, 45, 45, transparent)
+}
+
+func TestRenderTransforms(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">
+		<g transform="translate(50 0)"><rect width="50" height="50" fill="red"/></g>
+		<rect width="50" height="10" fill="blue" transform="rotate(90 0 0) translate(50 -50)"/>
+		<rect width="8" height="10" transform="matrix(2 0 0 2 0 50) scale(2.5)"/>
+	</svg>`, 100)
+	assertPixel(t, img, 75, 25, red)
+	assertPixel(t, img, 25, 25, transparent)
+	assertPixel(t, img, 45, 75, blue)
+	assertPixel(t, img, 20, 70, black)
+}
+
+func TestRenderStroke(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">
+		<polyline points="10,10 90,10 90,90" fill="none" stroke="red" stroke-width="10"/>
+		<line x1="10" y1="50" x2="50" y2="50" stroke="blue" stroke-width="10" stroke-linecap="round"/>
+	</svg>`, 100)
+	assertPixel(t, img, 50, 10, red)
+	assertPixel(t, img, 94, 6, red) // miter join
+	assertPixel(t, img, 70, 50, transparent)
+	assertPixel(t, img, 30, 53, blue)
+	assertPixel(t, img, 7, 50, blue) // round cap
+	assertPixel(t, img, 30, 30, transparent)
+}
+
+func TestRenderLinearGradient(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 100 100">
+		<defs>
+			<linearGradient id="stops"><stop offset="0" stop-color="red"/><stop offset="100%" stop-color="blue"/></linearGradient>
+			<linearGradient id="g" xlink:href="#stops"/>
+		</defs>
+		<rect width="100" height="100" fill="url(#g)"/>
+	</svg>`, 100)
+	assertPixel(t, img, 0, 50, color.RGBA{254, 0, 1, 255})
+	assertPixel(t, img, 99, 50, color.RGBA{1, 0, 254, 255})
+	assertPixel(t, img, 50, 0, color.RGBA{126, 0, 129, 255})
+}
+
+func TestRenderRadialGradient(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 100">
+		<radialGradient id="g" gradientUnits="userSpaceOnUse" cx="50" cy="50" r="50">
+			<stop offset="0" style="stop-color:#fff"/><stop offset="1" stop-color="#000"/>
+		</radialGradient>
+		<rect width="100" height="100" fill="url(#g) red"/>
+		<rect width="10" height="10" fill="url(#missing) blue"/>
+	</svg>`, 100)
+	center := img.RGBAAt(50, 50)
+	if center.R < 250 {
+		t.Errorf("expected center to be white, got %v", center)
+	}
+	assertPixel(t, img, 99, 50, color.RGBA{3, 3, 3, 255})
+	assertPixel(t, img, 5, 5, blue)
+}
+
+func TestRenderStylesheet(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 30 10">
+		<style><![CDATA[
+			/* generated by some editor */
+			.a { fill: red }
+			rect.a.b, #c { fill:blue !important; }
+			path:hover { fill: green }
+			@media (prefers-color-scheme: dark) { .a { fill: green } }
+		]]></style>
+		<rect class="a" width="10" height="10" fill="green"/>
+		<rect class="a b" x="10" width="10" height="10"/>
+		<rect class="a" id="c" x="20" width="10" height="10" style="fill: currentColor" color="#00f"/>
+	</svg>`, 30)
+	assertPixel(t, img, 5, 15, red)
+	assertPixel(t, img, 15, 15, blue)
+	assertPixel(t, img, 25, 15, blue)
+}
+
+func TestRenderInheritance(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 30 10" fill="red">
+		<g><rect width="10" height="10"/></g>
+		<g fill="blue"><rect x="10" width="10" height="10"/></g>
+		<g display="none"><rect x="20" width="10" height="10"/></g>
+	</svg>`, 30)
+	assertPixel(t, img, 5, 15, red)
+	assertPixel(t, img, 15, 15, blue)
+	assertPixel(t, img, 25, 15, transparent)
+}
+
+func TestRenderUse(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 30 10">
+		<defs><rect id="r" width="10" height="10"/></defs>
+		<symbol id="s" viewBox="0 0 1 1"><rect width="1" height="1" fill="blue"/></symbol>
+		<use xlink:href="#r" fill="red"/>
+		<use href="#s" x="20" width="10" height="10"/>
+		<use id="loop" href="#loop"/>
+	</svg>`, 30)
+	assertPixel(t, img, 5, 15, red)
+	assertPixel(t, img, 15, 15, transparent)
+	assertPixel(t, img, 25, 15, blue)
+}
+
+func TestRenderGroupOpacity(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10">
+		<g opacity="0.5"><rect width="10" height="10" fill="red"/><rect width="10" height="10" fill="blue"/></g>
+	</svg>`, 10)
+	// overlapping shapes in a group don't shine through each other
+	assertPixel(t, img, 5, 5, color.RGBA{0, 0, 128, 128})
+}
+
+func TestRenderKeepsAspectRatio(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" width="200" height="100"><rect width="200" height="100" fill="red"/></svg>`, 100)
+	assertPixel(t, img, 50, 10, transparent)
+	assertPixel(t, img, 50, 50, red)
+	assertPixel(t, img, 50, 90, transparent)
+}
+
+func TestRenderIgnoresForeignContent(t *testing.T) {
+	img := mustRender(t, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:sodipodi="http://sodipodi.sourceforge.net/DTD/sodipodi-0.dtd" width="10" height="10">
+		<sodipodi:namedview><rect width="10" height="10"/></sodipodi:namedview>
+		<text>Hi</text>
+		<image href="http://example.com/x.png" width="10" height="10"/>
+	</svg>`, 10)
+	assertPixel(t, img, 5, 5, transparent)
+}
+
+func TestRenderErrors(t *testing.T) {
+	_, err := Render([]byte(`<html><body></body></html>`), 10, 10)
+	if !errors.Is(err, ErrNotSVG) {
+		t.Errorf("expected ErrNotSVG, got %v", err)
+	}
+
+	_, err = Render([]byte(`<svg xmlns="http://www.w3.org/2000/svg"><g></svg>`), 10, 10)
+	if err == nil {
+		t.Error("expected error for malformed document")
+	}
+
+	_, err = Render([]byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), 0, 10)
+	if err == nil {
+		t.Error("expected error for empty size")
+	}
+}
+
+func TestRenderPNG(t *testing.T) {
+	var buf bytes.Buffer
+	err := RenderPNG([]byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 16 16"><circle cx="8" cy="8" r="8" fill="#f00"/></svg>`), 48, &buf)
+	check(t, err)
+
+	img, err := png.Decode(&buf)
+	check(t, err)
+	assertEquals(t, image.Rect(0, 0, 48, 48), img.Bounds())
+	assertEquals(t, color.Color(red), color.RGBAModel.Convert(img.At(24, 24)))
+}
+
+func TestParseColor(t *testing.T) {
+	tests := map[string]rgba{
+		"#f00":                    {1, 0, 0, 1},
+		"#FF000080":               {1, 0, 0, 128.0 / 255},
+		"rgb(255, 0, 0)":          {1, 0, 0, 1},
+		"rgba(100%,0%,0%,0.5)":    {1, 0, 0, 0.5},
+		"rgb(255 0 0 / 50%)":      {1, 0, 0, 0.5},
+		"hsl(120, 100%, 50%)":     {0, 1, 0, 1},
+		"RebeccaPurple":           {0x66 / 255.0, 0x33 / 255.0, 0x99 / 255.0, 1},
+		"transparent":             {0, 0, 0, 0},
+		" white ":                 {1, 1, 1, 1},
+		"hsla(240deg,100%,50%,1)": {0, 0, 1, 1},
+	}
+	for s, expected := range tests {
+		c, ok := parseColor(s)
+		if !ok {
+			t.Errorf("could not parse %q", s)
+			continue
+		}
+		assertEquals(t, expected, c)
+	}
+
+	for _, s := range []string{"", "#ff", "nocolor", "rgb(1,2)", "url(#x)"} {
+		if _, ok := parseColor(s); ok {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestParseNumbers(t *testing.T) {
+	numbers, ok := parseNumbers("1.5.5-2e1,3 ,4")
+	assertEquals(t, true, ok)
+	assertEquals(t, []float64{1.5, 0.5, -20, 3, 4}, numbers)
+
+	_, ok = parseNumbers("1,,2")
+	assertEquals(t, false, ok)
+}
+
+func TestParseTransform(t *testing.T) {
+	assertEquals(t, matrix{2, 0, 0, 3, 10, 0}, parseTransform("translate(10) scale(2,3)"))
+	assertEquals(t, identity, parseTransform("scale(2) bogus(1)"))
+	assertEquals(t, identity, parseTransform("matrix(1 2 3)"))
+}
+
+func mustRender(t *testing.T, svg string, size int) *image.RGBA {
+	t.Helper()
+	img, err := Render([]byte(svg), size, size)
+	if err != nil {
+		t.Fatalf("could not render: %s", err)
+	}
+	return img
+}
+
+func assertPixel(t *testing.T, img *image.RGBA, x, y int, expected color.RGBA) {
+	t.Helper()
+	actual := img.RGBAAt(x, y)
+	if actual != expected {
+		t.Errorf("expected pixel (%d, %d) to be %v, got %v", x, y, expected, actual)
+	}
+}
+
+func check(t *testing.T, err error) {
+	if err != nil {
+		fail(t, fmt.Sprintf("Unexpected error:  %#v", err))
+	}
+}
+
+func assertEquals(t *testing.T, expected, actual any) {
+	if !reflect.DeepEqual(expected, actual) {
+		fail(t, fmt.Sprintf("Not equal: %#v (expected)\n"+
+			"        != %#v (actual)", expected, actual))
+	}
+}
+
+func fail(t *testing.T, failureMessage string) {
+	t.Errorf("\t%s\n"+
+		"\r\t",
+		failureMessage)
+}
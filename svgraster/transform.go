@@ -0,0 +1,127 @@
+package svgraster
+
+import (
+	"math"
+	"regexp"
+	"strings"
+)
+
+// matrix is an affine transform [a b c d e f], mapping (x, y) to
+// (a*x + c*y + e, b*x + d*y + f) like SVG's matrix().
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the transform applying n first and m second.
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m matrix) apply(p point) point {
+	return point{m[0]*p.x + m[2]*p.y + m[4], m[1]*p.x + m[3]*p.y + m[5]}
+}
+
+func (m matrix) invert() (matrix, bool) {
+	det := m[0]*m[3] - m[1]*m[2]
+	if det == 0 || math.IsNaN(det) || math.IsInf(det, 0) {
+		return identity, false
+	}
+	return matrix{
+		m[3] / det,
+		-m[1] / det,
+		-m[2] / det,
+		m[0] / det,
+		(m[2]*m[5] - m[3]*m[4]) / det,
+		(m[1]*m[4] - m[0]*m[5]) / det,
+	}, true
+}
+
+// scale is the average factor by which m stretches lengths.
+func (m matrix) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+func translate(x, y float64) matrix {
+	return matrix{1, 0, 0, 1, x, y}
+}
+
+func scale(x, y float64) matrix {
+	return matrix{x, 0, 0, y, 0, 0}
+}
+
+func rotate(degrees float64) matrix {
+	s, c := math.Sincos(degrees * math.Pi / 180)
+	return matrix{c, s, -s, c, 0, 0}
+}
+
+var transformRe = regexp.MustCompile(`([a-zA-Z]+)\s*\(([^)]*)\)`)
+
+// parseTransform parses the value of a transform attribute. Unknown or
+// malformed functions make the whole list invalid, which SVG renders as if
+// there was no transform at all.
+func parseTransform(s string) matrix {
+	m := identity
+	for _, f := range transformRe.FindAllStringSubmatch(s, -1) {
+		args, ok := parseNumbers(f[2])
+		if !ok {
+			return identity
+		}
+
+		var t matrix
+		switch n := len(args); strings.ToLower(f[1]) {
+		case "matrix":
+			if n != 6 {
+				return identity
+			}
+			copy(t[:], args)
+		case "translate":
+			switch n {
+			case 1:
+				t = translate(args[0], 0)
+			case 2:
+				t = translate(args[0], args[1])
+			default:
+				return identity
+			}
+		case "scale":
+			switch n {
+			case 1:
+				t = scale(args[0], args[0])
+			case 2:
+				t = scale(args[0], args[1])
+			default:
+				return identity
+			}
+		case "rotate":
+			switch n {
+			case 1:
+				t = rotate(args[0])
+			case 3:
+				t = translate(args[1], args[2]).mul(rotate(args[0])).mul(translate(-args[1], -args[2]))
+			default:
+				return identity
+			}
+		case "skewx":
+			if n != 1 {
+				return identity
+			}
+			t = matrix{1, 0, math.Tan(args[0] * math.Pi / 180), 1, 0, 0}
+		case "skewy":
+			if n != 1 {
+				return identity
+			}
+			t = matrix{1, math.Tan(args[0] * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			return identity
+		}
+		m = m.mul(t)
+	}
+	return m
+}